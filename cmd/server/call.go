@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/thingful/big-iot-gateway/gw"
+)
+
+var callCmd = &cobra.Command{
+	Use:   "call <offeringID>",
+	Short: "Call an offering endpoint of the gateway as a consumer",
+	Long: `Call an offering endpoint of the gateway with a token minted for it, or
+the one given with --token, and print the response.
+
+The gateway is reached at --url, which defaults to the offering endpoint or
+http://localhost:<HTTPPort> when it isn't set.
+
+Formats:
+  json   indented json
+  raw    the response as received
+  jsonl  a record per line
+  csv    a row per record, with a column per field`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		baseURL, _ := flags.GetString("url")
+		token, _ := flags.GetString("token")
+		format, _ := flags.GetString("format")
+		timeout, _ := flags.GetDuration("timeout")
+
+		if format != "json" && format != "raw" && format != "jsonl" && format != "csv" {
+			return fmt.Errorf("unknown call format %s", format)
+		}
+
+		config, offerings, err := configAndOffers()
+		if err != nil {
+			return err
+		}
+
+		if token == "" {
+			token, err = gw.MintToken(config, offerings, args[0], tokenClaims(flags))
+			if err != nil {
+				return err
+			}
+		}
+
+		if baseURL == "" {
+			baseURL = config.OfferingEndPoint
+		}
+		if baseURL == "" {
+			baseURL = fmt.Sprintf("http://localhost:%d", config.HTTPPort)
+		}
+		endpoint := strings.TrimRight(baseURL, "/") + "/offering/" + strings.ToLower(args[0])
+
+		req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		client := &http.Client{Timeout: timeout}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s answered %s: %s", endpoint, resp.Status, strings.TrimSpace(string(body)))
+		}
+		if warning := resp.Header.Get("Warning"); warning != "" {
+			fmt.Fprintln(os.Stderr, "Warning:", warning)
+		}
+
+		return writeResponse(os.Stdout, body, format)
+	},
+}
+
+// writeResponse prints an offering response in format
+func writeResponse(w io.Writer, body []byte, format string) error {
+	switch format {
+	case "raw":
+		_, err := w.Write(body)
+		return err
+
+	case "json":
+		var out bytes.Buffer
+		if err := json.Indent(&out, body, "", "  "); err != nil {
+			return err
+		}
+		out.WriteByte('\n')
+		_, err := out.WriteTo(w)
+		return err
+	}
+
+	records, err := responseRecords(body)
+	if err != nil {
+		return err
+	}
+
+	if format == "jsonl" {
+		enc := json.NewEncoder(w)
+		for _, r := range records {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// csv, with the union of the fields of every record as columns
+	columns := []string{}
+	seen := map[string]bool{}
+	for _, r := range records {
+		for k := range r {
+			if !seen[k] {
+				seen[k] = true
+				columns = append(columns, k)
+			}
+		}
+	}
+	sort.Strings(columns)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	for _, r := range records {
+		row := make([]string, len(columns))
+		for i, c := range columns {
+			row[i] = csvValue(r[c])
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// responseRecords returns the records of a response, with or without an
+// envelope
+func responseRecords(body []byte) ([]map[string]interface{}, error) {
+	records := []map[string]interface{}{}
+	if err := json.Unmarshal(body, &records); err == nil {
+		return records, nil
+	}
+
+	env := struct {
+		Records []map[string]interface{} `json:"records"`
+	}{}
+	if err := json.Unmarshal(body, &env); err != nil || env.Records == nil {
+		return nil, errors.New("response isn't an array of records or an envelope")
+	}
+	return env.Records, nil
+}
+
+func csvValue(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	default:
+		b, _ := json.Marshal(val)
+		return string(b)
+	}
+}
+
+func init() {
+	callCmd.Flags().String("url", "", "Base URL of the gateway, defaults to the offering endpoint")
+	callCmd.Flags().String("token", "", "Consumer token to use instead of minting one")
+	callCmd.Flags().String("format", "json", "Output format: json, raw, jsonl or csv")
+	callCmd.Flags().Duration("timeout", 30*time.Second, "Timeout of the request")
+	addTokenFlags(callCmd.Flags())
+	RootCmd.AddCommand(callCmd)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/thingful/big-iot-gateway/gw"
+)
+
+var checkPipesCmd = &cobra.Command{
+	Use:   "check-pipes [offeringID...]",
+	Short: "Call the pipe of every offer and report how its outputs resolve",
+	Long: `Call the pipe of every offer, or of the ones given, once and without
+retries, map the records returned and report per offer the status, latency
+and number of records, and per output the percentage of records where its
+PipeTerm resolved to a value.
+
+The command fails when a pipe doesn't answer, returns fewer records than
+--minRecords, is slower than --maxLatency or has an output resolving in less
+than --minCoverage percent of the records, so it can be used from cron or
+before a deploy.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		opts := gw.CheckOptions{}
+		opts.Limit, _ = flags.GetInt("limit")
+		opts.MinRecords, _ = flags.GetInt("minRecords")
+		opts.MinCoverage, _ = flags.GetFloat64("minCoverage")
+		opts.MaxLatency, _ = flags.GetDuration("maxLatency")
+		opts.Parallel, _ = flags.GetInt("parallel")
+		format, _ := flags.GetString("format")
+
+		if format != "text" && format != "json" {
+			return fmt.Errorf("unknown check format %s", format)
+		}
+
+		config, offerings, err := configAndOffers()
+		if err != nil {
+			return err
+		}
+
+		if len(args) > 0 {
+			selected := []gw.Offer{}
+			for _, id := range args {
+				found := false
+				for _, o := range offerings {
+					if strings.EqualFold(o.ID, id) {
+						selected = append(selected, o)
+						found = true
+					}
+				}
+				if !found {
+					return fmt.Errorf("unknown offering %s", id)
+				}
+			}
+			offerings = selected
+		}
+
+		checks, err := gw.CheckPipes(config, offerings, opts)
+		if err != nil {
+			return err
+		}
+		if err := gw.WriteChecks(os.Stdout, checks, format); err != nil {
+			return err
+		}
+
+		// the report already says what failed
+		for _, c := range checks {
+			if !c.OK() {
+				os.Exit(1)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	checkPipesCmd.Flags().Int("limit", 100, "Records requested from every pipe, 0 to call the pipe URL as is")
+	checkPipesCmd.Flags().Int("minRecords", 1, "Records every pipe must return")
+	checkPipesCmd.Flags().Float64("minCoverage", 90, "Percentage of records every output must resolve in")
+	checkPipesCmd.Flags().Duration("maxLatency", 0, "Slowest acceptable pipe answer, 0 to not check it")
+	checkPipesCmd.Flags().Int("parallel", 4, "Pipes called at once")
+	checkPipesCmd.Flags().String("format", "text", "Output format: text or json")
+	RootCmd.AddCommand(checkPipesCmd)
+}
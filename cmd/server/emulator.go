@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/thingful/big-iot-gateway/pkg/log"
+	"github.com/thingful/big-iot-gateway/pkg/marketplace"
+	"github.com/thingful/big-iot-gateway/pkg/middleware"
+)
+
+var emulatorCmd = &cobra.Command{
+	Use:   "marketplace-emulator",
+	Short: "Run an in memory BIG-IoT marketplace for development and tests",
+	Long: `Run an in memory BIG-IoT marketplace implementing the provider endpoints:
+/accessToken, the addOffering, activateOffering and deleteOffering mutations
+and the query listing a provider's offerings. Start the gateway with --marketPlaceURI pointing to it.
+
+Its state can be inspected and consumer tokens minted with:
+
+  GET  /emulator/offerings
+  GET  /emulator/mutations
+  POST /emulator/token?offering=<id>&subscriber=<id>&ttl=1h
+  POST /emulator/reset`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		host, _ := cmd.Flags().GetString("host")
+		port, _ := cmd.Flags().GetInt("port")
+		providers, _ := cmd.Flags().GetStringSlice("provider")
+
+		emulator := marketplace.NewEmulator()
+		for _, p := range providers {
+			parts := strings.SplitN(p, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("invalid provider %q, expected id=secret", p)
+			}
+			emulator.AddProvider(parts[0], parts[1])
+		}
+
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		log.Log("addr", addr, "msg", "starting marketplace emulator")
+
+		return http.ListenAndServe(addr, middleware.RequestID(middleware.AccessLog(emulator)))
+	},
+}
+
+func init() {
+	emulatorCmd.Flags().String("host", "127.0.0.1", "Host the emulator listens on")
+	emulatorCmd.Flags().Int("port", 8090, "Port the emulator listens on")
+	emulatorCmd.Flags().StringSlice("provider", nil, "Provider credentials as id=secret, otherwise providers are registered on first use")
+	RootCmd.AddCommand(emulatorCmd)
+}
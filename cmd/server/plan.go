@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/thingful/big-iot-gateway/gw"
+)
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Show the marketplace changes starting the gateway would make, without contacting the marketplace",
+	Long: `Build every offering description as the gateway registers it and compare
+it with the offerings the gateway last registered, kept in --stateFile.
+The marketplace is never contacted.
+
+Formats:
+  diff     created, updated, unchanged and orphaned offerings
+  graphql  the addOffering mutations that would be sent
+  json     the plan with mutations and changed fields`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, _ := cmd.Flags().GetString("format")
+		return plan(format)
+	},
+}
+
+// plan loads the configuration and offers and prints the plan in format
+func plan(format string) error {
+	config := gw.NewConfig()
+	if err := config.Load(viper.AllSettings()); err != nil {
+		return err
+	}
+
+	if err := loadOffers(); err != nil {
+		return err
+	}
+	offerings := gw.OfferConf{}
+	if err := offers.Unmarshal(&offerings); err != nil {
+		return err
+	}
+
+	changes, err := gw.Plan(config, offerings.Offers)
+	if err != nil {
+		return err
+	}
+	return gw.WritePlan(os.Stdout, changes, format)
+}
+
+func init() {
+	planCmd.Flags().String("format", "diff", "Output format: diff, graphql or json")
+	RootCmd.AddCommand(planCmd)
+}
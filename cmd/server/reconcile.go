@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/thingful/big-iot-gateway/gw"
+)
+
+var reconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "Reconcile the offerings registered on the marketplace with the offers",
+	Long: `List the offerings every provider has registered on the marketplace and
+compare them with the offers, planning the operations needed:
+
+  create    offers not registered on the marketplace
+  update    offers whose name or description changed
+  activate  offers registered but inactive
+  delete    offerings no longer in the offers, i.e. left by a crash or renamed
+
+Only the orphans recorded in --stateFile are deleted, the offerings the
+provider registered with other tools or gateways are left alone unless
+--prune is given. Nothing is changed unless --apply is given.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		apply, _ := cmd.Flags().GetBool("apply")
+		format, _ := cmd.Flags().GetString("format")
+		prune, _ := cmd.Flags().GetBool("prune")
+
+		config := gw.NewConfig()
+		if err := config.Load(viper.AllSettings()); err != nil {
+			return err
+		}
+
+		if err := loadOffers(); err != nil {
+			return err
+		}
+		offerings := gw.OfferConf{}
+		if err := offers.Unmarshal(&offerings); err != nil {
+			return err
+		}
+
+		return gw.Reconcile(config, offerings.Offers, apply, prune, os.Stdout, format)
+	},
+}
+
+func init() {
+	reconcileCmd.Flags().Bool("apply", false, "Apply the planned operations")
+	reconcileCmd.Flags().String("format", "diff", "Output format: diff or json")
+	reconcileCmd.Flags().Bool("prune", false, "Delete every offering of the providers missing from the offers, not only the ones recorded in the state file")
+	RootCmd.AddCommand(reconcileCmd)
+}
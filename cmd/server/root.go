@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/spf13/cobra"
@@ -17,6 +18,7 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/thingful/big-iot-gateway/pkg/log"
+	"github.com/thingful/big-iot-gateway/pkg/secret"
 )
 
 var (
@@ -57,11 +59,46 @@ func init() {
 	RootCmd.PersistentFlags().Int("offeringCheckIntervalSec", 600, "Offering Check Interval in secs")
 	RootCmd.PersistentFlags().String("offeringEndpoint", "", "Offering End Point")
 	RootCmd.PersistentFlags().String("pipeAccessToken", "", "Pipes access token")
+	RootCmd.PersistentFlags().Int("pipeTimeoutSec", 30, "Default timeout for pipe requests in secs")
+	RootCmd.PersistentFlags().Int("pipeRetries", 2, "Number of retries for failed pipe requests")
+	RootCmd.PersistentFlags().String("pipeProxy", "", "Proxy URL for pipe requests")
+	RootCmd.PersistentFlags().String("pipeCAFile", "", "PEM file with extra CA certificates for pipe requests")
+	RootCmd.PersistentFlags().Int("breakerThreshold", 5, "Consecutive pipe failures before failing fast")
+	RootCmd.PersistentFlags().Int("breakerCooldownSec", 30, "Secs to wait before probing a failing pipe again")
+	RootCmd.PersistentFlags().Bool("breakerDeactivate", false, "Deactivate offerings while their pipe is failing")
+	RootCmd.PersistentFlags().Int("driftSampleSize", 10, "Records sampled by offering checks to detect schema drift, 0 disables it")
+	RootCmd.PersistentFlags().Float64("driftThreshold", 20, "Percentage points an output's resolution rate must drop to be a drift")
+	RootCmd.PersistentFlags().Bool("driftDeactivate", false, "Deactivate offerings while their schema drifts")
+	RootCmd.PersistentFlags().Int("reconcileIntervalSec", 0, "Secs between reconciliations of the marketplace with the offers, 0 disables them")
+	RootCmd.PersistentFlags().Int("streamIntervalSec", 10, "Secs between polls of pipes with stream subscribers")
+	RootCmd.PersistentFlags().String("historyDir", "", "Directory to keep the history of offers with a SnapshotSec, enables history")
+	RootCmd.PersistentFlags().Int("historyRetentionSec", 604800, "Secs the history of an offer is kept")
+	RootCmd.PersistentFlags().String("haLeaseDir", "", "Directory shared by the replicas to elect the one managing the marketplace, enables HA mode")
+	RootCmd.PersistentFlags().Int("haLeaseTTLSec", 15, "Secs the leader lease lasts without being renewed")
+	RootCmd.PersistentFlags().String("haReplicaID", "", "Id of this replica in the leader lease, defaults to hostname and pid")
+	RootCmd.PersistentFlags().String("registeredFile", "", "Registered offerings file of earlier versions, imported into --stateFile")
+	RootCmd.PersistentFlags().String("stateFile", "", "File to keep the gateway state across restarts and crashes")
+	RootCmd.PersistentFlags().String("fallbackDir", "", "Directory to keep last known good responses across restarts")
+	RootCmd.PersistentFlags().String("geocoder", "google", "Geocoder for offering bounds: google, nominatim or none")
+	RootCmd.PersistentFlags().Float64("extentTolerance", 0.001, "Degrees an extent derived from pipe data must move before it's updated")
 	RootCmd.PersistentFlags().String("mapsKey", "", "API Key for Geocoding locations via Google Maps API")
+	RootCmd.PersistentFlags().String("nominatimURL", "https://nominatim.openstreetmap.org", "URL of a Nominatim compatible geocoding API")
+	RootCmd.PersistentFlags().String("geocoderCacheFile", "", "File to keep geocoding results across restarts")
 	RootCmd.PersistentFlags().Int("HTTPPort", 0, "HTTP Port where will be running the service")
-	RootCmd.PersistentFlags().String("HTTPHost", "localhost", "HTTP Hostname where will be running the service")
+	RootCmd.PersistentFlags().String("HTTPHost", "", "HTTP Hostname where will be running the service, empty for every interface")
+	RootCmd.PersistentFlags().String("tlsCertFile", "", "Certificate file to serve HTTPS, reloaded when it changes")
+	RootCmd.PersistentFlags().String("tlsKeyFile", "", "Key file of the HTTPS certificate")
+	RootCmd.PersistentFlags().String("tlsMinVersion", "1.2", "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	RootCmd.PersistentFlags().StringSlice("tlsCiphers", nil, "Allowed TLS cipher suites, defaults to Go's secure suites")
+	RootCmd.PersistentFlags().String("tlsClientCAFile", "", "CA file to verify client certificates required by the admin listener")
+	RootCmd.PersistentFlags().String("adminAddr", "", "Address of the admin listener, e.g. 127.0.0.1:8081, empty disables it")
+	RootCmd.PersistentFlags().String("traceExporter", "none", "Where tracing spans are exported: none, stdout or otlp")
+	RootCmd.PersistentFlags().String("traceEndpoint", "http://localhost:4318", "OTLP/HTTP collector endpoint for the otlp trace exporter")
 	RootCmd.PersistentFlags().Bool("debug", false, "enable debug")
+	RootCmd.PersistentFlags().String("logLevel", "info", "Minimum log level: debug, info, warn or error")
+	RootCmd.PersistentFlags().String("logFormat", "json", "Log format: json or logfmt")
 	RootCmd.PersistentFlags().Bool("noauth", false, "disable auth")
+	RootCmd.PersistentFlags().String("secretKeyFile", "", "Key file used to decrypt enc: secret references")
 
 	viper.BindPFlag("marketPlaceURI", RootCmd.PersistentFlags().Lookup("marketPlaceURI"))
 	viper.BindPFlag("providerID", RootCmd.PersistentFlags().Lookup("providerID"))
@@ -70,11 +107,46 @@ func init() {
 	viper.BindPFlag("offeringCheckIntervalSec", RootCmd.PersistentFlags().Lookup("offeringCheckIntervalSec"))
 	viper.BindPFlag("offeringEndpoint", RootCmd.PersistentFlags().Lookup("offeringEndpoint"))
 	viper.BindPFlag("pipeAccessToken", RootCmd.PersistentFlags().Lookup("pipeAccessToken"))
+	viper.BindPFlag("pipeTimeoutSec", RootCmd.PersistentFlags().Lookup("pipeTimeoutSec"))
+	viper.BindPFlag("pipeRetries", RootCmd.PersistentFlags().Lookup("pipeRetries"))
+	viper.BindPFlag("pipeProxy", RootCmd.PersistentFlags().Lookup("pipeProxy"))
+	viper.BindPFlag("pipeCAFile", RootCmd.PersistentFlags().Lookup("pipeCAFile"))
+	viper.BindPFlag("breakerThreshold", RootCmd.PersistentFlags().Lookup("breakerThreshold"))
+	viper.BindPFlag("breakerCooldownSec", RootCmd.PersistentFlags().Lookup("breakerCooldownSec"))
+	viper.BindPFlag("breakerDeactivate", RootCmd.PersistentFlags().Lookup("breakerDeactivate"))
+	viper.BindPFlag("driftSampleSize", RootCmd.PersistentFlags().Lookup("driftSampleSize"))
+	viper.BindPFlag("driftThreshold", RootCmd.PersistentFlags().Lookup("driftThreshold"))
+	viper.BindPFlag("driftDeactivate", RootCmd.PersistentFlags().Lookup("driftDeactivate"))
+	viper.BindPFlag("reconcileIntervalSec", RootCmd.PersistentFlags().Lookup("reconcileIntervalSec"))
+	viper.BindPFlag("streamIntervalSec", RootCmd.PersistentFlags().Lookup("streamIntervalSec"))
+	viper.BindPFlag("historyDir", RootCmd.PersistentFlags().Lookup("historyDir"))
+	viper.BindPFlag("historyRetentionSec", RootCmd.PersistentFlags().Lookup("historyRetentionSec"))
+	viper.BindPFlag("haLeaseDir", RootCmd.PersistentFlags().Lookup("haLeaseDir"))
+	viper.BindPFlag("haLeaseTTLSec", RootCmd.PersistentFlags().Lookup("haLeaseTTLSec"))
+	viper.BindPFlag("haReplicaID", RootCmd.PersistentFlags().Lookup("haReplicaID"))
+	viper.BindPFlag("registeredFile", RootCmd.PersistentFlags().Lookup("registeredFile"))
+	viper.BindPFlag("stateFile", RootCmd.PersistentFlags().Lookup("stateFile"))
+	viper.BindPFlag("fallbackDir", RootCmd.PersistentFlags().Lookup("fallbackDir"))
+	viper.BindPFlag("geocoder", RootCmd.PersistentFlags().Lookup("geocoder"))
+	viper.BindPFlag("extentTolerance", RootCmd.PersistentFlags().Lookup("extentTolerance"))
 	viper.BindPFlag("mapsKey", RootCmd.PersistentFlags().Lookup("mapsKey"))
+	viper.BindPFlag("nominatimURL", RootCmd.PersistentFlags().Lookup("nominatimURL"))
+	viper.BindPFlag("geocoderCacheFile", RootCmd.PersistentFlags().Lookup("geocoderCacheFile"))
 	viper.BindPFlag("HTTPPort", RootCmd.PersistentFlags().Lookup("HTTPPort"))
 	viper.BindPFlag("HTTPHost", RootCmd.PersistentFlags().Lookup("HTTPHost"))
+	viper.BindPFlag("tlsCertFile", RootCmd.PersistentFlags().Lookup("tlsCertFile"))
+	viper.BindPFlag("tlsKeyFile", RootCmd.PersistentFlags().Lookup("tlsKeyFile"))
+	viper.BindPFlag("tlsMinVersion", RootCmd.PersistentFlags().Lookup("tlsMinVersion"))
+	viper.BindPFlag("tlsCiphers", RootCmd.PersistentFlags().Lookup("tlsCiphers"))
+	viper.BindPFlag("tlsClientCAFile", RootCmd.PersistentFlags().Lookup("tlsClientCAFile"))
+	viper.BindPFlag("adminAddr", RootCmd.PersistentFlags().Lookup("adminAddr"))
+	viper.BindPFlag("traceExporter", RootCmd.PersistentFlags().Lookup("traceExporter"))
+	viper.BindPFlag("traceEndpoint", RootCmd.PersistentFlags().Lookup("traceEndpoint"))
 	viper.BindPFlag("debug", RootCmd.PersistentFlags().Lookup("debug"))
+	viper.BindPFlag("logLevel", RootCmd.PersistentFlags().Lookup("logLevel"))
+	viper.BindPFlag("logFormat", RootCmd.PersistentFlags().Lookup("logFormat"))
 	viper.BindPFlag("noauth", RootCmd.PersistentFlags().Lookup("noauth"))
+	viper.BindPFlag("secretKeyFile", RootCmd.PersistentFlags().Lookup("secretKeyFile"))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -95,13 +167,36 @@ func initConfig() {
 		log.Log("msg", "Using config file:"+viper.ConfigFileUsed())
 	}
 
-	// Offerings file
-	offers = viper.New()
-	if err := checkOfferFile(offerFile, offers); err != nil {
+	if err := configureLog(); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// loadOffers reads the offerings file, only the commands working with offers
+// need it
+func loadOffers() error {
+	offers = viper.New()
+	return checkOfferFile(offerFile, offers)
+}
+
+// configureLog applies the log format and level settings, --debug implies the
+// debug level
+func configureLog() error {
+	if err := log.SetFormat(viper.GetString("logFormat")); err != nil {
+		return err
+	}
+
+	level, err := log.ParseLevel(viper.GetString("logLevel"))
+	if err != nil {
+		return err
+	}
+	if viper.GetBool("debug") {
+		level = log.DebugLevel
+	}
+	log.SetLevel(level)
+	return nil
+}
+
 func bindViper(flags *pflag.FlagSet, names ...string) error {
 	for _, name := range names {
 		err := viper.BindPFlag(name, flags.Lookup(name))
@@ -165,9 +260,26 @@ type AwsCreds struct {
 
 func getS3Offers(bucket, file string) (io.Reader, error) {
 
-	sess, err := session.NewSession(&aws.Config{
+	awsConfig := &aws.Config{
 		Region: aws.String(awsCreds.region),
-	})
+	}
+
+	// explicit credentials can be secret references, otherwise the default
+	// aws credential chain is used
+	if awsCreds.accessKey != "" && awsCreds.secret != "" {
+		secrets := secret.NewResolver(viper.GetString("secretKeyFile"))
+		accessKey, err := secrets.Resolve(awsCreds.accessKey)
+		if err != nil {
+			return nil, err
+		}
+		secretKey, err := secrets.Resolve(awsCreds.secret)
+		if err != nil {
+			return nil, err
+		}
+		awsConfig.Credentials = credentials.NewStaticCredentials(accessKey.Reveal(), secretKey.Reveal(), "")
+	}
+
+	sess, err := session.NewSession(awsConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/thingful/big-iot-gateway/gw"
+)
+
+var scaffoldCmd = &cobra.Command{
+	Use:   "scaffold",
+	Short: "Scaffold an offer by sampling a pipe",
+	Long: `Sample a pipe and print an offer entry for it, ready to be edited and
+added to the offers file. The array of records is looked up in the response
+unless --rootPath is given, and an output is suggested for every top level
+field of the records from a bundled vocabulary of BIG-IoT terms. Fields every
+offer already has, like latitude and longitude, are left out.
+
+A report of every field found, with its type and range, is written to stderr.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		opts := gw.ScaffoldOptions{}
+		opts.PipeURL, _ = flags.GetString("pipe")
+		opts.ID, _ = flags.GetString("id")
+		opts.Name, _ = flags.GetString("name")
+		opts.City, _ = flags.GetString("city")
+		opts.Provider, _ = flags.GetString("provider")
+		opts.RootPath, _ = flags.GetString("rootPath")
+		opts.Limit, _ = flags.GetInt("limit")
+		format, _ := flags.GetString("format")
+
+		if opts.PipeURL == "" {
+			return errors.New("pipe is not set")
+		}
+		if format != "json" && format != "yaml" {
+			return fmt.Errorf("unknown scaffold format %s", format)
+		}
+
+		config := gw.NewConfig()
+		if err := config.Load(viper.AllSettings()); err != nil {
+			return err
+		}
+
+		s, err := gw.ScaffoldOffer(config, opts)
+		if err != nil {
+			return err
+		}
+
+		writeFieldReport(s)
+		return gw.WriteScaffold(os.Stdout, s, format)
+	},
+}
+
+// writeFieldReport prints the fields found in the sampled records to stderr
+func writeFieldReport(s *gw.Scaffold) {
+	fmt.Fprintf(os.Stderr, "Sampled %d records at %s\n\n", s.Records, orRoot(s.Offer.RootPath))
+
+	tw := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tTYPE\tSEEN\tRANGE\tOUTPUT")
+	for _, f := range s.Fields {
+		rng := f.Example
+		if f.Min != nil {
+			rng = strconv.FormatFloat(*f.Min, 'g', -1, 64) + " .. " + strconv.FormatFloat(*f.Max, 'g', -1, 64)
+		}
+
+		output := ""
+		switch {
+		case f.Common:
+			output = "(common output)"
+		case f.Nested:
+			output = "(nested, not usable as PipeTerm)"
+		case f.Output == nil:
+			output = "(skipped)"
+		case f.Matched:
+			output = f.Output.BigiotName
+		default:
+			output = f.Output.BigiotName + " (not in vocabulary)"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%d/%d\t%s\t%s\n", f.Term, f.Type, f.Seen, s.Records, rng, output)
+	}
+	tw.Flush()
+	fmt.Fprintln(os.Stderr)
+}
+
+func orRoot(rootPath string) string {
+	if rootPath == "" {
+		return "the root of the response"
+	}
+	return rootPath
+}
+
+func init() {
+	scaffoldCmd.Flags().String("pipe", "", "URL of the pipe to sample")
+	scaffoldCmd.Flags().String("id", "", "Offer ID, defaults to the last part of the pipe URL")
+	scaffoldCmd.Flags().String("name", "", "Offer name, defaults to its ID")
+	scaffoldCmd.Flags().String("city", "", "City of the offer")
+	scaffoldCmd.Flags().String("provider", "", "Provider profile whose pipeAccessToken is used, the default one when empty")
+	scaffoldCmd.Flags().String("rootPath", "", "Dot separated path to the records, detected when empty")
+	scaffoldCmd.Flags().Int("limit", 100, "Records requested from the pipe, 0 to not send a limit")
+	scaffoldCmd.Flags().String("format", "json", "Output format: json or yaml")
+	RootCmd.AddCommand(scaffoldCmd)
+}
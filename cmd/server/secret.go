@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/thingful/big-iot-gateway/pkg/secret"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var secretCmd = &cobra.Command{
+	Use:   "secret",
+	Short: "Manage encrypted secret references",
+}
+
+var secretKeygenCmd = &cobra.Command{
+	Use:   "keygen <file>",
+	Short: "Generate a new secret key file",
+	Long: `Generate a new secret key file. An existing key file is kept unless --force
+is given, as values encrypted with it can't be decrypted anymore once it's
+replaced.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := secret.GenerateKey()
+		if err != nil {
+			return err
+		}
+
+		flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		if force, _ := cmd.Flags().GetBool("force"); force {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		}
+		f, err := os.OpenFile(args[0], flags, 0600)
+		if os.IsExist(err) {
+			return fmt.Errorf("%s already exists, use --force to replace it", args[0])
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteString(key + "\n"); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	},
+}
+
+var secretEncryptCmd = &cobra.Command{
+	Use:   "encrypt",
+	Short: "Encrypt a value read from stdin into an enc: reference using --secretKeyFile",
+	Long: `Encrypt a value into an enc: reference using --secretKeyFile. The value is
+prompted for without echo on a terminal, otherwise read from stdin, so it
+doesn't end up in the shell history or the process list.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keyFile := viper.GetString("secretKeyFile")
+		if keyFile == "" {
+			return errors.New("secretKeyFile is not set")
+		}
+
+		key, err := secret.ReadKey(keyFile)
+		if err != nil {
+			return err
+		}
+
+		value, err := readValue()
+		if err != nil {
+			return err
+		}
+		if value == "" {
+			return errors.New("no value to encrypt")
+		}
+
+		ref, err := secret.Encrypt(key, value)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(ref)
+		return nil
+	},
+}
+
+// readValue prompts for the value to encrypt without echo, or reads it from
+// stdin when it isn't a terminal
+func readValue() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Value: ")
+		b, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+
+	b, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+func init() {
+	secretKeygenCmd.Flags().Bool("force", false, "Replace an existing key file")
+	secretCmd.AddCommand(secretKeygenCmd, secretEncryptCmd)
+	RootCmd.AddCommand(secretCmd)
+}
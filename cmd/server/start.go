@@ -10,6 +10,9 @@ var startCmd = &cobra.Command{
 	Use:   "start",
 	Short: "Start BIG-IoT Gateway",
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			return plan("graphql")
+		}
 
 		config := gw.NewConfig()
 		err := config.Load(viper.AllSettings())
@@ -17,6 +20,10 @@ var startCmd = &cobra.Command{
 			return err
 		}
 
+		if err = loadOffers(); err != nil {
+			return err
+		}
+
 		offerings := gw.OfferConf{}
 		if err = offers.Unmarshal(&offerings); err != nil {
 			return err
@@ -27,5 +34,6 @@ var startCmd = &cobra.Command{
 }
 
 func init() {
+	startCmd.Flags().Bool("dry-run", false, "Print the marketplace mutations instead of starting, same as plan --format graphql")
 	RootCmd.AddCommand(startCmd)
 }
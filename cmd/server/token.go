@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/thingful/big-iot-gateway/gw"
+)
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manage consumer tokens for local testing",
+}
+
+var tokenMintCmd = &cobra.Command{
+	Use:   "mint <offeringID>",
+	Short: "Mint a consumer token for an offering signed with its provider secret",
+	Long: `Mint a consumer token for an offering, signed with the secret of the
+provider owning it as the marketplace does when a consumer subscribes. The
+token is accepted by the gateway, so offering endpoints can be tested without
+--noauth.
+
+A negative --expiry mints an expired token, and --subscribableId a token for
+another offering, to test rejected requests.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, offerings, err := configAndOffers()
+		if err != nil {
+			return err
+		}
+
+		token, err := gw.MintToken(config, offerings, args[0], tokenClaims(cmd.Flags()))
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(token)
+		return nil
+	},
+}
+
+// configAndOffers loads the configuration and the offers
+func configAndOffers() (gw.Config, []gw.Offer, error) {
+	config := gw.NewConfig()
+	if err := config.Load(viper.AllSettings()); err != nil {
+		return config, nil, err
+	}
+
+	if err := loadOffers(); err != nil {
+		return config, nil, err
+	}
+	offerings := gw.OfferConf{}
+	if err := offers.Unmarshal(&offerings); err != nil {
+		return config, nil, err
+	}
+	return config, offerings.Offers, nil
+}
+
+// addTokenFlags adds the flags setting the claims of a minted token
+func addTokenFlags(flags *pflag.FlagSet) {
+	flags.String("subscribableId", "", "Subscribable id claim, defaults to the marketplace id of the offering")
+	flags.String("subscriber", "Dev-Consumer-Query", "Subscriber id claim")
+	flags.Duration("expiry", time.Hour, "Time until the token expires")
+}
+
+func tokenClaims(flags *pflag.FlagSet) gw.TokenClaims {
+	subscribableID, _ := flags.GetString("subscribableId")
+	subscriber, _ := flags.GetString("subscriber")
+	expiry, _ := flags.GetDuration("expiry")
+	return gw.TokenClaims{
+		SubscribableID: subscribableID,
+		SubscriberID:   subscriber,
+		Expiry:         expiry,
+	}
+}
+
+func init() {
+	addTokenFlags(tokenMintCmd.Flags())
+	tokenCmd.AddCommand(tokenMintCmd)
+	RootCmd.AddCommand(tokenCmd)
+}
@@ -0,0 +1,86 @@
+package gw
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/geocoder"
+	"github.com/thingful/big-iot-gateway/pkg/log"
+)
+
+// offerStatus is the state of an offer as shown on the admin surface
+type offerStatus struct {
+	ID            string           `json:"id"`
+	Provider      string           `json:"provider"`
+	Registered    bool             `json:"registered"`
+	MarketplaceID string           `json:"marketplaceId,omitempty"`
+	Circuit       string           `json:"circuit"`
+	Extent        *geocoder.Bounds `json:"extent,omitempty"`
+	Drift         *offerDrift      `json:"drift,omitempty"`
+	Freshness     *offerFreshness  `json:"freshness,omitempty"`
+	ActiveUntil   *time.Time       `json:"activeUntil,omitempty"`
+	LastCheck     *checkResult     `json:"lastCheck,omitempty"`
+	Usage         *offerUsage      `json:"usage,omitempty"`
+}
+
+// adminOfferings lists the state of every offer
+func adminOfferings(offers []Offer, reg *registry, breakers pipeBreakers, drift *driftDetector, fresh *freshness, use *usage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		statuses := make([]offerStatus, 0, len(offers))
+		for _, o := range offers {
+			last, registered := reg.registration(o.ID)
+			extent, _ := reg.bounds(o.ID)
+			status := offerStatus{
+				ID:            o.ID,
+				Provider:      offerProvider(o),
+				Registered:    registered,
+				MarketplaceID: last.MarketplaceID,
+				Circuit:       breakers[o.PipeURL].State().String(),
+				Extent:        extent,
+				Drift:         drift.state(o.ID),
+				Freshness:     fresh.state(o.ID),
+				Usage:         use.get(o.ID),
+			}
+			if registered {
+				status.ActiveUntil = &last.ActiveUntil
+			}
+			if c, ok := reg.check(o.ID); ok {
+				status.LastCheck = &c
+			}
+			statuses = append(statuses, status)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(statuses); err != nil {
+			log.Log("error", err)
+		}
+	}
+}
+
+// adminLeader shows the HA state of the replica
+func adminLeader(leader *elector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(leader.status()); err != nil {
+			log.Log("error", err)
+		}
+	}
+}
+
+// adminLogLevel shows the log level, or changes it when called with PUT and a
+// level parameter
+func adminLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		level, err := log.ParseLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.SetLevel(level)
+		log.Info(r.Context(), "logLevel", level.String(), "msg", "log level changed")
+	}
+
+	fmt.Fprintln(w, log.GetLevel().String())
+}
@@ -0,0 +1,147 @@
+package gw
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/breaker"
+	"github.com/thingful/big-iot-gateway/pkg/log"
+	"github.com/thingful/big-iot-gateway/pkg/pipes"
+	"github.com/thingful/big-iot-gateway/pkg/webhook"
+	"github.com/thingful/bigiot"
+)
+
+// pipeBreakers holds one circuit breaker per pipe url, offers sharing a pipe
+// share its breaker
+type pipeBreakers map[string]*breaker.Breaker
+
+// newPipeBreakers creates a breaker for every pipe used by offers. onChange is
+// called with the offers using a pipe when its circuit opens, coming from
+// closed, or closes again, not on the failed probes of an open circuit. The
+// calls of a pipe are made one at a time and in order.
+func newPipeBreakers(offers []Offer, threshold int, cooldown time.Duration, onChange func(offers []Offer, to breaker.State)) pipeBreakers {
+	byPipe := map[string][]Offer{}
+	for _, o := range offers {
+		byPipe[o.PipeURL] = append(byPipe[o.PipeURL], o)
+	}
+
+	b := pipeBreakers{}
+	for pipeURL, pipeOffers := range byPipe {
+		pipeURL, pipeOffers := pipeURL, pipeOffers
+		n := &pipeNotifier{latest: breaker.Closed, wake: make(chan struct{}, 1)}
+		if onChange != nil {
+			go n.run(func(to breaker.State) { onChange(pipeOffers, to) })
+		}
+		b[pipeURL] = breaker.New(threshold, cooldown, func(from, to breaker.State) {
+			log.Log("pipe", pipeURL, "from", from.String(), "to", to.String(), "msg", "pipe circuit changed")
+			opened := from == breaker.Closed && to == breaker.Open
+			closed := to == breaker.Closed
+			if !opened && !closed {
+				return
+			}
+			firePipe(pipeURL, pipeOffers, to)
+			if onChange != nil {
+				n.notify(to)
+			}
+		})
+	}
+	return b
+}
+
+// pipeNotifier runs the onChange calls of a pipe one at a time. Only the last
+// state matters, so states notified while a call runs are coalesced into the
+// next one.
+type pipeNotifier struct {
+	mu     sync.Mutex
+	latest breaker.State
+	wake   chan struct{}
+}
+
+func (n *pipeNotifier) notify(to breaker.State) {
+	n.mu.Lock()
+	n.latest = to
+	n.mu.Unlock()
+
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run calls apply every time the latest state differs from the one last
+// applied, breakers start closed
+func (n *pipeNotifier) run(apply func(to breaker.State)) {
+	applied := breaker.Closed
+	for range n.wake {
+		n.mu.Lock()
+		to := n.latest
+		n.mu.Unlock()
+
+		if to == applied {
+			continue
+		}
+		applied = to
+		apply(to)
+	}
+}
+
+// firePipe sends a webhook event when the circuit of a pipe opens or closes
+func firePipe(pipeURL string, offers []Offer, to breaker.State) {
+	e := webhook.Event{Pipe: pipeURL}
+	switch to {
+	case breaker.Open:
+		e.Type = webhook.PipeFailed
+		e.Message = "pipe failing, circuit opened"
+	case breaker.Closed:
+		e.Type = webhook.PipeRecovered
+		e.Message = "pipe recovered, circuit closed"
+	default:
+		return
+	}
+	ids := make([]string, len(offers))
+	for i, o := range offers {
+		ids[i] = o.ID
+	}
+	e.Message += " for " + strings.Join(ids, ", ")
+	webhook.Fire(context.Background(), e)
+}
+
+// record reports the result of a pipe request to the breaker, errors caused by
+// the caller going away aren't the pipe's fault so they are ignored
+func record(ctx context.Context, b *breaker.Breaker, err error) {
+	switch {
+	case err == nil:
+		b.Success()
+	case ctx.Err() == context.Canceled:
+		b.Abort()
+	default:
+		if serr, ok := err.(*pipes.StatusError); ok && serr.Code < 500 && serr.Code != 429 {
+			// the pipe is answering, it's the request that is wrong
+			b.Success()
+			return
+		}
+		b.Failure()
+	}
+}
+
+// deactivateOffering expires the activation of a registered offering so the
+// marketplace stops advertising it, reason says why
+func deactivateOffering(ctx context.Context, provider *bigiot.Provider, reg *registry, o Offer, reason string) error {
+	id, ok := reg.get(o.ID)
+	if !ok {
+		return nil
+	}
+	log.LogContext(ctx, "offering-id", o.ID, "reason", reason, "msg", "deactivating offering")
+	_, err := provider.ActivateOffering(ctx, &bigiot.ActivateOffering{
+		ID:             id,
+		ExpirationTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	reg.markInactive(o.ID)
+	fireOffering(ctx, webhook.OfferingDeactivated, o, "offering deactivated, "+reason, nil)
+	return nil
+}
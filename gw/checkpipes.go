@@ -0,0 +1,230 @@
+package gw
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/log"
+	"github.com/thingful/big-iot-gateway/pkg/pipes"
+	"github.com/thingful/big-iot-gateway/pkg/secret"
+)
+
+// CheckOptions are the thresholds a pipe must meet. A MaxLatency of zero
+// doesn't check the latency.
+type CheckOptions struct {
+	Limit       int           // records requested from the pipe, 0 to call PipeURL as is
+	MinRecords  int           // records the pipe must return
+	MinCoverage float64       // percentage of records every output must resolve in
+	MaxLatency  time.Duration // slowest acceptable answer
+	Parallel    int           // pipes called at once
+}
+
+// PipeCheck is the result of calling the pipe of an offer
+type PipeCheck struct {
+	OfferID   string           `json:"offerId"`
+	Provider  string           `json:"provider"`
+	PipeURL   string           `json:"pipeUrl"`
+	Status    int              `json:"status"`
+	LatencyMs int64            `json:"latencyMs"`
+	Records   int              `json:"records"`
+	Outputs   []OutputCoverage `json:"outputs"`
+	Error     string           `json:"error,omitempty"`
+	Failures  []string         `json:"failures,omitempty"`
+}
+
+// OK tells whether the pipe met every threshold
+func (c PipeCheck) OK() bool {
+	return len(c.Failures) == 0
+}
+
+// OutputCoverage is how often the PipeTerm of an output resolved to a value
+// that isn't null in a set of records, and the type of those values
+type OutputCoverage struct {
+	BigiotName string  `json:"bigiotName"`
+	PipeTerm   string  `json:"pipeTerm"`
+	Resolved   int     `json:"resolved"`
+	Coverage   float64 `json:"coverage"`
+	Type       string  `json:"type,omitempty"`
+}
+
+// outputCoverage measures every output over the object records, members of
+// the array that aren't objects count as unresolved
+func outputCoverage(records []interface{}, outputs []Output) []OutputCoverage {
+	coverage := make([]OutputCoverage, len(outputs))
+	for i, o := range outputs {
+		c := OutputCoverage{BigiotName: o.BigiotName, PipeTerm: o.PipeTerm}
+		for _, r := range records {
+			obj, ok := r.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if v, ok := obj[o.PipeTerm]; ok && v != nil {
+				c.Resolved++
+				c.Type = mergeType(c.Type, valueType(v))
+			}
+		}
+		if len(records) > 0 {
+			c.Coverage = 100 * float64(c.Resolved) / float64(len(records))
+		}
+		coverage[i] = c
+	}
+	return coverage
+}
+
+// CheckPipes calls the pipe of every offer once, without retries, and
+// measures how the outputs resolve in the records returned. Only the outputs
+// of the offers are checked, not the ones every offer has.
+func CheckPipes(config Config, offers []Offer, opts CheckOptions) ([]PipeCheck, error) {
+	profiles, err := pipeProfiles(config, pipes.WithRetries(0, 0))
+	if err != nil {
+		return nil, err
+	}
+	offers, err = profileOffers(offers, profiles)
+	if err != nil {
+		return nil, err
+	}
+
+	clients, err := offerPipeClients(offers, profiles, secret.NewResolver(config.SecretKeyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	parallel := opts.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	sem := make(chan struct{}, parallel)
+
+	checks := make([]PipeCheck, len(offers))
+	var wg sync.WaitGroup
+	for i, o := range offers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, o Offer) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			checks[i] = checkPipe(o, clients[o.ID], opts)
+		}(i, o)
+	}
+	wg.Wait()
+
+	return checks, nil
+}
+
+func checkPipe(o Offer, client *pipes.Client, opts CheckOptions) PipeCheck {
+	c := PipeCheck{
+		OfferID:  o.ID,
+		Provider: offerProvider(o),
+		PipeURL:  o.PipeURL,
+		Outputs:  []OutputCoverage{},
+	}
+	fail := func(format string, args ...interface{}) {
+		c.Failures = append(c.Failures, fmt.Sprintf(format, args...))
+	}
+
+	pipeURL := o.PipeURL
+	if opts.Limit > 0 {
+		u, err := url.Parse(o.PipeURL)
+		if err != nil {
+			c.Error = err.Error()
+			fail("invalid pipe url")
+			return c
+		}
+		q := u.Query()
+		q.Set("limit", fmt.Sprint(opts.Limit))
+		u.RawQuery = q.Encode()
+		pipeURL = u.String()
+	}
+
+	ctx := log.WithRequestID(context.Background(), log.NewRequestID())
+	start := time.Now()
+	body, err := client.Get(ctx, pipeURL, offerTimeout(o))
+	latency := time.Since(start)
+	c.LatencyMs = int64(latency / time.Millisecond)
+
+	if err != nil {
+		if serr, ok := err.(*pipes.StatusError); ok {
+			c.Status = serr.Code
+		}
+		c.Error = err.Error()
+		fail("pipe request failed")
+		return c
+	}
+	c.Status = 200
+
+	if opts.MaxLatency > 0 && latency > opts.MaxLatency {
+		fail("latency %s over %s", latency.Round(time.Millisecond), opts.MaxLatency)
+	}
+
+	records, err := pipeRecords(body, o.RootPath)
+	if err != nil {
+		c.Error = err.Error()
+		fail("unexpected payload")
+		return c
+	}
+	c.Records = len(records)
+	if c.Records < opts.MinRecords {
+		fail("%d records, expected at least %d", c.Records, opts.MinRecords)
+	}
+
+	c.Outputs = outputCoverage(records, o.Outputs)
+	for _, oc := range c.Outputs {
+		if c.Records > 0 && oc.Coverage < opts.MinCoverage {
+			fail("%s (%s) resolved in %.0f%% of records", oc.BigiotName, oc.PipeTerm, oc.Coverage)
+		}
+	}
+
+	return c
+}
+
+// WriteChecks prints the pipe checks as a report or json
+func WriteChecks(w io.Writer, checks []PipeCheck, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(checks)
+
+	case "text", "":
+		failed := 0
+		for _, c := range checks {
+			result := "ok"
+			if !c.OK() {
+				result = "FAIL"
+				failed++
+			}
+			status := "no response"
+			if c.Status != 0 {
+				status = fmt.Sprintf("status %d", c.Status)
+			}
+			fmt.Fprintf(w, "%s %s (provider %s): %s, %dms, %d records\n", result, c.OfferID, c.Provider, status, c.LatencyMs, c.Records)
+			if c.Error != "" {
+				fmt.Fprintf(w, "    error: %s\n", c.Error)
+			}
+
+			tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+			for _, oc := range c.Outputs {
+				fmt.Fprintf(tw, "    %s\t%s\t%.0f%%\t%s\n", oc.BigiotName, oc.PipeTerm, oc.Coverage, oc.Type)
+			}
+			tw.Flush()
+
+			if len(c.Failures) > 0 {
+				fmt.Fprintf(w, "    failed: %s\n", strings.Join(c.Failures, "; "))
+			}
+		}
+		fmt.Fprintf(w, "\n%d of %d pipes failed their checks.\n", failed, len(checks))
+		return nil
+
+	default:
+		return fmt.Errorf("unknown check format %s", format)
+	}
+}
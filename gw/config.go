@@ -2,26 +2,66 @@ package gw
 
 import (
 	"errors"
+	"fmt"
+	"net"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/spf13/cast"
+	"github.com/thingful/big-iot-gateway/pkg/secret"
+	"github.com/thingful/big-iot-gateway/pkg/webhook"
 )
 
 // Config contains the required configuration for the gateway
 type Config struct {
-	MarketPlaceURI           string        // Needed to manage offers
-	ProviderID               string        // Needed to login into Marketplace
-	ProviderSecret           string        // Needed to login into Marketplace
-	OfferingActiveLengthSec  time.Duration // timeout
-	OfferingCheckIntervalSec time.Duration // Offering Check interval
+	MarketPlaceURI           string                    // Needed to manage offers
+	ProviderID               string                    // Needed to login into Marketplace
+	ProviderSecret           secret.String             // Needed to login into Marketplace
+	Providers                map[string]ProviderConfig // provider profiles offers can reference by name
+	Webhooks                 []webhook.Target          // where state changes of offerings and pipes are posted
+	OfferingActiveLengthSec  time.Duration             // timeout
+	OfferingCheckIntervalSec time.Duration             // Offering Check interval
 	OfferingEndPoint         string
-	PipeAccessToken          string // Token to access pipes
-	MapsKey                  string // Token to access Google maps geocoding API
-	HTTPPort                 int    // GW port
-	HTTPHost                 string // GW Host
-	Debug                    bool   // Debug Flag
-	NoAuth                   bool   // disable auth flag
+	PipeAccessToken          secret.String // Token to access pipes
+	PipeTimeoutSec           time.Duration // default timeout for pipe requests
+	PipeRetries              int           // number of retries for failed pipe requests
+	PipeProxy                string        // proxy url for pipe requests
+	PipeCAFile               string        // extra CA certificates to verify pipes
+	BreakerThreshold         int           // consecutive pipe failures before opening its circuit
+	BreakerCooldownSec       time.Duration // time an open circuit waits before probing the pipe
+	BreakerDeactivate        bool          // deactivate offerings while their pipe circuit is open
+	DriftSampleSize          int           // records sampled by offering checks to detect schema drift, 0 disables it
+	DriftThreshold           float64       // percentage points an output's resolution rate must drop to drift
+	DriftDeactivate          bool          // deactivate offerings while their schema drifts
+	FallbackDir              string        // directory where last known good responses are kept
+	RegisteredFile           string        // registered offerings file of earlier versions, imported into StateFile
+	StateFile                string        // file where the gateway state is kept across restarts, empty keeps it in memory
+	ReconcileIntervalSec     time.Duration // how often the marketplace is reconciled with the offers, 0 disables it
+	StreamIntervalSec        time.Duration // how often pipes with stream subscribers are polled
+	HistoryDir               string        // directory where the history of the offers is kept, enables history
+	HistoryRetentionSec      time.Duration // how long the history of an offer is kept
+	HALeaseDir               string        // directory shared by the replicas holding the leader lease, enables HA mode
+	HALeaseTTLSec            time.Duration // time the leader lease lasts without renewal
+	HAReplicaID              string        // id of the replica in the lease, defaults to hostname and pid
+	Geocoder                 string        // geocoder used for offering bounds: google, nominatim or none
+	ExtentTolerance          float64       // degrees a derived extent must move before it's updated
+	MapsKey                  secret.String // Token to access Google maps geocoding API
+	NominatimURL             string        // Nominatim compatible geocoding API
+	GeocoderCacheFile        string        // file where geocoding results are kept
+	HTTPPort                 int           // GW port
+	HTTPHost                 string        // GW Host, empty listens on every interface
+	TLSCertFile              string        // certificate to serve HTTPS, reloaded when it changes
+	TLSKeyFile               string        // key of TLSCertFile
+	TLSMinVersion            string        // minimum TLS version: 1.0, 1.1, 1.2 or 1.3
+	TLSCiphers               []string      // allowed cipher suites, empty uses Go's defaults
+	TLSClientCAFile          string        // CA verifying client certificates required by the admin surface
+	AdminAddr                string        // address of the admin listener, empty disables it
+	TraceExporter            string        // where spans are exported: none, stdout or otlp
+	TraceEndpoint            string        // OTLP/HTTP collector endpoint
+	Debug                    bool          // Debug Flag
+	NoAuth                   bool          // disable auth flag
+	SecretKeyFile            string        // key used to decrypt enc: secret references
 }
 
 // NewConfig return a new Config
@@ -33,6 +73,11 @@ func NewConfig() Config {
 // read from viper.AllSettings() function
 // if some needed setting doesn't exist it returns an error
 func (c *Config) Load(conf map[string]interface{}) error {
+	if val, ok := conf["secretkeyfile"]; ok {
+		c.SecretKeyFile = cast.ToString(val)
+	}
+	secrets := secret.NewResolver(c.SecretKeyFile)
+
 	if val, ok := conf["marketplaceuri"]; ok {
 		c.MarketPlaceURI = cast.ToString(val)
 	} else {
@@ -40,13 +85,13 @@ func (c *Config) Load(conf map[string]interface{}) error {
 	}
 	if val, ok := conf["providerid"]; ok {
 		c.ProviderID = cast.ToString(val)
-	} else {
-		return errors.New("providerID is not set")
 	}
 	if val, ok := conf["providersecret"]; ok {
-		c.ProviderSecret = cast.ToString(val)
-	} else {
-		return errors.New("providerSecret is not set")
+		v, err := secrets.Resolve(cast.ToString(val))
+		if err != nil {
+			return fmt.Errorf("providerSecret: %s", err.Error())
+		}
+		c.ProviderSecret = v
 	}
 	if val, ok := conf["offeringactivelengthsec"]; ok {
 		c.OfferingActiveLengthSec = cast.ToDuration(val)
@@ -64,16 +109,114 @@ func (c *Config) Load(conf map[string]interface{}) error {
 		return errors.New("offeringserver is not set")
 	}
 	if val, ok := conf["pipeaccesstoken"]; ok {
-		c.PipeAccessToken = cast.ToString(val)
+		v, err := secrets.Resolve(cast.ToString(val))
+		if err != nil {
+			return fmt.Errorf("pipeAccessToken: %s", err.Error())
+		}
+		c.PipeAccessToken = v
 	} else {
 		return errors.New("pipeAccessToken is not set")
 	}
+	if err := c.loadProviders(conf, secrets); err != nil {
+		return err
+	}
+	if err := c.loadWebhooks(conf, secrets); err != nil {
+		return err
+	}
+	if val, ok := conf["pipetimeoutsec"]; ok {
+		c.PipeTimeoutSec = cast.ToDuration(val)
+	}
+	if val, ok := conf["piperetries"]; ok {
+		c.PipeRetries = cast.ToInt(val)
+	}
+	if val, ok := conf["pipeproxy"]; ok {
+		c.PipeProxy = cast.ToString(val)
+	}
+	if val, ok := conf["pipecafile"]; ok {
+		c.PipeCAFile = cast.ToString(val)
+	}
+	if val, ok := conf["breakerthreshold"]; ok {
+		c.BreakerThreshold = cast.ToInt(val)
+	}
+	if val, ok := conf["breakercooldownsec"]; ok {
+		c.BreakerCooldownSec = cast.ToDuration(val)
+	}
+	if val, ok := conf["breakerdeactivate"]; ok {
+		c.BreakerDeactivate = cast.ToBool(val)
+	}
+	if val, ok := conf["driftsamplesize"]; ok {
+		c.DriftSampleSize = cast.ToInt(val)
+	}
+	if val, ok := conf["driftthreshold"]; ok {
+		c.DriftThreshold = cast.ToFloat64(val)
+	}
+	if val, ok := conf["driftdeactivate"]; ok {
+		c.DriftDeactivate = cast.ToBool(val)
+	}
+	if val, ok := conf["fallbackdir"]; ok {
+		c.FallbackDir = cast.ToString(val)
+	}
+	if val, ok := conf["registeredfile"]; ok {
+		c.RegisteredFile = cast.ToString(val)
+	}
+	if val, ok := conf["statefile"]; ok {
+		c.StateFile = cast.ToString(val)
+	}
+	if val, ok := conf["reconcileintervalsec"]; ok {
+		c.ReconcileIntervalSec = cast.ToDuration(val)
+	}
+	if val, ok := conf["streamintervalsec"]; ok {
+		c.StreamIntervalSec = cast.ToDuration(val)
+	}
+	if val, ok := conf["historydir"]; ok {
+		c.HistoryDir = cast.ToString(val)
+	}
+	if val, ok := conf["historyretentionsec"]; ok {
+		c.HistoryRetentionSec = cast.ToDuration(val)
+	}
+	if val, ok := conf["haleasedir"]; ok {
+		c.HALeaseDir = cast.ToString(val)
+	}
+	if val, ok := conf["haleasettlsec"]; ok {
+		c.HALeaseTTLSec = cast.ToDuration(val)
+	}
+	if val, ok := conf["hareplicaid"]; ok {
+		c.HAReplicaID = cast.ToString(val)
+	}
+	if c.StreamIntervalSec < 1 {
+		return errors.New("streamIntervalSec must be at least 1 sec")
+	}
+	if c.HistoryDir != "" && c.HistoryRetentionSec < 1 {
+		return errors.New("historyRetentionSec must be at least 1 sec")
+	}
+	if c.HALeaseDir != "" && c.HALeaseTTLSec < 3 {
+		return errors.New("haLeaseTTLSec must be at least 3 secs")
+	}
 
-	if val, ok := conf["mapskey"]; ok {
-		c.MapsKey = cast.ToString(val)
+	if val, ok := conf["geocoder"]; ok && cast.ToString(val) != "" {
+		c.Geocoder = cast.ToString(val)
 	} else {
+		c.Geocoder = "google"
+	}
+	if val, ok := conf["mapskey"]; ok {
+		v, err := secrets.Resolve(cast.ToString(val))
+		if err != nil {
+			return fmt.Errorf("mapsKey: %s", err.Error())
+		}
+		c.MapsKey = v
+	}
+	if c.Geocoder == "google" && c.MapsKey == "" {
 		return errors.New("mapsKey is not set")
 	}
+	if val, ok := conf["extenttolerance"]; ok {
+		c.ExtentTolerance = cast.ToFloat64(val)
+	}
+	if val, ok := conf["nominatimurl"]; ok {
+		c.NominatimURL = cast.ToString(val)
+	}
+	if val, ok := conf["geocodercachefile"]; ok {
+		c.GeocoderCacheFile = cast.ToString(val)
+	}
 	if val, ok := conf["httpport"]; ok && cast.ToInt(val) != 0 {
 		c.HTTPPort = cast.ToInt(val)
 	} else {
@@ -88,6 +231,41 @@ func (c *Config) Load(conf map[string]interface{}) error {
 	} else {
 		return errors.New("httphost is not set")
 	}
+	if val, ok := conf["tlscertfile"]; ok {
+		c.TLSCertFile = cast.ToString(val)
+	}
+	if val, ok := conf["tlskeyfile"]; ok {
+		c.TLSKeyFile = cast.ToString(val)
+	}
+	if c.TLSCertFile != "" && c.TLSKeyFile == "" {
+		return errors.New("tlsKeyFile is not set")
+	}
+	if val, ok := conf["tlsminversion"]; ok {
+		c.TLSMinVersion = cast.ToString(val)
+	}
+	if val, ok := conf["tlsciphers"]; ok {
+		c.TLSCiphers = cast.ToStringSlice(val)
+	}
+	if val, ok := conf["tlsclientcafile"]; ok {
+		c.TLSClientCAFile = cast.ToString(val)
+	}
+	if c.TLSClientCAFile != "" && c.TLSCertFile == "" {
+		return errors.New("tlsClientCAFile needs tlsCertFile")
+	}
+	if val, ok := conf["adminaddr"]; ok {
+		c.AdminAddr = cast.ToString(val)
+	}
+	if c.AdminAddr != "" {
+		if _, _, err := net.SplitHostPort(c.AdminAddr); err != nil {
+			return fmt.Errorf("invalid adminAddr: %v", err)
+		}
+	}
+	if val, ok := conf["traceexporter"]; ok {
+		c.TraceExporter = cast.ToString(val)
+	}
+	if val, ok := conf["traceendpoint"]; ok {
+		c.TraceEndpoint = cast.ToString(val)
+	}
 	if val, ok := conf["debug"]; ok {
 		c.Debug = cast.ToBool(val)
 	}
@@ -96,3 +274,62 @@ func (c *Config) Load(conf map[string]interface{}) error {
 	}
 	return nil
 }
+
+// secretSettings are the settings, at any level, whose values are secrets
+var secretSettings = map[string]bool{
+	"providersecret":  true,
+	"pipeaccesstoken": true,
+	"mapskey":         true,
+	"aws_key":         true,
+	"aws_secret":      true,
+}
+
+// secretPaths are the settings whose values are secrets only where they are,
+// [] stands for any item of a list
+var secretPaths = map[string]bool{
+	"webhooks[].url":    true, // i.e. Slack urls are secrets
+	"webhooks[].secret": true,
+}
+
+// RedactSettings returns a copy of settings, as returned by
+// viper.AllSettings(), with every secret value replaced so it can be dumped
+func RedactSettings(settings map[string]interface{}) map[string]interface{} {
+	return redactSettings("", settings)
+}
+
+// redactSettings redacts the settings found at path
+func redactSettings(path string, settings map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(settings))
+	for k, v := range settings {
+		key := strings.ToLower(k)
+		if path != "" {
+			key = path + "." + key
+		}
+
+		switch {
+		case secretSettings[strings.ToLower(k)], secretPaths[key]:
+			out[k] = secret.Redacted
+		default:
+			out[k] = redactValue(key, v)
+		}
+	}
+	return out
+}
+
+// redactValue redacts the settings nested in v, found at path
+func redactValue(path string, v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		return redactSettings(path, val)
+	case map[interface{}]interface{}:
+		return redactSettings(path, cast.ToStringMap(val))
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = redactValue(path+"[]", item)
+		}
+		return out
+	default:
+		return v
+	}
+}
@@ -0,0 +1,63 @@
+package gw
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/thingful/big-iot-gateway/pkg/secret"
+)
+
+func TestRedactSettings(t *testing.T) {
+	testCases := []struct {
+		name     string
+		settings map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			name:     "top level secrets",
+			settings: map[string]interface{}{"providersecret": "s3cr3t", "providerid": "Org-Prov", "mapskey": "key"},
+			expected: map[string]interface{}{"providersecret": secret.Redacted, "providerid": "Org-Prov", "mapskey": secret.Redacted},
+		},
+		{
+			name:     "urls outside webhooks are kept",
+			settings: map[string]interface{}{"marketplaceuri": "https://market.big-iot.org", "nominatimurl": "https://nominatim.openstreetmap.org", "url": "http://x"},
+			expected: map[string]interface{}{"marketplaceuri": "https://market.big-iot.org", "nominatimurl": "https://nominatim.openstreetmap.org", "url": "http://x"},
+		},
+		{
+			name: "provider profiles",
+			settings: map[string]interface{}{"providers": map[string]interface{}{
+				"other": map[string]interface{}{"providerSecret": "s3cr3t", "marketPlaceURI": "http://m", "secret": "kept"},
+			}},
+			expected: map[string]interface{}{"providers": map[string]interface{}{
+				"other": map[string]interface{}{"providerSecret": secret.Redacted, "marketPlaceURI": "http://m", "secret": "kept"},
+			}},
+		},
+		{
+			name: "webhooks",
+			settings: map[string]interface{}{"webhooks": []interface{}{
+				map[interface{}]interface{}{"url": "https://hooks.slack.com/services/T0/B0/X", "secret": "hmac", "events": []interface{}{"offering.registered"}},
+			}},
+			expected: map[string]interface{}{"webhooks": []interface{}{
+				map[string]interface{}{"url": secret.Redacted, "secret": secret.Redacted, "events": []interface{}{"offering.registered"}},
+			}},
+		},
+		{
+			name: "urls nested under webhooks items",
+			settings: map[string]interface{}{"webhooks": []interface{}{
+				map[string]interface{}{"URL": "https://hooks.example", "headers": map[string]interface{}{"url": "kept"}},
+			}},
+			expected: map[string]interface{}{"webhooks": []interface{}{
+				map[string]interface{}{"URL": secret.Redacted, "headers": map[string]interface{}{"url": "kept"}},
+			}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := RedactSettings(tc.settings)
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package gw
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/log"
+)
+
+// PayloadError is returned when a pipe response doesn't have the shape an
+// offer expects, e.g. an object or error document where a list of records
+// should be
+type PayloadError struct {
+	Path string // root path we were trying to resolve
+	Got  string // json type found instead
+}
+
+func (e *PayloadError) Error() string {
+	path := e.Path
+	if path == "" {
+		path = "<root>"
+	}
+	return fmt.Sprintf("unexpected pipe payload: expected array at %s, got %s", path, e.Got)
+}
+
+// envelope wraps converted records together with some metadata about the
+// offering when an offer has Envelope enabled
+type envelope struct {
+	OfferingID  string                   `json:"offeringId"`
+	Count       int                      `json:"count"`
+	GeneratedAt time.Time                `json:"generatedAt"`
+	License     string                   `json:"license,omitempty"`
+	Attribution string                   `json:"attribution,omitempty"`
+	Records     []map[string]interface{} `json:"records"`
+}
+
+// ConvertJSON takes pipe json and change to big-iot json depends on offerinConfig provide
+func ConvertJSON(pipeJson []byte, offering Offer) ([]byte, error) {
+	output, err := ConvertRecords(pipeJson, offering)
+	if err != nil {
+		return nil, err
+	}
+
+	if !offering.Envelope {
+		return json.Marshal(output)
+	}
+
+	return json.Marshal(envelope{
+		OfferingID:  offering.ID,
+		Count:       len(output),
+		GeneratedAt: time.Now().UTC(),
+		License:     offering.Datalicense,
+		Attribution: offering.Attribution,
+		Records:     output,
+	})
+}
+
+// ConvertRecords extracts the records of a pipe response and maps every pipe
+// term into its big-iot name. Members of the record array that aren't objects
+// are skipped.
+func ConvertRecords(pipeJson []byte, offering Offer) ([]map[string]interface{}, error) {
+	records, err := pipeRecords(pipeJson, offering.RootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	output := make([]map[string]interface{}, 0, len(records))
+	skipped := 0
+
+	for _, member := range records {
+		pipeData, ok := member.(map[string]interface{})
+		if !ok {
+			skipped++
+			continue
+		}
+
+		output = append(output, convertRecord(pipeData, offering))
+	}
+
+	if skipped > 0 {
+		log.Log("offering-id", offering.ID, "skipped", skipped, "msg", "ignoring non object records")
+	}
+
+	return output, nil
+}
+
+// convertRecord maps every pipe term of a record into its big-iot name
+func convertRecord(pipeData map[string]interface{}, offering Offer) map[string]interface{} {
+	bigiotData := map[string]interface{}{} // make temporary var
+
+	for _, output := range offering.Outputs {
+		if val, ok := pipeData[output.PipeTerm]; ok { // find if the key exist, if it does assign it
+			bigiotData[output.BigiotName] = val
+		} else { // if it doesn't exist, assing default value
+			bigiotData[output.BigiotName] = ""
+		}
+	}
+
+	return bigiotData
+}
+
+// pipeRecords unmarshals a pipe response and returns the array found at
+// rootPath, a dot separated list of object keys (empty for the document root)
+func pipeRecords(pipeJson []byte, rootPath string) ([]interface{}, error) {
+	var m interface{}
+	err := json.Unmarshal(pipeJson, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	if rootPath != "" {
+		for _, key := range strings.Split(rootPath, ".") {
+			obj, ok := m.(map[string]interface{})
+			if !ok {
+				return nil, &PayloadError{Path: rootPath, Got: jsonType(m)}
+			}
+			if m, ok = obj[key]; !ok {
+				return nil, &PayloadError{Path: rootPath, Got: "missing key " + key}
+			}
+		}
+	}
+
+	j, ok := m.([]interface{})
+	if !ok {
+		return nil, &PayloadError{Path: rootPath, Got: jsonType(m)}
+	}
+
+	return j, nil
+}
+
+// jsonType returns the json name of an unmarshalled value type
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
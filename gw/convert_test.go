@@ -0,0 +1,157 @@
+package gw
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPipeRecords(t *testing.T) {
+	testCases := []struct {
+		name     string
+		body     string
+		rootPath string
+		count    int
+		err      string
+	}{
+		{"root array", `[{"a":1},{"a":2}]`, "", 2, ""},
+		{"empty array", `[]`, "", 0, ""},
+		{"nested path", `{"data":{"items":[{"a":1}]}}`, "data.items", 1, ""},
+		{"object at root", `{"error":"unauthorized"}`, "", 0, "unexpected pipe payload: expected array at <root>, got object"},
+		{"missing key", `{"data":{}}`, "data.items", 0, "unexpected pipe payload: expected array at data.items, got missing key items"},
+		{"path through a non object", `{"data":[1]}`, "data.items", 0, "unexpected pipe payload: expected array at data.items, got array"},
+		{"null at path", `{"data":null}`, "data", 0, "unexpected pipe payload: expected array at data, got null"},
+		{"string at root", `"down for maintenance"`, "", 0, "unexpected pipe payload: expected array at <root>, got string"},
+		{"invalid json", `[{"a":`, "", 0, "unexpected end of JSON input"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			records, err := pipeRecords([]byte(tc.body), tc.rootPath)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(records) != tc.count {
+				t.Errorf("expected %d records, got %d", tc.count, len(records))
+			}
+		})
+	}
+}
+
+func TestConvertRecords(t *testing.T) {
+	offer := Offer{
+		ID: "parking",
+		Outputs: []Output{
+			{BigiotName: "freeSpaces", PipeTerm: "free"},
+			{BigiotName: "latitude", PipeTerm: "lat"},
+			{BigiotName: "longitude", PipeTerm: "lng"},
+		},
+	}
+
+	testCases := []struct {
+		name     string
+		body     string
+		rootPath string
+		expected []map[string]interface{}
+		payload  bool
+	}{
+		{
+			name: "pipe terms mapped to big-iot names",
+			body: `[{"free":3,"lat":45.07,"lng":7.68,"other":"dropped"}]`,
+			expected: []map[string]interface{}{
+				{"freeSpaces": 3.0, "latitude": 45.07, "longitude": 7.68},
+			},
+		},
+		{
+			name: "missing terms are empty",
+			body: `[{"free":null},{}]`,
+			expected: []map[string]interface{}{
+				{"freeSpaces": nil, "latitude": "", "longitude": ""},
+				{"freeSpaces": "", "latitude": "", "longitude": ""},
+			},
+		},
+		{
+			name: "members that aren't objects are skipped",
+			body: `[{"free":1},2,"three",[4]]`,
+			expected: []map[string]interface{}{
+				{"freeSpaces": 1.0, "latitude": "", "longitude": ""},
+			},
+		},
+		{
+			name:     "records under a root path",
+			body:     `{"meta":{},"results":[{"free":true,"lat":"45.07"}]}`,
+			rootPath: "results",
+			expected: []map[string]interface{}{
+				{"freeSpaces": true, "latitude": "45.07", "longitude": ""},
+			},
+		},
+		{
+			name:     "no records",
+			body:     `[]`,
+			expected: []map[string]interface{}{},
+		},
+		{
+			name:    "error document",
+			body:    `{"errors":[{"title":"not found"}]}`,
+			payload: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			o := offer
+			o.RootPath = tc.rootPath
+
+			records, err := ConvertRecords([]byte(tc.body), o)
+			if tc.payload {
+				if _, ok := err.(*PayloadError); !ok {
+					t.Fatalf("expected a PayloadError, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(records, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, records)
+			}
+		})
+	}
+}
+
+func TestConvertJSONEnvelope(t *testing.T) {
+	offer := Offer{
+		ID:          "parking",
+		Datalicense: "CC_BY_4.0",
+		Attribution: "City of Turin",
+		Envelope:    true,
+		Outputs:     []Output{{BigiotName: "freeSpaces", PipeTerm: "free"}},
+	}
+
+	b, err := ConvertJSON([]byte(`[{"free":3},{"free":4}]`), offer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	env := envelope{}
+	if err := json.Unmarshal(b, &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.OfferingID != "parking" || env.Count != 2 || len(env.Records) != 2 || env.License != "CC_BY_4.0" || env.Attribution != "City of Turin" || env.GeneratedAt.IsZero() {
+		t.Errorf("unexpected envelope %s", b)
+	}
+
+	offer.Envelope = false
+	b, err = ConvertJSON([]byte(`[{"free":3}]`), offer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(b) != `[{"freeSpaces":3}]` {
+		t.Errorf("unexpected records %s", b)
+	}
+}
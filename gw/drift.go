@@ -0,0 +1,197 @@
+package gw
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/log"
+	"github.com/thingful/big-iot-gateway/pkg/store"
+	"github.com/thingful/big-iot-gateway/pkg/webhook"
+)
+
+// baselineWeight is how much a healthy sample moves the baseline coverage
+const baselineWeight = 0.2
+
+// driftBucket keeps the drift state of the offers in the state store
+const driftBucket = "drift"
+
+// driftDetector compares how the outputs of every offer resolve in the
+// records sampled by the offering checks with a baseline, learnt from the
+// samples taken while the offer isn't drifting. An offer drifts when an
+// output resolves in threshold percentage points fewer records than the
+// baseline, or its values change type. The states are kept in st so the
+// baselines survive restarts.
+type driftDetector struct {
+	sampleSize int
+	threshold  float64
+	deactivate bool
+	st         *store.Store
+
+	mu     sync.Mutex
+	offers map[string]*offerDrift
+}
+
+// offerDrift is the drift state of an offer
+type offerDrift struct {
+	Drifting bool             `json:"drifting"`
+	Since    *time.Time       `json:"since,omitempty"`
+	Reasons  []string         `json:"reasons,omitempty"`
+	Baseline []OutputCoverage `json:"baseline"`
+	Last     []OutputCoverage `json:"last"`
+	Checked  time.Time        `json:"checked"`
+}
+
+// newDriftDetector returns a detector sampling sampleSize records, or nil
+// when sampleSize is 0 which disables drift detection
+func newDriftDetector(sampleSize int, threshold float64, deactivate bool, st *store.Store) *driftDetector {
+	if sampleSize <= 0 {
+		return nil
+	}
+	return &driftDetector{
+		sampleSize: sampleSize,
+		threshold:  threshold,
+		deactivate: deactivate,
+		st:         st,
+		offers:     map[string]*offerDrift{},
+	}
+}
+
+// observe measures the outputs of an offer in records and returns whether it
+// is drifting and if that changed with this sample
+func (d *driftDetector) observe(ctx context.Context, o Offer, records []interface{}) (drifting, changed bool) {
+	if d == nil || len(records) == 0 {
+		return false, false
+	}
+	coverage := outputCoverage(records, o.Outputs)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state, ok := d.offers[o.ID]
+	if !ok {
+		state = &offerDrift{Baseline: coverage, Last: coverage, Checked: time.Now().UTC()}
+		d.offers[o.ID] = state
+		d.keep(o.ID, state)
+		return false, false
+	}
+	state.Last = coverage
+	state.Checked = time.Now().UTC()
+
+	reasons := []string{}
+	for i, c := range coverage {
+		b := state.Baseline[i]
+		if b.Coverage-c.Coverage > d.threshold {
+			reasons = append(reasons, fmt.Sprintf("%s (%s) resolved in %.0f%% of records, was %.0f%%", c.BigiotName, c.PipeTerm, c.Coverage, b.Coverage))
+		}
+		// a baseline of mixed values has no type to change from, and
+		// integers becoming decimals are still numbers
+		if b.Type != "" && b.Type != "mixed" && c.Type != "" && typeChanged(b.Type, c.Type) {
+			reasons = append(reasons, fmt.Sprintf("%s (%s) values are %s, were %s", c.BigiotName, c.PipeTerm, c.Type, b.Type))
+		}
+	}
+
+	drifting = len(reasons) > 0
+	changed = drifting != state.Drifting
+	state.Drifting = drifting
+	state.Reasons = reasons
+
+	switch {
+	case drifting && changed:
+		now := time.Now().UTC()
+		state.Since = &now
+		log.Warn(ctx, "offering-id", o.ID, "reasons", strings.Join(reasons, "; "), "msg", "schema drift detected")
+		fireOffering(ctx, webhook.OfferingDrifting, o, "schema drift detected: "+strings.Join(reasons, "; "), nil)
+	case drifting:
+		log.Debug(ctx, "offering-id", o.ID, "reasons", strings.Join(reasons, "; "), "msg", "schema still drifting")
+	case changed:
+		state.Since = nil
+		log.Info(ctx, "offering-id", o.ID, "msg", "schema drift resolved")
+		fireOffering(ctx, webhook.OfferingDriftResolved, o, "schema drift resolved", nil)
+	}
+
+	// only healthy samples teach the baseline, so a drift isn't learnt
+	if !drifting {
+		for i, c := range coverage {
+			b := &state.Baseline[i]
+			b.Coverage += baselineWeight * (c.Coverage - b.Coverage)
+			if c.Type != "" {
+				b.Type = mergeType(b.Type, c.Type)
+			}
+		}
+	}
+	d.keep(o.ID, state)
+
+	return drifting, changed
+}
+
+// typeChanged tells whether values of type t no longer match the baseline
+// type, integers widening to numbers don't
+func typeChanged(baseline, t string) bool {
+	merged := mergeType(baseline, t)
+	return merged != baseline && !(baseline == "integer" && merged == "number")
+}
+
+// keep stages the state of an offer in the state store, it must be called
+// with the lock held
+func (d *driftDetector) keep(offerID string, state *offerDrift) {
+	if err := d.st.Stage(driftBucket, offerID, state); err != nil {
+		log.Log("error", err, "offering-id", offerID, "msg", "unable to keep drift state")
+	}
+}
+
+// restore reads the state of an offer left by a previous run, a baseline
+// learnt from other outputs is dropped
+func (d *driftDetector) restore(o Offer) error {
+	if d == nil {
+		return nil
+	}
+	state := &offerDrift{}
+	ok, err := d.st.Get(driftBucket, o.ID, state)
+	if !ok || err != nil {
+		return err
+	}
+	if len(state.Baseline) != len(o.Outputs) {
+		return nil
+	}
+	for i, b := range state.Baseline {
+		if b.BigiotName != o.Outputs[i].BigiotName || b.PipeTerm != o.Outputs[i].PipeTerm {
+			return nil
+		}
+	}
+
+	d.mu.Lock()
+	d.offers[o.ID] = state
+	d.mu.Unlock()
+	return nil
+}
+
+// deactivated tells whether an offer is kept deactivated because it drifts
+func (d *driftDetector) deactivated(offerID string) bool {
+	if d == nil || !d.deactivate {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state, ok := d.offers[offerID]
+	return ok && state.Drifting
+}
+
+// state returns a copy of the drift state of an offer
+func (d *driftDetector) state(offerID string) *offerDrift {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state, ok := d.offers[offerID]
+	if !ok {
+		return nil
+	}
+	s := *state
+	s.Baseline = append([]OutputCoverage(nil), state.Baseline...)
+	s.Last = append([]OutputCoverage(nil), state.Last...)
+	return &s
+}
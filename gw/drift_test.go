@@ -0,0 +1,175 @@
+package gw
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/thingful/big-iot-gateway/pkg/store"
+	"github.com/thingful/big-iot-gateway/pkg/webhook"
+)
+
+// sample returns n records, the first resolved of them with value v in the
+// "v" term
+func sample(n, resolved int, v interface{}) []interface{} {
+	records := make([]interface{}, n)
+	for i := range records {
+		r := map[string]interface{}{"other": true}
+		if i < resolved {
+			r["v"] = v
+		}
+		records[i] = r
+	}
+	return records
+}
+
+// mixed returns records alternating numbers and strings
+func mixed(n int) []interface{} {
+	records := make([]interface{}, n)
+	for i := range records {
+		if i%2 == 0 {
+			records[i] = map[string]interface{}{"v": 21.0}
+		} else {
+			records[i] = map[string]interface{}{"v": "high"}
+		}
+	}
+	return records
+}
+
+func TestDriftObserve(t *testing.T) {
+	offer := Offer{ID: "parking", Outputs: []Output{{BigiotName: "value", PipeTerm: "v"}}}
+
+	type step struct {
+		records  []interface{}
+		drifting bool
+		changed  bool
+	}
+	testCases := []struct {
+		name   string
+		steps  []step
+		events []string
+	}{
+		{
+			name: "coverage drop",
+			steps: []step{
+				{sample(10, 10, 21.0), false, false},
+				{sample(10, 10, 21.0), false, false},
+				{sample(10, 3, 21.0), true, true},
+				{sample(10, 3, 21.0), true, false},
+			},
+			events: []string{webhook.OfferingDrifting},
+		},
+		{
+			name: "small coverage drop",
+			steps: []step{
+				{sample(10, 10, 21.0), false, false},
+				{sample(10, 9, 21.0), false, false},
+			},
+		},
+		{
+			name: "type change",
+			steps: []step{
+				{sample(10, 10, 21.0), false, false},
+				{sample(10, 10, "21"), true, true},
+			},
+			events: []string{webhook.OfferingDrifting},
+		},
+		{
+			name: "integers widening to numbers",
+			steps: []step{
+				{sample(10, 10, 21.0), false, false},
+				{sample(10, 10, 21.5), false, false},
+				{sample(10, 10, 21.0), false, false},
+			},
+		},
+		{
+			name: "baseline already mixed",
+			steps: []step{
+				{mixed(10), false, false},
+				{mixed(10), false, false},
+				{sample(10, 10, "high"), false, false},
+				{mixed(10), false, false},
+			},
+		},
+		{
+			name: "recovery",
+			steps: []step{
+				{sample(10, 10, 21.0), false, false},
+				{sample(10, 10, "21"), true, true},
+				{sample(10, 2, "21"), true, false},
+				{sample(10, 10, 21.0), false, true},
+				{sample(10, 10, 21.0), false, false},
+			},
+			events: []string{webhook.OfferingDrifting, webhook.OfferingDriftResolved},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				mu     sync.Mutex
+				events []string
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				e := webhook.Event{}
+				json.NewDecoder(r.Body).Decode(&e)
+				mu.Lock()
+				events = append(events, e.Type)
+				mu.Unlock()
+			}))
+			defer srv.Close()
+			if err := webhook.Configure([]webhook.Target{{URL: srv.URL}}); err != nil {
+				t.Fatal(err)
+			}
+
+			st, _ := store.Open("")
+			d := newDriftDetector(10, 20, false, st)
+			for i, s := range tc.steps {
+				drifting, changed := d.observe(context.Background(), offer, s.records)
+				if drifting != s.drifting || changed != s.changed {
+					t.Errorf("step %d: expected drifting %v changed %v, got %v %v", i, s.drifting, s.changed, drifting, changed)
+				}
+			}
+
+			webhook.Shutdown(context.Background())
+			mu.Lock()
+			defer mu.Unlock()
+			if len(events) != len(tc.events) || (len(events) > 0 && !reflect.DeepEqual(events, tc.events)) {
+				t.Errorf("expected events %v, got %v", tc.events, events)
+			}
+		})
+	}
+}
+
+func TestDriftDeactivated(t *testing.T) {
+	offer := Offer{ID: "parking", Outputs: []Output{{BigiotName: "value", PipeTerm: "v"}}}
+
+	testCases := []struct {
+		name       string
+		deactivate bool
+		expected   bool
+	}{
+		{"deactivating", true, true},
+		{"logging only", false, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			st, _ := store.Open("")
+			d := newDriftDetector(10, 20, tc.deactivate, st)
+			d.observe(context.Background(), offer, sample(10, 10, 21.0))
+			d.observe(context.Background(), offer, sample(10, 0, 21.0))
+
+			if got := d.deactivated(offer.ID); got != tc.expected {
+				t.Errorf("expected deactivated %v, got %v", tc.expected, got)
+			}
+			if state := d.state(offer.ID); state == nil || !state.Drifting || state.Since == nil {
+				t.Errorf("expected a drifting state, got %+v", state)
+			}
+		})
+	}
+}
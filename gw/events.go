@@ -0,0 +1,62 @@
+package gw
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cast"
+	"github.com/thingful/big-iot-gateway/pkg/secret"
+	"github.com/thingful/big-iot-gateway/pkg/webhook"
+)
+
+// fireOffering sends a webhook event about an offer
+func fireOffering(ctx context.Context, eventType string, o Offer, message string, err error) {
+	e := webhook.Event{
+		Type:       eventType,
+		OfferingID: o.ID,
+		Provider:   offerProvider(o),
+		Message:    message,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	webhook.Fire(ctx, e)
+}
+
+// loadWebhooks reads the webhooks section of the configuration, url and
+// secret accept secret references
+func (c *Config) loadWebhooks(conf map[string]interface{}, secrets *secret.Resolver) error {
+	for i, val := range cast.ToSlice(conf["webhooks"]) {
+		settings := map[string]interface{}{}
+		for k, v := range cast.ToStringMap(val) {
+			settings[strings.ToLower(k)] = v
+		}
+
+		u, err := secrets.Resolve(cast.ToString(settings["url"]))
+		if err != nil {
+			return webhookError(i, "url", err)
+		}
+		s, err := secrets.Resolve(cast.ToString(settings["secret"]))
+		if err != nil {
+			return webhookError(i, "secret", err)
+		}
+
+		t := webhook.Target{
+			URL:     u.Reveal(),
+			Format:  cast.ToString(settings["format"]),
+			Secret:  s.Reveal(),
+			Events:  cast.ToStringSlice(settings["events"]),
+			Retries: webhook.DefaultRetries,
+		}
+		if r, ok := settings["retries"]; ok {
+			t.Retries = cast.ToInt(r)
+		}
+		c.Webhooks = append(c.Webhooks, t)
+	}
+	return nil
+}
+
+func webhookError(i int, setting string, err error) error {
+	return fmt.Errorf("webhook %d: %s: %s", i, setting, err.Error())
+}
@@ -0,0 +1,72 @@
+package gw
+
+import (
+	"strconv"
+
+	"github.com/thingful/big-iot-gateway/pkg/geocoder"
+	"github.com/thingful/big-iot-gateway/pkg/log"
+)
+
+// DefaultExtentSampleSize is the number of records requested from a pipe to
+// derive the extent of an offering
+const DefaultExtentSampleSize = 100
+
+// recordPoints returns the location of every pipe record that has a valid
+// latitude and longitude
+func recordPoints(records []interface{}) []geocoder.Point {
+	points := []geocoder.Point{}
+	for _, member := range records {
+		record, ok := member.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		lat, ok := toFloat(record["latitude"])
+		if !ok || lat < -90 || lat > 90 {
+			continue
+		}
+		lng, ok := toFloat(record["longitude"])
+		if !ok || lng < -180 || lng > 180 {
+			continue
+		}
+		points = append(points, geocoder.Point{Lat: lat, Lng: lng})
+	}
+	return points
+}
+
+// toFloat converts a json number, or a string holding one, into a float
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// updateExtent derives the bounds of an offering from sampled pipe records and
+// keeps them in the registry when they moved more than tolerance degrees
+func updateExtent(reg *registry, o Offer, records []interface{}, tolerance float64) {
+	points := recordPoints(records)
+	bounds := geocoder.BoundsOf(points)
+	if bounds == nil {
+		log.Log("offering-id", o.ID, "msg", "no coordinates in pipe records, keeping extent")
+		return
+	}
+
+	current, _ := reg.bounds(o.ID)
+	if !bounds.Differs(current, tolerance) {
+		return
+	}
+
+	log.Log(
+		"offering-id", o.ID,
+		"points", len(points),
+		"northEast", bounds.NorthEast,
+		"southWest", bounds.SouthWest,
+		"msg", "offering extent changed",
+	)
+	reg.setBounds(o.ID, bounds)
+}
@@ -0,0 +1,183 @@
+package gw
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/log"
+)
+
+// fallbackEntry is the last successful response served for an offer
+type fallbackEntry struct {
+	FetchedAt time.Time       `json:"fetchedAt"`
+	Body      json.RawMessage `json:"body"`
+}
+
+// fallbackFlushInterval is how often the responses stored since the last
+// flush are written to disk, so requests never wait for the disk
+const fallbackFlushInterval = 5 * time.Second
+
+// lastKnownGood keeps the last successful response of every offer so it can
+// be served when the pipe fails. Entries live in memory and, when dir is set,
+// are also written to disk in the background to survive restarts.
+type lastKnownGood struct {
+	dir string
+
+	mu      sync.RWMutex
+	entries map[string]fallbackEntry
+	dirty   map[string]bool
+}
+
+func newLastKnownGood(dir string) *lastKnownGood {
+	l := &lastKnownGood{
+		dir:     dir,
+		entries: map[string]fallbackEntry{},
+		dirty:   map[string]bool{},
+	}
+	if dir != "" {
+		go l.flushLoop(fallbackFlushInterval)
+	}
+	return l
+}
+
+// store saves body as the last good response of an offer, it's written to
+// disk by the next flush
+func (l *lastKnownGood) store(offerID string, body []byte) {
+	e := fallbackEntry{FetchedAt: time.Now().UTC(), Body: body}
+
+	l.mu.Lock()
+	l.entries[offerID] = e
+	if l.dir != "" {
+		l.dirty[offerID] = true
+	}
+	l.mu.Unlock()
+}
+
+// flushLoop flushes the stored responses every interval
+func (l *lastKnownGood) flushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		l.flush()
+	}
+}
+
+// flush writes the responses stored since the last flush, only the last one
+// of every offer
+func (l *lastKnownGood) flush() {
+	l.mu.Lock()
+	pending := make(map[string]fallbackEntry, len(l.dirty))
+	for offerID := range l.dirty {
+		pending[offerID] = l.entries[offerID]
+	}
+	l.dirty = map[string]bool{}
+	l.mu.Unlock()
+
+	for offerID, e := range pending {
+		if err := l.write(offerID, e); err != nil {
+			log.Log("error", err, "offering-id", offerID, "msg", "unable to persist fallback")
+		}
+	}
+}
+
+// load returns the last good response of an offer if it's not older than
+// maxAge
+func (l *lastKnownGood) load(offerID string, maxAge time.Duration) (fallbackEntry, bool) {
+	l.mu.RLock()
+	e, ok := l.entries[offerID]
+	l.mu.RUnlock()
+
+	if !ok && l.dir != "" {
+		e, ok = l.read(offerID)
+		if ok {
+			l.mu.Lock()
+			l.entries[offerID] = e
+			l.mu.Unlock()
+		}
+	}
+
+	if !ok || time.Since(e.FetchedAt) > maxAge {
+		return fallbackEntry{}, false
+	}
+	return e, true
+}
+
+func (l *lastKnownGood) path(offerID string) string {
+	return filepath.Join(l.dir, url.PathEscape(offerID)+".json")
+}
+
+// write saves an entry to a temporary file and renames it, so a crash never
+// leaves a half written fallback behind
+func (l *lastKnownGood) write(offerID string, e fallbackEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(l.dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(l.dir, ".fallback")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), l.path(offerID))
+}
+
+func (l *lastKnownGood) read(offerID string) (fallbackEntry, bool) {
+	var e fallbackEntry
+
+	b, err := ioutil.ReadFile(l.path(offerID))
+	if err != nil {
+		return e, false
+	}
+	if err := json.Unmarshal(b, &e); err != nil {
+		log.Log("error", err, "offering-id", offerID, "msg", "ignoring corrupt fallback")
+		return e, false
+	}
+	return e, true
+}
+
+// serveFallback writes the last good response of an offer, marked as stale. It
+// returns false if the offer has no fallback or it's too old.
+func serveFallback(w http.ResponseWriter, r *http.Request, lkg *lastKnownGood, o Offer) bool {
+	if o.FallbackMaxAgeSec <= 0 {
+		return false
+	}
+
+	e, ok := lkg.load(o.ID, time.Duration(o.FallbackMaxAgeSec)*time.Second)
+	if !ok {
+		return false
+	}
+
+	log.LogContext(r.Context(), "offering-id", o.ID, "fetchedAt", e.FetchedAt, "msg", "serving last known good response")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Warning", `110 - "Response is Stale"`)
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(e.FetchedAt).Seconds())))
+	w.Header().Set("X-Gateway-Stale", "true")
+	w.Header().Set("X-Gateway-Fetched-At", e.FetchedAt.Format(http.TimeFormat))
+	if _, err := w.Write(e.Body); err != nil {
+		log.LogContext(r.Context(), "error", err)
+	}
+	return true
+}
@@ -0,0 +1,169 @@
+package gw
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/log"
+	"github.com/thingful/big-iot-gateway/pkg/store"
+)
+
+// timestampTerm is the pipe term holding when a record was last updated
+const timestampTerm = "updatedAt"
+
+// freshnessBucket keeps the freshness state of the offers in the state store
+const freshnessBucket = "freshness"
+
+// freshness keeps whether the data of every offer with a MaxDataAgeSec is
+// fresh, judged on the newest updatedAt of the records sampled by the
+// offering checks. The states are kept in st, so an offer deactivated
+// because of old data stays so after a restart.
+type freshness struct {
+	st *store.Store
+
+	mu     sync.Mutex
+	offers map[string]*offerFreshness
+}
+
+// offerFreshness is the freshness state of an offer, Newest is nil when no
+// record had a timestamp
+type offerFreshness struct {
+	Fresh   bool       `json:"fresh"`
+	Newest  *time.Time `json:"newest,omitempty"`
+	Age     string     `json:"age,omitempty"`
+	MaxAge  string     `json:"maxAge"`
+	Since   time.Time  `json:"since"`
+	Checked time.Time  `json:"checked"`
+}
+
+func newFreshness(st *store.Store) *freshness {
+	return &freshness{st: st, offers: map[string]*offerFreshness{}}
+}
+
+// observe judges the records of an offer, returning whether its data is
+// stale and if that changed with this sample. Offers without MaxDataAgeSec
+// are always fresh.
+func (f *freshness) observe(ctx context.Context, o Offer, records []interface{}) (stale, changed bool) {
+	if o.MaxDataAgeSec <= 0 {
+		return false, false
+	}
+	maxAge := time.Duration(o.MaxDataAgeSec) * time.Second
+	now := time.Now().UTC()
+
+	newest, ok := newestTimestamp(records)
+	state := offerFreshness{
+		Fresh:   ok && now.Sub(newest) <= maxAge,
+		MaxAge:  maxAge.String(),
+		Since:   now,
+		Checked: now,
+	}
+	if ok {
+		state.Newest = &newest
+		state.Age = now.Sub(newest).Round(time.Second).String()
+	}
+
+	f.mu.Lock()
+	last, seen := f.offers[o.ID]
+	// until the first sample an offer is taken as fresh, it was registered
+	changed = (seen && last.Fresh != state.Fresh) || (!seen && !state.Fresh)
+	if seen && !changed {
+		state.Since = last.Since
+	}
+	f.offers[o.ID] = &state
+	if err := f.st.Stage(freshnessBucket, o.ID, state); err != nil {
+		log.Log("error", err, "offering-id", o.ID, "msg", "unable to keep freshness state")
+	}
+	f.mu.Unlock()
+
+	switch {
+	case changed && !state.Fresh && !ok:
+		log.Warn(ctx, "offering-id", o.ID, "maxAge", state.MaxAge, "msg", "no record has an "+timestampTerm+" timestamp, offering data is stale")
+	case changed && !state.Fresh:
+		log.Warn(ctx, "offering-id", o.ID, "newest", newest, "age", state.Age, "maxAge", state.MaxAge, "msg", "offering data is stale")
+	case changed:
+		log.Info(ctx, "offering-id", o.ID, "newest", newest, "age", state.Age, "msg", "offering data is fresh again")
+	}
+
+	return !state.Fresh, changed
+}
+
+// stale tells whether an offer is kept deactivated because its data is old
+func (f *freshness) stale(offerID string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	state, ok := f.offers[offerID]
+	return ok && !state.Fresh
+}
+
+// state returns a copy of the freshness state of an offer
+func (f *freshness) state(offerID string) *offerFreshness {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	state, ok := f.offers[offerID]
+	if !ok {
+		return nil
+	}
+	s := *state
+	return &s
+}
+
+// restore reads the state of an offer left by a previous run, if it still
+// has a MaxDataAgeSec
+func (f *freshness) restore(o Offer) error {
+	if o.MaxDataAgeSec <= 0 {
+		return nil
+	}
+	state := &offerFreshness{}
+	ok, err := f.st.Get(freshnessBucket, o.ID, state)
+	if !ok || err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.offers[o.ID] = state
+	f.mu.Unlock()
+	return nil
+}
+
+// newestTimestamp returns the most recent updatedAt of the records. RFC 3339
+// strings and unix times, in seconds or milliseconds, are understood.
+func newestTimestamp(records []interface{}) (time.Time, bool) {
+	var newest time.Time
+	found := false
+	for _, r := range records {
+		obj, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		t, ok := recordTimestamp(obj)
+		if !ok {
+			continue
+		}
+
+		if !found || t.After(newest) {
+			newest, found = t, true
+		}
+	}
+	return newest, found
+}
+
+// recordTimestamp returns the updatedAt of a record in UTC
+func recordTimestamp(obj map[string]interface{}) (time.Time, bool) {
+	switch v := obj[timestampTerm].(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return t.UTC(), true
+	case float64:
+		if v > 1e12 {
+			return time.Unix(0, int64(v)*int64(time.Millisecond)).UTC(), true
+		}
+		return time.Unix(int64(v), 0).UTC(), true
+	default:
+		return time.Time{}, false
+	}
+}
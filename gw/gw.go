@@ -2,25 +2,34 @@ package gw
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"os"
 	"os/signal"
 
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/spf13/viper"
+	"github.com/thingful/big-iot-gateway/pkg/breaker"
+	"github.com/thingful/big-iot-gateway/pkg/geocoder"
+	"github.com/thingful/big-iot-gateway/pkg/history"
 	"github.com/thingful/big-iot-gateway/pkg/log"
+	"github.com/thingful/big-iot-gateway/pkg/marketplace"
 	"github.com/thingful/big-iot-gateway/pkg/middleware"
 	"github.com/thingful/big-iot-gateway/pkg/pipes"
+	"github.com/thingful/big-iot-gateway/pkg/secret"
+	"github.com/thingful/big-iot-gateway/pkg/store"
+	"github.com/thingful/big-iot-gateway/pkg/trace"
+	"github.com/thingful/big-iot-gateway/pkg/webhook"
 	"github.com/thingful/bigiot"
 	goji "goji.io"
 	"goji.io/pat"
-	"googlemaps.github.io/maps"
 )
 
 var (
@@ -51,16 +60,39 @@ var (
 
 // Start starts gw service
 func Start(config Config, offers []Offer) error {
-	stop := make(chan os.Signal)
+	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt)
 
 	addCommonOutputToOfferings(offers)
 
 	if config.Debug {
-		log.Log("settings", viper.AllSettings())
+		log.Log("settings", RedactSettings(viper.AllSettings()))
 	}
 
-	provider, err := authenticateProvider(config.ProviderID, config.ProviderSecret, config.MarketPlaceURI)
+	exporter, err := newTraceExporter(config)
+	if err != nil {
+		return err
+	}
+	trace.SetExporter(exporter)
+
+	// configured before the providers log in, so their failures are sent
+	if err := webhook.Configure(config.Webhooks); err != nil {
+		return err
+	}
+
+	profiles, err := newProfiles(config)
+	if err != nil {
+		return err
+	}
+
+	// offers of unknown providers are dropped so that every remaining offer
+	// has a profile
+	offers, err = profileOffers(offers, profiles)
+	if err != nil {
+		return err
+	}
+
+	pipeClients, err := offerPipeClients(offers, profiles, secret.NewResolver(config.SecretKeyFile))
 	if err != nil {
 		return err
 	}
@@ -70,40 +102,167 @@ func Start(config Config, offers []Offer) error {
 		return err
 	}
 
-	mapClient, err := maps.NewClient(maps.WithAPIKey(config.MapsKey))
+	st, err := store.Open(config.StateFile)
 	if err != nil {
 		return err
 	}
 
-	offerings := []*bigiot.Offering{}
+	geo, err := newGeocoder(config, st)
+	if err != nil {
+		return err
+	}
 
-	for _, o := range offers {
-		log.Log("offering-id", o.ID, "msg", "registering")
+	host := offeringEndpoint.String()
+	imported, err := importRegistrations(config.RegisteredFile, st)
+	if err != nil {
+		return err
+	}
+	if imported > 0 {
+		log.Log("file", config.RegisteredFile, "registrations", imported, "msg", "imported registrations into the state file")
+	}
+	reg := newRegistry(st)
+	lkg := newLastKnownGood(config.FallbackDir)
 
-		offeringDescription := makeOfferingInput(o, offeringEndpoint.String(), config.OfferingActiveLengthSec, mapClient)
+	// in HA mode only the leader changes the marketplace
+	var leader *elector
 
-		offering, err := provider.RegisterOffering(context.Background(), offeringDescription)
-		if err != nil {
-			log.Log("error", err, "offer", o.Name)
+	breakers := newPipeBreakers(offers, config.BreakerThreshold, config.BreakerCooldownSec*time.Second, func(pipeOffers []Offer, to breaker.State) {
+		if !config.BreakerDeactivate || !leader.leading() {
+			return
+		}
+		ctx := log.WithRequestID(context.Background(), log.NewRequestID())
+		for _, o := range pipeOffers {
+			p := profiles[offerProvider(o)]
+			if !p.authenticated {
+				continue
+			}
+			var err error
+			switch to {
+			case breaker.Open:
+				err = deactivateOffering(ctx, p.provider, reg, o, "pipe circuit open")
+			case breaker.Closed:
+				log.LogContext(ctx, "offering-id", o.ID, "msg", "pipe recovered, reactivating offering")
+				err = registerOffering(ctx, p.provider, reg, o, host, config.OfferingActiveLengthSec, geo)
+			}
+			if err != nil {
+				log.LogContext(ctx, "error", err, "offering-id", o.ID)
+			}
+		}
+	})
+
+	drift := newDriftDetector(config.DriftSampleSize, config.DriftThreshold, config.DriftDeactivate, st)
+	fresh := newFreshness(st)
+	use, err := newUsage(st)
+	if err != nil {
+		return err
+	}
+
+	registerOffers := func(ctx context.Context) {
+		for _, o := range offers {
+			p := profiles[offerProvider(o)]
+			if !p.authenticated {
+				log.LogContext(ctx, "offering-id", o.ID, "provider", p.name, "msg", "provider not authenticated, skipping registration")
+				continue
+			}
+
+			// an offering deactivated by the previous run waits for its
+			// checks to reactivate it
+			if drift.deactivated(o.ID) || fresh.stale(o.ID) {
+				log.LogContext(ctx, "offering-id", o.ID, "msg", "offering was deactivated by a previous run, keeping it deactivated")
+				continue
+			}
+
+			log.LogContext(ctx, "offering-id", o.ID, "provider", p.name, "msg", "registering")
+
+			err := registerOffering(ctx, p.provider, reg, o, host, config.OfferingActiveLengthSec, geo)
+			if err != nil {
+				log.LogContext(ctx, "error", err, "offering-id", o.ID)
+			}
+		}
+	}
+
+	leader, err = newElector(config, func(ctx context.Context) {
+		// a new leader takes over what the previous one registered
+		if err := recoverState(ctx, offers, profiles, reg, drift, fresh); err != nil {
+			log.LogContext(ctx, "error", err, "msg", "unable to recover gateway state")
 		}
+		registerOffers(ctx)
+	})
+	if err != nil {
+		return err
+	}
 
-		offerings = append(offerings, offering)
+	startCtx := log.WithRequestID(context.Background(), log.NewRequestID())
+	if leader == nil {
+		if err := recoverState(startCtx, offers, profiles, reg, drift, fresh); err != nil {
+			return err
+		}
+		registerOffers(startCtx)
+	} else {
+		log.LogContext(startCtx, "replica", leader.replica, "leaseDir", config.HALeaseDir, "msg", "HA mode, waiting for the leader election")
+		go leader.run()
+	}
+	go syncLoop(st, stateSyncInterval)
 
+	for _, o := range offers {
+		p := profiles[offerProvider(o)]
+		if !p.authenticated {
+			continue
+		}
 		go func(off Offer) {
-			err := offeringCheck(off, provider, offeringEndpoint.String(), config.PipeAccessToken, config.OfferingCheckIntervalSec, mapClient)
+			err := offeringCheck(off, p.provider, reg, host, pipeClients[off.ID], breakers[off.PipeURL], drift, fresh, leader, config.OfferingCheckIntervalSec, config.ExtentTolerance, geo)
 			log.Log("error", err)
 		}(o)
 	}
 
+	if config.ReconcileIntervalSec > 0 {
+		r := newReconciler(config, offers, profiles, reg, host, geo, managedOffer(reg, breakers, drift, fresh), false)
+		go reconcileLoop(r, config.ReconcileIntervalSec*time.Second, leader)
+	}
+
 	rootMux := goji.NewMux()
 	bigiotMux := goji.SubMux()
 
+	rootMux.Use(middleware.RequestID)
+	rootMux.Use(middleware.Trace)
+	rootMux.Use(middleware.AccessLog)
+
 	rootMux.HandleFunc(pat.Get("/pulse"), pulse)
 	rootMux.Handle(pat.New("/offering/*"), bigiotMux)
 
+	// the admin surface has its own listener, off unless adminAddr is set
+	adminMux := goji.NewMux()
+	adminMux.Use(middleware.RequestID)
+	adminMux.Use(middleware.AccessLog)
+	adminMux.HandleFunc(pat.Get("/admin/offerings"), adminOfferings(offers, reg, breakers, drift, fresh, use))
+	adminMux.HandleFunc(pat.Get("/admin/loglevel"), adminLogLevel)
+	if leader != nil {
+		adminMux.HandleFunc(pat.Get("/admin/leader"), adminLeader(leader))
+	}
+	adminMux.HandleFunc(pat.Put("/admin/loglevel"), adminLogLevel)
+
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return err
+	}
+	adminTLSConfig, err := newAdminTLSConfig(tlsConfig, config)
+	if err != nil {
+		return err
+	}
+	if adminTLSConfig != nil && adminTLSConfig.ClientCAs != nil {
+		log.Log("msg", "requiring client certificates for admin")
+		adminMux.Use(middleware.RequireClientCert)
+	}
+
 	if !config.NoAuth {
 		log.Log("msg", "adding auth middleware")
-		auth, err := middleware.NewAuth(provider)
+		auth, err := middleware.NewAuth(func(offeringID string) (middleware.TokenValidator, bool) {
+			index := getOfferingIndex(offeringID, offers)
+			if index == -1 {
+				return nil, false
+			}
+			return profiles[offerProvider(offers[index])].provider, true
+		})
 		if err != nil {
 			return err
 		}
@@ -112,67 +271,270 @@ func Start(config Config, offers []Offer) error {
 		log.Log("msg", "no auth")
 	}
 
+	hub := newStreamHub(config.StreamIntervalSec*time.Second, pipeClients, breakers)
+	streamHandler := func(serve func(hub *streamHub, o Offer, w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			offeringID := pat.Param(r, "offeringID")
+			middleware.SetOffering(ctx, offeringID)
+			index := getOfferingIndex(offeringID, offers)
+			if index == -1 || !offers[index].Stream {
+				w.WriteHeader(404)
+				return
+			}
+			log.Debug(ctx, "offeringID", offeringID, "msg", "incoming stream subscription")
+			serve(hub, offers[index], w, r)
+		}
+	}
+	bigiotMux.HandleFunc(pat.Get("/:offeringID/stream"), streamHandler(serveSSE))
+	bigiotMux.HandleFunc(pat.Get("/:offeringID/ws"), streamHandler(serveWebSocket))
+
+	var hist *historyRecorder
+	if config.HistoryDir != "" {
+		hst, err := history.Open(config.HistoryDir)
+		if err != nil {
+			return err
+		}
+		hist = newHistoryRecorder(hst, config.HistoryRetentionSec*time.Second, pipeClients, breakers)
+	}
+	for _, o := range offers {
+		switch {
+		case o.SnapshotSec <= 0:
+		case hist == nil:
+			log.Log("offering-id", o.ID, "msg", "offer sets SnapshotSec but no historyDir is set, not keeping its history")
+		default:
+			go hist.run(o)
+		}
+	}
+	bigiotMux.HandleFunc(pat.Get("/:offeringID/history"), func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		offeringID := pat.Param(r, "offeringID")
+		middleware.SetOffering(ctx, offeringID)
+		index := getOfferingIndex(offeringID, offers)
+		if index == -1 || hist == nil || offers[index].SnapshotSec <= 0 {
+			w.WriteHeader(404)
+			return
+		}
+		log.Debug(ctx, "offeringID", offeringID, "msg", "incoming history query")
+		hist.serve(offers[index], w, r)
+	})
+
 	bigiotMux.HandleFunc(pat.Get("/:offeringID"), func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
 		offeringID := pat.Param(r, "offeringID")
-		log.Log("offeringID", offeringID, "msg", "incoming request")
+		middleware.SetOffering(ctx, offeringID)
+		log.Debug(ctx, "offeringID", offeringID, "msg", "incoming request")
 		index := getOfferingIndex(offeringID, offers)
 		if index == -1 { // we check if the path is valid, if not return 404
 			w.WriteHeader(404)
 			return
 		}
 
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		w = sw
+		defer func() {
+			use.count(offers[index].ID, sw.status, sw.Header().Get("X-Gateway-Stale") != "")
+		}()
+
 		// then we try to call pipe
 		pipeURL := offers[index].PipeURL
-		pipeJSON, err := pipes.MakeRequest(pipeURL, config.PipeAccessToken)
+		pipeBreaker := breakers[pipeURL]
+		if wait, ok := pipeBreaker.Allow(); !ok {
+			log.LogContext(ctx, "offering-id", offers[index].ID, "msg", "pipe circuit open, rejecting request")
+			if serveFallback(w, r, lkg, offers[index]) {
+				return
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			w.WriteHeader(503)
+			return
+		}
+
+		pipeJSON, err := pipeClients[offers[index].ID].Get(ctx, pipeURL, offerTimeout(offers[index]))
+		record(ctx, pipeBreaker, err)
 		if err != nil {
-			log.Log("error", err)
+			log.LogContext(ctx, "error", err, "offering-id", offers[index].ID)
+			if serveFallback(w, r, lkg, offers[index]) {
+				return
+			}
 			w.WriteHeader(500)
 			return
 		}
 
 		// now we reformat our json to their json
+		_, span := trace.Start(ctx, "convert", trace.Internal)
+		span.Set("offering.id", offers[index].ID)
+		span.Set("pipe.bytes", len(pipeJSON))
 		bigiotJSON, err := ConvertJSON(pipeJSON, offers[index])
+		span.SetError(err)
+		span.End()
 		if err != nil {
-			log.Log("error", err)
+			log.LogContext(ctx, "error", err, "offering-id", offers[index].ID)
+			if _, ok := err.(*PayloadError); ok {
+				if serveFallback(w, r, lkg, offers[index]) {
+					return
+				}
+				w.WriteHeader(502)
+				return
+			}
 			w.WriteHeader(500)
 			return
 		}
 
+		if offers[index].FallbackMaxAgeSec > 0 {
+			lkg.store(offers[index].ID, bigiotJSON)
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		if _, err := io.WriteString(w, string(bigiotJSON)); err != nil {
-			log.Log("error", err)
+			log.LogContext(ctx, "error", err)
 		}
 	})
 
-	srv := &http.Server{Addr: fmt.Sprintf(":%d", config.HTTPPort), Handler: rootMux}
+	srv := &http.Server{
+		Addr:      net.JoinHostPort(config.HTTPHost, strconv.Itoa(config.HTTPPort)),
+		Handler:   rootMux,
+		TLSConfig: tlsConfig,
+	}
+
+	go serve(srv)
 
-	go func() {
-		log.Log("port", config.HTTPPort, "msg", "starting server")
-		log.Fatal(srv.ListenAndServe())
-	}()
+	var adminSrv *http.Server
+	if config.AdminAddr != "" {
+		adminSrv = &http.Server{
+			Addr:      config.AdminAddr,
+			Handler:   adminMux,
+			TLSConfig: adminTLSConfig,
+		}
+		go serve(adminSrv)
+	} else {
+		log.Log("msg", "admin listener disabled, set adminAddr to enable it")
+	}
 
 	<-stop
 
-	log.Log("msg", "shutting down, removing offerings")
+	// in HA mode the offerings stay while other replicas serve them
+	last, err := leader.leave(context.Background())
+	if err != nil {
+		log.Log("error", err, "msg", "unable to leave the leader lease, leaving offerings registered")
+	}
+	removed := offers
+	if !last {
+		removed = nil
+		log.Log("msg", "shutting down, other replicas keep serving the offerings")
+	} else {
+		log.Log("msg", "shutting down, removing offerings")
+	}
+
+	// range over offerings and remove them all from marketplace, a failure
+	// with one provider doesn't stop the others from cleaning up
+	clients := newMarketplaceClients(config)
+	listed := map[string]map[string]marketplace.RemoteOffering{}
+	for _, o := range removed {
+		name := offerProvider(o)
+		id, ok := reg.get(o.ID)
+		if !ok && leader != nil && profiles[name].authenticated {
+			// the last replica may never have led, the offerings the
+			// others registered are looked up on the marketplace
+			if _, done := listed[name]; !done {
+				ctx := log.WithRequestID(context.Background(), log.NewRequestID())
+				remote, err := registeredOfferings(ctx, clients[name], config.Providers[name].ID)
+				if err != nil {
+					log.LogContext(ctx, "error", err, "provider", name, "msg", "unable to list offerings, leaving them registered")
+				}
+				listed[name] = remote
+			}
+			var ro marketplace.RemoteOffering
+			ro, ok = listed[name][o.ID]
+			id = ro.ID
+		}
+		if !ok {
+			continue
+		}
 
-	// range over offerings and remove them all from marketplace
-	for _, o := range offerings {
 		deleteOffering := &bigiot.DeleteOffering{
-			ID: o.ID,
+			ID: id,
 		}
 
-		err = provider.DeleteOffering(context.Background(), deleteOffering)
+		err = profiles[offerProvider(o)].provider.DeleteOffering(context.Background(), deleteOffering)
 		if err != nil {
-			return err
+			log.Log("error", err, "offering-id", o.ID)
+			continue
 		}
+		reg.remove(o.ID)
+		fireOffering(context.Background(), webhook.OfferingDeleted, o, "gateway shutting down, offering deleted", nil)
+	}
+	if err := st.Sync(); err != nil {
+		log.Log("error", err, "msg", "unable to save gateway state")
 	}
+	lkg.flush()
 
+	hub.close()
 	srv.Shutdown(context.Background())
+	if adminSrv != nil {
+		adminSrv.Shutdown(context.Background())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := trace.Shutdown(ctx); err != nil {
+		log.Log("error", err, "msg", "unable to export pending spans")
+	}
+	if err := webhook.Shutdown(ctx); err != nil {
+		log.Log("error", err, "msg", "unable to deliver pending webhooks")
+	}
 
 	return nil
 
 }
 
+// newTraceExporter returns the configured span exporter, nil when tracing is
+// disabled
+func newTraceExporter(config Config) (trace.Exporter, error) {
+	switch config.TraceExporter {
+	case "", "none":
+		return nil, nil
+	case "stdout":
+		return trace.NewWriterExporter(os.Stdout), nil
+	case "otlp":
+		endpoint := config.TraceEndpoint
+		if endpoint == "" {
+			endpoint = trace.DefaultOTLPEndpoint
+		}
+		return trace.NewOTLPExporter(endpoint, "big-iot-gateway"), nil
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %s", config.TraceExporter)
+	}
+}
+
+// newGeocoder returns the configured geocoder fronted by a cache, kept in st
+// when it's set
+func newGeocoder(config Config, st *store.Store) (geocoder.Geocoder, error) {
+	var (
+		geo geocoder.Geocoder
+		err error
+	)
+
+	switch config.Geocoder {
+	case "google":
+		geo, err = geocoder.NewGoogle(config.MapsKey.Reveal())
+		if err != nil {
+			return nil, err
+		}
+	case "nominatim":
+		geo = geocoder.NewNominatim(config.NominatimURL, "big-iot-gateway (https://github.com/thingful/big-iot-gateway)")
+	case "none":
+		return geocoder.None{}, nil
+	default:
+		return nil, fmt.Errorf("unknown geocoder %s", config.Geocoder)
+	}
+
+	// results go to the state store, unless they have a file of their own
+	if st != nil && config.GeocoderCacheFile == "" {
+		return geocoder.NewStoreCache(st, geo)
+	}
+	return geocoder.NewCache(config.GeocoderCacheFile, geo)
+}
+
 func addCommonOutputToOfferings(o []Offer) {
 	for i := range o {
 		o[i].Outputs = append(o[i].Outputs, commonOutputs...)
@@ -180,25 +542,37 @@ func addCommonOutputToOfferings(o []Offer) {
 
 }
 
-func authenticateProvider(id, secret, uri string) (*bigiot.Provider, error) {
-	provider, err := bigiot.NewProvider(
-		id,
-		secret,
-		bigiot.WithMarketplace(uri),
-	)
-	if err != nil {
-		return nil, err
+// registerOffering registers an offer on the marketplace and keeps its
+// marketplace id
+func registerOffering(ctx context.Context, provider *bigiot.Provider, reg *registry, o Offer, host string, offeringActiveLengthSec time.Duration, geo geocoder.Geocoder) error {
+	if o.ExtentFromData {
+		if b, ok := reg.bounds(o.ID); ok {
+			o.BoundingBox = b
+		}
 	}
 
-	err = provider.Authenticate()
+	offeringDescription := makeOfferingInput(o, host, offeringActiveLengthSec, geo)
+
+	offering, err := provider.RegisterOffering(ctx, offeringDescription)
 	if err != nil {
-		return nil, err
+		fireOffering(ctx, webhook.OfferingRegistrationFailed, o, "offering registration failed", err)
+		return err
 	}
 
-	return provider, err
+	_, registered := reg.get(o.ID)
+	inactive := reg.inactive(o.ID)
+	reg.set(o, offering.ID, offeringDescription)
+
+	switch {
+	case !registered:
+		fireOffering(ctx, webhook.OfferingRegistered, o, "offering registered", nil)
+	case inactive:
+		fireOffering(ctx, webhook.OfferingActivated, o, "offering activated again", nil)
+	}
+	return nil
 }
 
-func makeOfferingInput(o Offer, host string, offeringActiveLengthSec time.Duration, mapClient *maps.Client) *bigiot.OfferingDescription {
+func makeOfferingInput(o Offer, host string, offeringActiveLengthSec time.Duration, geo geocoder.Geocoder) *bigiot.OfferingDescription {
 	var princingModel bigiot.PricingModel
 
 	if o.Price > 0 {
@@ -248,6 +622,13 @@ func makeOfferingInput(o Offer, host string, offeringActiveLengthSec time.Durati
 			ExpirationTime: time.Now().Add(offeringActiveLengthSec * time.Second), // need to set this
 		},
 	}
+	if o.Stream {
+		addOfferingInput.Endpoints = append(addOfferingInput.Endpoints, bigiot.Endpoint{
+			URI:                 streamURI(host, o),
+			EndpointType:        bigiot.WebSocket,
+			AccessInterfaceType: bigiot.BIGIoTLib,
+		})
+	}
 	for _, output := range o.Outputs {
 		d := bigiot.DataField{
 			Name:   output.BigiotName,
@@ -256,23 +637,26 @@ func makeOfferingInput(o Offer, host string, offeringActiveLengthSec time.Durati
 		addOfferingInput.Outputs = append(addOfferingInput.Outputs, d)
 	}
 
-	// attempt to get a geobounds for the given city location
-	geocodeResults, err := mapClient.Geocode(context.Background(), &maps.GeocodingRequest{
-		Address: o.City,
-	})
-	if err != nil {
-		log.Log("error", err)
+	// explicit bounds in the offer win, otherwise attempt to get a geobounds
+	// for the given city location
+	bounds := o.BoundingBox
+	if bounds == nil && o.City != "" {
+		var err error
+		bounds, err = geo.Geocode(context.Background(), o.City)
+		if err != nil {
+			log.Log("error", err, "offering-id", o.ID, "city", o.City, "msg", "registering offering without bounding box")
+		}
 	}
 
-	if len(geocodeResults) > 0 {
+	if bounds != nil {
 		addOfferingInput.SpatialExtent.BoundingBox = &bigiot.BoundingBox{
 			Location1: bigiot.Location{
-				Lng: geocodeResults[0].Geometry.Bounds.NorthEast.Lng,
-				Lat: geocodeResults[0].Geometry.Bounds.NorthEast.Lat,
+				Lng: bounds.NorthEast.Lng,
+				Lat: bounds.NorthEast.Lat,
 			},
 			Location2: bigiot.Location{
-				Lng: geocodeResults[0].Geometry.Bounds.SouthWest.Lng,
-				Lat: geocodeResults[0].Geometry.Bounds.SouthWest.Lat,
+				Lng: bounds.SouthWest.Lng,
+				Lat: bounds.SouthWest.Lat,
 			},
 		}
 	}
@@ -280,56 +664,174 @@ func makeOfferingInput(o Offer, host string, offeringActiveLengthSec time.Durati
 	return addOfferingInput
 }
 
-// the first register could also happen here
+// the first register could also happen here. Failures are recorded and the
+// offering is checked again on the next tick, the loop never ends.
 func offeringCheck(
 	offering Offer,
 	provider *bigiot.Provider,
+	reg *registry,
 	host string,
-	pipeAccessToken string,
+	pipeClient *pipes.Client,
+	pipeBreaker *breaker.Breaker,
+	drift *driftDetector,
+	fresh *freshness,
+	leader *elector,
 	offeringCheckIntervalSec time.Duration,
-	mapClient *maps.Client) error {
+	extentTolerance float64,
+	geo geocoder.Geocoder) error {
+
+	// we only need one record to know the pipe works, but we sample more
+	// to detect drift and when the extent is derived from the data
+	limit := 1
+	if drift != nil && drift.sampleSize > limit {
+		limit = drift.sampleSize
+	}
+	if offering.ExtentFromData {
+		size := offering.ExtentSampleSize
+		if size <= 0 {
+			size = DefaultExtentSampleSize
+		}
+		if size > limit {
+			limit = size
+		}
+	}
+
+	// the newest record can be anywhere in the response, so offers with a
+	// MaxDataAgeSec fetch all of them and only sample the limit
+	pipeURL := fmt.Sprintf("%s?limit=%d", offering.PipeURL, limit)
+	if offering.MaxDataAgeSec > 0 {
+		pipeURL = offering.PipeURL
+	}
 
 	ticker := time.NewTicker(time.Second * offeringCheckIntervalSec)
 	for range ticker.C {
+		// followers leave the offerings to the leader
+		if !leader.leading() {
+			continue
+		}
+
+		ctx := log.WithRequestID(context.Background(), log.NewRequestID())
+
+		// while the circuit is open the breaker owns the offering state
+		if _, ok := pipeBreaker.Allow(); !ok {
+			log.LogContext(ctx, "offering-id", offering.ID, "msg", "pipe circuit open, skipping check")
+			reg.setCheck(offering.ID, checkResult{Result: "circuit open"})
+			continue
+		}
 
-		bytes, err := pipes.MakeRequest(offering.PipeURL+"?limit=1", pipeAccessToken)
+		bytes, err := pipeClient.Get(ctx, pipeURL, offerTimeout(offering))
+		record(ctx, pipeBreaker, err)
 		if err != nil {
-			return err
+			log.LogContext(ctx, "error", err, "offering-id", offering.ID)
+			reg.setCheck(offering.ID, checkResult{Result: "pipe failed", Error: err.Error()})
+			continue
 		}
 
 		// we unmarshal the response, check number of result
-		var m interface{}
-		err = json.Unmarshal(bytes, &m)
+		j, err := pipeRecords(bytes, offering.RootPath)
 		if err != nil {
-			return err
+			log.LogContext(ctx, "error", err, "offering-id", offering.ID)
+			reg.setCheck(offering.ID, checkResult{Result: "unexpected payload", Error: err.Error()})
+			continue
+		}
+		result := checkResult{Records: len(j)}
+		sample := j
+		if len(sample) > limit {
+			sample = sample[:limit]
 		}
 
-		j := m.([]interface{}) //type case to slice first
-		if len(j) == 1 {
-			//Debug
-			log.Log("msg", "pipe for offering: ", offering.Name, " return 1 result, re-registering offering:")
-			offeringDescription := makeOfferingInput(offering, host, offeringCheckIntervalSec, mapClient)
-			_, err = provider.RegisterOffering(context.Background(), offeringDescription)
+		if len(j) > 0 {
+			if offering.ExtentFromData {
+				updateExtent(reg, offering, sample, extentTolerance)
+			}
+
+			// a drifting offering stays deactivated until its records
+			// are back to normal, the next registration reactivates it.
+			// A failed deactivation is tried again on the next check.
+			drifting, changed := drift.observe(ctx, offering, sample)
+			if drifting && drift.deactivate {
+				if changed || !reg.inactive(offering.ID) {
+					if err := deactivateOffering(ctx, provider, reg, offering, "schema drifting"); err != nil {
+						log.LogContext(ctx, "error", err, "offering-id", offering.ID)
+					}
+				}
+				result.Result = "drifting"
+				reg.setCheck(offering.ID, result)
+				continue
+			}
+
+			// the same goes for an offering whose records are too old
+			if stale, changed := fresh.observe(ctx, offering, j); stale {
+				if changed || !reg.inactive(offering.ID) {
+					if err := deactivateOffering(ctx, provider, reg, offering, "data older than MaxDataAgeSec"); err != nil {
+						log.LogContext(ctx, "error", err, "offering-id", offering.ID)
+					}
+				}
+				result.Result = "stale"
+				reg.setCheck(offering.ID, result)
+				continue
+			}
+
+			log.LogContext(ctx, "offering-id", offering.ID, "msg", "pipe returned results, re-registering offering")
+			err = registerOffering(ctx, provider, reg, offering, host, offeringCheckIntervalSec, geo)
 			if err != nil {
-				return err
+				log.LogContext(ctx, "error", err, "offering-id", offering.ID)
+				result.Result, result.Error = "registration failed", err.Error()
+				reg.setCheck(offering.ID, result)
+				continue
 			}
+			result.Result = "registered"
+			reg.setCheck(offering.ID, result)
 
 		} else {
 			// delete offering from marketplace
-			log.Log("msg", offering.Name+" returns 0 result, deleting offering :"+offering.Name)
+			log.LogContext(ctx, "offering-id", offering.ID, "msg", "pipe returned no records, deleting offering")
 
+			id, ok := reg.get(offering.ID)
+			if !ok {
+				id = offering.ID
+			}
 			deleteOfferingInput := &bigiot.DeleteOffering{
-				ID: offering.ID,
+				ID: id,
 			}
-			err := provider.DeleteOffering(context.Background(), deleteOfferingInput)
+			err := provider.DeleteOffering(ctx, deleteOfferingInput)
 			if err != nil {
-				return err
+				log.LogContext(ctx, "error", err, "offering-id", offering.ID)
+				result.Result, result.Error = "delete failed", err.Error()
+				reg.setCheck(offering.ID, result)
+				continue
 			}
+			reg.remove(offering.ID)
+			result.Result = "deleted"
+			reg.setCheck(offering.ID, result)
+			fireOffering(ctx, webhook.OfferingDeleted, offering, "pipe returned no records, offering deleted", nil)
 		}
 	}
 	return nil
 }
 
+// offerTimeout returns the pipe timeout configured for an offer, zero means
+// the client's default
+func offerTimeout(o Offer) time.Duration {
+	return time.Duration(o.TimeoutSec) * time.Second
+}
+
+// serve runs a server until it's shut down, over HTTPS when it has a TLS
+// configuration
+func serve(srv *http.Server) {
+	var err error
+	if srv.TLSConfig != nil {
+		log.Log("addr", srv.Addr, "msg", "starting https server")
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		log.Log("addr", srv.Addr, "msg", "starting server")
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
 func pulse(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "ok")
 }
@@ -344,40 +846,3 @@ func getOfferingIndex(id string, offerings []Offer) int {
 	}
 	return offeringIndex
 }
-
-// ConvertJSON takes pipe json and change to big-iot json depends on offerinConfig provide
-func ConvertJSON(pipeJson []byte, offering Offer) ([]byte, error) {
-
-	output := []map[string]interface{}{}
-
-	var m interface{}
-	err := json.Unmarshal(pipeJson, &m)
-	if err != nil {
-		return nil, err
-	}
-
-	j := m.([]interface{}) //type case to slice first
-
-	for _, member := range j {
-		pipeData := member.(map[string]interface{}) // then for each member, cast to map string interface
-
-		bigiotData := map[string]interface{}{} // make temporary var
-
-		for _, output := range offering.Outputs {
-			if val, ok := pipeData[output.PipeTerm]; ok { // find if the key exist, if it does assign it
-				bigiotData[output.BigiotName] = val
-			} else { // if it doesn't exist, assing default value
-				bigiotData[output.BigiotName] = ""
-			}
-		}
-
-		output = append(output, bigiotData)
-	}
-
-	s, err := json.Marshal(output)
-	if err != nil {
-		return nil, err
-	}
-
-	return s, nil
-}
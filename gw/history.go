@@ -0,0 +1,296 @@
+package gw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/geocoder"
+	"github.com/thingful/big-iot-gateway/pkg/history"
+	"github.com/thingful/big-iot-gateway/pkg/log"
+	"github.com/thingful/big-iot-gateway/pkg/pipes"
+)
+
+const (
+	// historyDefaultRange is how far back history queries without from go
+	historyDefaultRange = 24 * time.Hour
+
+	// historyDefaultLimit and historyMaxLimit bound the records returned by
+	// a history query
+	historyDefaultLimit = 1000
+	historyMaxLimit     = 10000
+)
+
+// historyRecorder snapshots the converted records of the offers with a
+// SnapshotSec into the history store and answers history queries
+type historyRecorder struct {
+	st        *history.Store
+	retention time.Duration
+	clients   map[string]*pipes.Client
+	breakers  pipeBreakers
+}
+
+func newHistoryRecorder(st *history.Store, retention time.Duration, clients map[string]*pipes.Client, breakers pipeBreakers) *historyRecorder {
+	return &historyRecorder{
+		st:        st,
+		retention: retention,
+		clients:   clients,
+		breakers:  breakers,
+	}
+}
+
+// run snapshots an offer every SnapshotSec, starting right away
+func (h *historyRecorder) run(o Offer) {
+	ticker := time.NewTicker(time.Duration(o.SnapshotSec) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		ctx := log.WithRequestID(context.Background(), log.NewRequestID())
+		if err := h.snapshot(ctx, o); err != nil {
+			log.LogContext(ctx, "error", err, "offering-id", o.ID, "msg", "unable to snapshot offering history")
+		}
+		<-ticker.C
+	}
+}
+
+// snapshot keeps the current records of an offer and drops the days older
+// than its retention
+func (h *historyRecorder) snapshot(ctx context.Context, o Offer) error {
+	b := h.breakers[o.PipeURL]
+	if _, ok := b.Allow(); !ok {
+		log.Debug(ctx, "offering-id", o.ID, "msg", "pipe circuit open, skipping history snapshot")
+		return nil
+	}
+
+	body, err := h.clients[o.ID].Get(ctx, o.PipeURL, offerTimeout(o))
+	record(ctx, b, err)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	points, untimed, err := historyPoints(body, o)
+	if err != nil {
+		return err
+	}
+	if untimed > 0 {
+		log.Debug(ctx, "offering-id", o.ID, "records", untimed, "msg", "skipping records without updatedAt from history")
+	}
+
+	cutoff := now.Add(-h.offerRetention(o))
+	kept := points[:0]
+	for _, p := range points {
+		if p.Time.After(cutoff) {
+			kept = append(kept, p)
+		}
+	}
+
+	added, err := h.st.Append(o.ID, kept)
+	if err != nil {
+		return err
+	}
+	log.Debug(ctx, "offering-id", o.ID, "records", len(points), "added", added, "msg", "offering history snapshot")
+
+	removed, err := h.st.Prune(o.ID, cutoff)
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		log.LogContext(ctx, "offering-id", o.ID, "days", removed, "msg", "removed offering history past its retention")
+	}
+	return nil
+}
+
+// offerRetention returns how long the history of an offer is kept
+func (h *historyRecorder) offerRetention(o Offer) time.Duration {
+	if o.RetentionSec > 0 {
+		return time.Duration(o.RetentionSec) * time.Second
+	}
+	return h.retention
+}
+
+// historyPoints converts a pipe response into history points, timed by
+// their updatedAt and identified by the offer's SensorTerm. Records without
+// updatedAt can't be told apart from one snapshot to the next, they are
+// skipped and counted in untimed.
+func historyPoints(body []byte, o Offer) (points []history.Point, untimed int, err error) {
+	records, err := pipeRecords(body, o.RootPath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	points = make([]history.Point, 0, len(records))
+	for _, member := range records {
+		obj, ok := member.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		t, ok := recordTimestamp(obj)
+		if !ok {
+			untimed++
+			continue
+		}
+
+		raw, err := json.Marshal(convertRecord(obj, o))
+		if err != nil {
+			return nil, 0, err
+		}
+		p := history.Point{Time: t, Record: raw}
+		if o.SensorTerm != "" {
+			p.Sensor = sensorID(obj[o.SensorTerm])
+		}
+		if pts := recordPoints([]interface{}{obj}); len(pts) == 1 {
+			p.Location = &pts[0]
+		}
+		points = append(points, p)
+	}
+	return points, untimed, nil
+}
+
+// sensorID returns a sensor term value as a string, empty when it's missing
+func sensorID(v interface{}) string {
+	switch id := v.(type) {
+	case string:
+		return id
+	case float64:
+		return strconv.FormatFloat(id, 'f', -1, 64)
+	case nil:
+		return ""
+	default:
+		b, _ := json.Marshal(id)
+		return string(b)
+	}
+}
+
+// serve answers a history query for an offer. from and to are RFC 3339
+// times, bbox is minLng,minLat,maxLng,maxLat, sensor a SensorTerm value and
+// limit the most records returned.
+func (h *historyRecorder) serve(o Offer, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	q, err := h.parseQuery(o, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	points, truncated, err := h.st.Points(o.ID, q)
+	if err != nil {
+		log.LogContext(ctx, "error", err, "offering-id", o.ID, "msg", "unable to read offering history")
+		w.WriteHeader(500)
+		return
+	}
+
+	records := make([]map[string]interface{}, 0, len(points))
+	for _, p := range points {
+		rec := map[string]interface{}{}
+		if err := json.Unmarshal(p.Record, &rec); err != nil {
+			continue
+		}
+		records = append(records, rec)
+	}
+
+	var body []byte
+	if o.Envelope {
+		body, err = json.Marshal(envelope{
+			OfferingID:  o.ID,
+			Count:       len(records),
+			GeneratedAt: time.Now().UTC(),
+			License:     o.Datalicense,
+			Attribution: o.Attribution,
+			Records:     records,
+		})
+	} else {
+		body, err = json.Marshal(records)
+	}
+	if err != nil {
+		log.LogContext(ctx, "error", err, "offering-id", o.ID)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if truncated {
+		w.Header().Set("X-Gateway-Truncated", "true")
+	}
+	if _, err := w.Write(body); err != nil {
+		log.LogContext(ctx, "error", err)
+	}
+}
+
+// parseQuery reads the params of a history query, from is never before the
+// retention of the offer
+func (h *historyRecorder) parseQuery(o Offer, r *http.Request) (history.Query, error) {
+	params := r.URL.Query()
+	now := time.Now().UTC()
+	q := history.Query{To: now, Sensor: params.Get("sensor"), Limit: historyDefaultLimit}
+
+	if v := params.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, errors.New("to must be an RFC 3339 time")
+		}
+		q.To = t
+	}
+	q.From = q.To.Add(-historyDefaultRange)
+	if v := params.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, errors.New("from must be an RFC 3339 time")
+		}
+		q.From = t
+	}
+	if q.From.After(q.To) {
+		return q, errors.New("from must be before to")
+	}
+	if oldest := now.Add(-h.offerRetention(o)); q.From.Before(oldest) {
+		q.From = oldest
+	}
+
+	if v := params.Get("bbox"); v != "" {
+		b, err := parseBBox(v)
+		if err != nil {
+			return q, err
+		}
+		q.Bounds = b
+	}
+
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > historyMaxLimit {
+			return q, errors.New("limit must be between 1 and " + strconv.Itoa(historyMaxLimit))
+		}
+		q.Limit = n
+	}
+	return q, nil
+}
+
+// parseBBox reads a minLng,minLat,maxLng,maxLat bounding box
+func parseBBox(v string) (*geocoder.Bounds, error) {
+	invalid := errors.New("bbox must be minLng,minLat,maxLng,maxLat")
+
+	parts := strings.Split(v, ",")
+	if len(parts) != 4 {
+		return nil, invalid
+	}
+	n := make([]float64, 4)
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, invalid
+		}
+		n[i] = f
+	}
+	if n[0] > n[2] || n[1] > n[3] {
+		return nil, invalid
+	}
+
+	return &geocoder.Bounds{
+		SouthWest: geocoder.Point{Lng: n[0], Lat: n[1]},
+		NorthEast: geocoder.Point{Lng: n[2], Lat: n[3]},
+	}, nil
+}
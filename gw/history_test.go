@@ -0,0 +1,69 @@
+package gw
+
+import (
+	"testing"
+)
+
+func TestHistoryPoints(t *testing.T) {
+	offer := Offer{
+		ID:         "parking",
+		SensorTerm: "id",
+		Outputs: []Output{
+			{BigiotName: "free", PipeTerm: "free"},
+			{BigiotName: "latitude", PipeTerm: "latitude"},
+			{BigiotName: "longitude", PipeTerm: "longitude"},
+		},
+	}
+
+	testCases := []struct {
+		name    string
+		body    string
+		points  []string
+		untimed int
+	}{
+		{
+			name:   "timed records",
+			body:   `[{"id":"a","free":3,"updatedAt":"2026-10-01T10:00:00Z","latitude":41.39,"longitude":2.17},{"id":7,"free":1,"updatedAt":1790000000}]`,
+			points: []string{"a 2026-10-01T10:00:00Z", "7 2026-09-21T14:13:20Z"},
+		},
+		{
+			name:    "records without updatedAt are skipped",
+			body:    `[{"id":"a","free":3},{"id":"b","free":2,"updatedAt":"2026-10-01T10:00:00Z"},{"id":"c","updatedAt":"yesterday"}]`,
+			points:  []string{"b 2026-10-01T10:00:00Z"},
+			untimed: 2,
+		},
+		{
+			name:   "members that aren't objects",
+			body:   `[1,"two",null]`,
+			points: []string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			points, untimed, err := historyPoints([]byte(tc.body), offer)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if untimed != tc.untimed {
+				t.Errorf("expected %d untimed, got %d", tc.untimed, untimed)
+			}
+			if len(points) != len(tc.points) {
+				t.Fatalf("expected %d points, got %d", len(tc.points), len(points))
+			}
+			for i, p := range points {
+				if got := p.Sensor + " " + p.Time.UTC().Format("2006-01-02T15:04:05Z"); got != tc.points[i] {
+					t.Errorf("expected %s, got %s", tc.points[i], got)
+				}
+			}
+		})
+	}
+
+	points, _, _ := historyPoints([]byte(testCases[0].body), offer)
+	if points[0].Location == nil || points[0].Location.Lat != 41.39 {
+		t.Errorf("expected the location of the record, got %v", points[0].Location)
+	}
+	if string(points[0].Record) != `{"free":3,"latitude":41.39,"longitude":2.17}` {
+		t.Errorf("unexpected record %s", points[0].Record)
+	}
+}
@@ -0,0 +1,172 @@
+package gw
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/lease"
+	"github.com/thingful/big-iot-gateway/pkg/log"
+)
+
+// elector keeps the replica in the lease shared by the replicas of an HA
+// deployment, and tells whether it's the leader, the only replica changing
+// the marketplace. A nil elector, HA disabled, always leads.
+type elector struct {
+	lease     lease.Lease
+	replica   string
+	ttl       time.Duration
+	onElected func(ctx context.Context)
+
+	// calls to the lease are serialized, so a renewal can't bring the
+	// replica back after it left
+	leaseMu sync.Mutex
+
+	mu      sync.Mutex
+	leader  string
+	leads   bool
+	stopped bool
+	stop    chan struct{}
+}
+
+// leaderStatus is the HA state shown on the admin surface
+type leaderStatus struct {
+	Replica string `json:"replica"`
+	Leader  string `json:"leader"`
+	Leading bool   `json:"leading"`
+}
+
+// newElector returns the elector of the replica, or nil when HA is disabled.
+// onElected is called every time the replica becomes the leader.
+func newElector(config Config, onElected func(ctx context.Context)) (*elector, error) {
+	if config.HALeaseDir == "" {
+		return nil, nil
+	}
+
+	l, err := lease.NewFile(config.HALeaseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	replica := config.HAReplicaID
+	if replica == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		replica = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+
+	return &elector{
+		lease:     l,
+		replica:   replica,
+		ttl:       config.HALeaseTTLSec * time.Second,
+		onElected: onElected,
+		stop:      make(chan struct{}),
+	}, nil
+}
+
+// run renews the lease every third of its ttl, starting right away
+func (e *elector) run() {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		e.renew()
+
+		select {
+		case <-ticker.C:
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// renew keeps the replica alive in the lease and follows who leads. When
+// the lease can't be reached the replica stops leading, another one may take
+// over once the lease expires.
+func (e *elector) renew() {
+	ctx := log.WithRequestID(context.Background(), log.NewRequestID())
+
+	e.leaseMu.Lock()
+	defer e.leaseMu.Unlock()
+	if e.isStopped() {
+		return
+	}
+
+	leader, err := e.lease.Renew(ctx, e.replica, e.ttl)
+	if err != nil {
+		log.Error(ctx, "error", err, "replica", e.replica, "msg", "unable to renew lease")
+		leader = ""
+	}
+
+	e.mu.Lock()
+	if e.stopped {
+		e.mu.Unlock()
+		return
+	}
+	was := e.leads
+	e.leader = leader
+	e.leads = leader == e.replica
+	elected, demoted := e.leads && !was, was && !e.leads
+	e.mu.Unlock()
+
+	switch {
+	case elected:
+		log.Info(ctx, "replica", e.replica, "msg", "elected leader, managing marketplace offerings")
+		if e.onElected != nil {
+			go e.onElected(ctx)
+		}
+	case demoted:
+		log.Warn(ctx, "replica", e.replica, "leader", leader, "msg", "lost leadership, no longer managing marketplace offerings")
+	}
+}
+
+// leading tells whether the replica may change the marketplace
+func (e *elector) leading() bool {
+	if e == nil {
+		return true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leads
+}
+
+// leave stops leading and removes the replica from the lease, returning
+// whether it was the last replica alive
+func (e *elector) leave(ctx context.Context) (bool, error) {
+	if e == nil {
+		return true, nil
+	}
+
+	e.mu.Lock()
+	if !e.stopped {
+		e.stopped = true
+		e.leads = false
+		close(e.stop)
+	}
+	e.mu.Unlock()
+
+	e.leaseMu.Lock()
+	defer e.leaseMu.Unlock()
+	remaining, err := e.lease.Leave(ctx, e.replica)
+	if err != nil {
+		return false, err
+	}
+	return remaining == 0, nil
+}
+
+func (e *elector) isStopped() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.stopped
+}
+
+// status returns the HA state of the replica
+func (e *elector) status() leaderStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return leaderStatus{Replica: e.replica, Leader: e.leader, Leading: e.leads}
+}
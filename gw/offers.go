@@ -1,5 +1,9 @@
 package gw
 
+import (
+	"github.com/thingful/big-iot-gateway/pkg/geocoder"
+)
+
 type Output struct {
 	BigiotName string // short name for the Output
 	BigiotRDF  string // rdf of the Output
@@ -7,16 +11,47 @@ type Output struct {
 }
 
 type Offer struct {
-	ID          string  // id of offering, no space
-	Name        string  // name of offering, wiht space
-	City        string  // name of city
-	PipeURL     string  // url of thingful pipe
-	Category    string  // big-iot ontology represent categoty of this offering
-	Datalicense string  // big-iot datalicense
-	Price       float64 // price in cents
-	Outputs     []Output
+	ID                string           // id of offering, no space
+	Name              string           // name of offering, wiht space
+	Provider          string           // name of the provider profile, empty for the default one
+	City              string           // name of city
+	BoundingBox       *geocoder.Bounds // explicit spatial extent, skips geocoding City
+	ExtentFromData    bool             // derive the spatial extent from the coordinates of pipe records
+	ExtentSampleSize  int              // number of records sampled to derive the extent
+	PipeURL           string           // url of thingful pipe
+	Category          string           // big-iot ontology represent categoty of this offering
+	Datalicense       string           // big-iot datalicense
+	Price             float64          // price in cents
+	RootPath          string           // dot separated path to the record array in pipe's result, empty for root
+	Envelope          bool             // wrap records in an envelope with offering metadata
+	Attribution       string           // attribution included in the envelope
+	TimeoutSec        int              // timeout for pipe requests, overrides pipeTimeoutSec
+	Auth              *PipeAuth        // credentials for the pipe, the provider's pipeAccessToken when nil
+	FallbackMaxAgeSec int              // serve the last good response up to this age when the pipe fails, 0 disables it
+	MaxDataAgeSec     int              // deactivate the offering while its newest updatedAt is older, 0 disables it
+	Stream            bool             // serve new records on SSE and WebSocket endpoints, registering the WebSocket one
+	SnapshotSec       int              // snapshot the records into the history every this many secs, 0 disables it
+	RetentionSec      int              // how long the history is kept, overrides historyRetentionSec
+	SensorTerm        string           // pipe term identifying the sensor of a record in the history
+	Outputs           []Output
 }
 
 type OfferConf struct {
 	Offers []Offer
 }
+
+// PipeAuth describes how to authenticate with a pipe. Scheme is one of
+// thingful, bearer, basic, apikey-header, apikey-query or oauth2. Token,
+// Password, Key and ClientSecret accept secret references.
+type PipeAuth struct {
+	Scheme       string
+	Token        string   // thingful and bearer
+	Username     string   // basic
+	Password     string   // basic
+	Name         string   // apikey header or query param name
+	Key          string   // apikey
+	TokenURL     string   // oauth2
+	ClientID     string   // oauth2
+	ClientSecret string   // oauth2
+	Scopes       []string // oauth2
+}
@@ -0,0 +1,86 @@
+package gw
+
+import (
+	"fmt"
+
+	"github.com/thingful/big-iot-gateway/pkg/pipes"
+	"github.com/thingful/big-iot-gateway/pkg/secret"
+)
+
+// newAuthenticator builds the pipe authenticator described by an offer,
+// resolving any secret references in it
+func newAuthenticator(a *PipeAuth, secrets *secret.Resolver) (pipes.Authenticator, error) {
+	resolve := func(field, ref string) (string, error) {
+		if ref == "" {
+			return "", fmt.Errorf("%s auth needs %s", a.Scheme, field)
+		}
+		v, err := secrets.Resolve(ref)
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", field, err.Error())
+		}
+		return v.Reveal(), nil
+	}
+
+	switch a.Scheme {
+	case "thingful", "bearer":
+		token, err := resolve("Token", a.Token)
+		if err != nil {
+			return nil, err
+		}
+		if a.Scheme == "thingful" {
+			return pipes.ThingfulBearer(token), nil
+		}
+		return pipes.Bearer(token), nil
+
+	case "basic":
+		password, err := resolve("Password", a.Password)
+		if err != nil {
+			return nil, err
+		}
+		return pipes.Basic{Username: a.Username, Password: password}, nil
+
+	case "apikey-header", "apikey-query":
+		if a.Name == "" {
+			return nil, fmt.Errorf("%s auth needs Name", a.Scheme)
+		}
+		key, err := resolve("Key", a.Key)
+		if err != nil {
+			return nil, err
+		}
+		if a.Scheme == "apikey-header" {
+			return pipes.APIKeyHeader{Name: a.Name, Key: key}, nil
+		}
+		return pipes.APIKeyQuery{Name: a.Name, Key: key}, nil
+
+	case "oauth2":
+		if a.TokenURL == "" || a.ClientID == "" {
+			return nil, fmt.Errorf("oauth2 auth needs TokenURL and ClientID")
+		}
+		clientSecret, err := resolve("ClientSecret", a.ClientSecret)
+		if err != nil {
+			return nil, err
+		}
+		return pipes.NewClientCredentials(a.TokenURL, a.ClientID, clientSecret, a.Scopes), nil
+
+	default:
+		return nil, fmt.Errorf("unknown pipe auth scheme %q", a.Scheme)
+	}
+}
+
+// offerPipeClients returns the pipe client of every offer, offers with their
+// own credentials get a client sharing connections with their provider's one
+func offerPipeClients(offers []Offer, profiles map[string]*profile, secrets *secret.Resolver) (map[string]*pipes.Client, error) {
+	clients := map[string]*pipes.Client{}
+	for _, o := range offers {
+		client := profiles[offerProvider(o)].pipeClient
+		if o.Auth != nil {
+			auth, err := newAuthenticator(o.Auth, secrets)
+			if err != nil {
+				return nil, fmt.Errorf("offer %s: %s", o.ID, err.Error())
+			}
+			client = client.WithAuthenticator(auth)
+		}
+		clients[o.ID] = client
+	}
+	return clients, nil
+}
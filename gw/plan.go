@@ -0,0 +1,299 @@
+package gw
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/thingful/big-iot-gateway/pkg/geocoder"
+	"github.com/thingful/big-iot-gateway/pkg/log"
+	"github.com/thingful/bigiot"
+)
+
+// plan actions
+const (
+	ActionCreate    = "create"
+	ActionUpdate    = "update"
+	ActionUnchanged = "unchanged"
+	ActionOrphaned  = "orphaned"
+)
+
+// Change is what starting the gateway would do to the marketplace for an
+// offer, compared to what it last registered
+type Change struct {
+	Action        string        `json:"action"`
+	OfferID       string        `json:"offerId"`
+	Provider      string        `json:"provider"`
+	MarketplaceID string        `json:"marketplaceId,omitempty"`
+	Fields        []FieldChange `json:"fields,omitempty"`
+	Mutation      string        `json:"mutation,omitempty"`
+}
+
+// FieldChange is a field of the offering description that changed, values
+// are JSON encoded and empty when the field didn't exist
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// Plan builds the offering descriptions exactly as the gateway registers
+// them and compares them with the ones kept in the state file. It never
+// contacts the marketplace. Offers whose extent is derived from their data
+// use the last registered extent.
+func Plan(config Config, offers []Offer) ([]Change, error) {
+	if err := checkOfferIDs(offers); err != nil {
+		return nil, err
+	}
+
+	reg, err := readRegistry(config)
+	if err != nil {
+		return nil, err
+	}
+
+	offeringEndpoint, err := url.Parse(config.OfferingEndPoint)
+	if err != nil {
+		return nil, err
+	}
+	host := offeringEndpoint.String()
+
+	geo, err := newGeocoder(config, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	addCommonOutputToOfferings(offers)
+
+	changes := []Change{}
+	desired := map[string]bool{}
+	for _, o := range offers {
+		pc, ok := config.Providers[offerProvider(o)]
+		if !ok {
+			log.Log("offering-id", o.ID, "provider", offerProvider(o), "error", "unknown provider, ignoring offer")
+			continue
+		}
+		desired[o.ID] = true
+
+		last, registered := reg.registration(o.ID)
+		if o.ExtentFromData && o.BoundingBox == nil && registered {
+			o.BoundingBox = descriptionBounds(last.Description)
+		}
+
+		desc := makeOfferingInput(o, host, config.OfferingActiveLengthSec, geo)
+		mutation, err := dryRunMutation(pc.ID, func(p *bigiot.Provider) error {
+			_, err := p.RegisterOffering(context.Background(), desc)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		c := Change{
+			Action:   ActionCreate,
+			OfferID:  o.ID,
+			Provider: offerProvider(o),
+			Mutation: mutation,
+		}
+		if registered {
+			c.MarketplaceID = last.MarketplaceID
+			c.Fields = diffDescriptions(last.Description, desc)
+			c.Action = ActionUpdate
+			if len(c.Fields) == 0 {
+				c.Action = ActionUnchanged
+			}
+		}
+		changes = append(changes, c)
+	}
+
+	orphaned := []Change{}
+	for _, id := range reg.offerIDs() {
+		r, _ := reg.registration(id)
+		if !desired[id] {
+			orphaned = append(orphaned, Change{
+				Action:        ActionOrphaned,
+				OfferID:       id,
+				Provider:      r.Provider,
+				MarketplaceID: r.MarketplaceID,
+			})
+		}
+	}
+	sort.Slice(orphaned, func(i, j int) bool { return orphaned[i].OfferID < orphaned[j].OfferID })
+
+	return append(changes, orphaned...), nil
+}
+
+// WritePlan prints changes as a diff, the GraphQL mutations or json
+func WritePlan(w io.Writer, changes []Change, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(changes)
+
+	case "graphql":
+		for _, c := range changes {
+			if c.Mutation == "" {
+				continue
+			}
+			fmt.Fprintf(w, "# %s (provider %s)\n%s\n\n", c.OfferID, c.Provider, c.Mutation)
+		}
+		return nil
+
+	case "diff", "":
+		counts := map[string]int{}
+		for _, c := range changes {
+			counts[c.Action]++
+			switch c.Action {
+			case ActionCreate:
+				fmt.Fprintf(w, "+ %s (provider %s) will be created\n", c.OfferID, c.Provider)
+			case ActionUpdate:
+				fmt.Fprintf(w, "~ %s (provider %s) will be updated\n", c.OfferID, c.Provider)
+				for _, f := range c.Fields {
+					fmt.Fprintf(w, "    %s: %s -> %s\n", f.Field, orNone(f.Old), orNone(f.New))
+				}
+			case ActionUnchanged:
+				fmt.Fprintf(w, "  %s (provider %s) is unchanged\n", c.OfferID, c.Provider)
+			case ActionOrphaned:
+				fmt.Fprintf(w, "- %s (%s) was registered but is no longer in the offers\n", c.OfferID, c.MarketplaceID)
+			}
+		}
+		fmt.Fprintf(w, "\nPlan: %d to create, %d to update, %d unchanged, %d orphaned.\n",
+			counts[ActionCreate], counts[ActionUpdate], counts[ActionUnchanged], counts[ActionOrphaned])
+		return nil
+
+	default:
+		return fmt.Errorf("unknown plan format %s", format)
+	}
+}
+
+func orNone(v string) string {
+	if v == "" {
+		return "(none)"
+	}
+	return v
+}
+
+// captureTransport answers marketplace requests itself, keeping the GraphQL
+// queries instead of sending them
+type captureTransport struct {
+	queries []string
+}
+
+func (t *captureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	q := struct {
+		Query string `json:"query"`
+	}{}
+	if err := json.Unmarshal(body, &q); err != nil {
+		return nil, err
+	}
+	t.queries = append(t.queries, q.Query)
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(`{"data":{}}`)),
+		Request:    req,
+	}, nil
+}
+
+// dryRunMutation returns the GraphQL mutation fn makes with a provider, the
+// provider never reaches a marketplace
+func dryRunMutation(providerID string, fn func(p *bigiot.Provider) error) (string, error) {
+	t := &captureTransport{}
+	p, err := bigiot.NewProvider(providerID, "", bigiot.WithHTTPClient(&http.Client{Transport: t}))
+	if err != nil {
+		return "", err
+	}
+	if err := fn(p); err != nil {
+		return "", err
+	}
+	return strings.Join(t.queries, "\n"), nil
+}
+
+// diffDescriptions lists the fields that differ between two descriptions,
+// ignoring their activation
+func diffDescriptions(old, new *bigiot.OfferingDescription) []FieldChange {
+	oldFields := map[string]string{}
+	newFields := map[string]string{}
+	flattenDescription(old, oldFields)
+	flattenDescription(new, newFields)
+
+	names := map[string]bool{}
+	for k := range oldFields {
+		names[k] = true
+	}
+	for k := range newFields {
+		names[k] = true
+	}
+
+	changes := []FieldChange{}
+	for k := range names {
+		if oldFields[k] != newFields[k] {
+			changes = append(changes, FieldChange{Field: k, Old: oldFields[k], New: newFields[k]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// flattenDescription maps every leaf field of desc, i.e.
+// Outputs[0].Name, to its JSON encoded value
+func flattenDescription(desc *bigiot.OfferingDescription, fields map[string]string) {
+	if desc == nil {
+		return
+	}
+	d := *desc
+	d.Activation = nil
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return
+	}
+	flatten("", v, fields)
+}
+
+func flatten(prefix string, v interface{}, fields map[string]string) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			if prefix != "" {
+				k = prefix + "." + k
+			}
+			flatten(k, child, fields)
+		}
+	case []interface{}:
+		for i, child := range val {
+			flatten(fmt.Sprintf("%s[%d]", prefix, i), child, fields)
+		}
+	case nil:
+	default:
+		b, _ := json.Marshal(val)
+		fields[prefix] = string(b)
+	}
+}
+
+// descriptionBounds returns the bounding box of a registered description
+func descriptionBounds(desc *bigiot.OfferingDescription) *geocoder.Bounds {
+	if desc == nil || desc.SpatialExtent == nil || desc.SpatialExtent.BoundingBox == nil {
+		return nil
+	}
+	bb := desc.SpatialExtent.BoundingBox
+	return &geocoder.Bounds{
+		NorthEast: geocoder.Point{Lat: bb.Location1.Lat, Lng: bb.Location1.Lng},
+		SouthWest: geocoder.Point{Lat: bb.Location2.Lat, Lng: bb.Location2.Lng},
+	}
+}
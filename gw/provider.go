@@ -0,0 +1,230 @@
+package gw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/thingful/big-iot-gateway/pkg/log"
+	"github.com/thingful/big-iot-gateway/pkg/middleware"
+	"github.com/thingful/big-iot-gateway/pkg/pipes"
+	"github.com/thingful/big-iot-gateway/pkg/secret"
+	"github.com/thingful/big-iot-gateway/pkg/trace"
+	"github.com/thingful/big-iot-gateway/pkg/webhook"
+	"github.com/thingful/bigiot"
+)
+
+// DefaultProvider is the name of the profile built from the top level
+// providerID and providerSecret settings, used by offers without a Provider
+const DefaultProvider = "default"
+
+// ProviderConfig holds the credentials of a provider profile. MarketPlaceURI
+// and PipeAccessToken fall back to the top level settings when empty.
+type ProviderConfig struct {
+	ID              string
+	Secret          secret.String
+	MarketPlaceURI  string
+	PipeAccessToken secret.String
+}
+
+// loadProviders reads the providers section of the configuration, adding the
+// default profile when providerID is set
+func (c *Config) loadProviders(conf map[string]interface{}, secrets *secret.Resolver) error {
+	c.Providers = map[string]ProviderConfig{}
+
+	if c.ProviderID != "" || c.ProviderSecret != "" {
+		c.Providers[DefaultProvider] = ProviderConfig{
+			ID:     c.ProviderID,
+			Secret: c.ProviderSecret,
+		}
+	}
+
+	for name, val := range cast.ToStringMap(conf["providers"]) {
+		settings := map[string]interface{}{}
+		for k, v := range cast.ToStringMap(val) {
+			settings[strings.ToLower(k)] = v
+		}
+
+		providerSecret, err := secrets.Resolve(cast.ToString(settings["providersecret"]))
+		if err != nil {
+			return fmt.Errorf("provider %s: providerSecret: %s", name, err.Error())
+		}
+		pipeAccessToken, err := secrets.Resolve(cast.ToString(settings["pipeaccesstoken"]))
+		if err != nil {
+			return fmt.Errorf("provider %s: pipeAccessToken: %s", name, err.Error())
+		}
+
+		p := ProviderConfig{
+			ID:              cast.ToString(settings["providerid"]),
+			Secret:          providerSecret,
+			MarketPlaceURI:  cast.ToString(settings["marketplaceuri"]),
+			PipeAccessToken: pipeAccessToken,
+		}
+		if p.ID == "" || p.Secret == "" {
+			return fmt.Errorf("provider %s: providerID and providerSecret must be set", name)
+		}
+		c.Providers[name] = p
+	}
+
+	if len(c.Providers) == 0 {
+		return errors.New("providerID is not set")
+	}
+
+	for name, p := range c.Providers {
+		if p.ID == "" {
+			return fmt.Errorf("provider %s: providerID is not set", name)
+		}
+		if p.Secret == "" {
+			return fmt.Errorf("provider %s: providerSecret is not set", name)
+		}
+		if p.MarketPlaceURI == "" {
+			p.MarketPlaceURI = c.MarketPlaceURI
+		}
+		if p.PipeAccessToken == "" {
+			p.PipeAccessToken = c.PipeAccessToken
+		}
+		c.Providers[name] = p
+	}
+
+	return nil
+}
+
+// profile is a provider profile at runtime, authenticated tells whether it
+// managed to log into its marketplace. Tokens can be validated even when it
+// didn't as they only need the secret.
+type profile struct {
+	name          string
+	provider      *bigiot.Provider
+	pipeClient    *pipes.Client
+	authenticated bool
+}
+
+// newProfiles creates a provider and pipe client for every profile. A profile
+// that fails to authenticate is kept, but its offers won't be registered, so
+// a bad set of credentials doesn't stop the others.
+func newProfiles(config Config) (map[string]*profile, error) {
+	profiles := map[string]*profile{}
+	authenticated := 0
+
+	for name, pc := range config.Providers {
+		provider, err := bigiot.NewProvider(
+			pc.ID,
+			pc.Secret.Reveal(),
+			bigiot.WithMarketplace(pc.MarketPlaceURI),
+			bigiot.WithHTTPClient(&http.Client{
+				Timeout: bigiot.DefaultTimeout * time.Second,
+				Transport: trace.Transport{
+					Name:    "marketplace",
+					Proxied: middleware.RequestIDTransport{},
+				},
+			}),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		pipeClient, err := newPipeClient(config, pc.PipeAccessToken)
+		if err != nil {
+			return nil, err
+		}
+
+		p := &profile{
+			name:       name,
+			provider:   provider,
+			pipeClient: pipeClient,
+		}
+
+		if err := provider.Authenticate(); err != nil {
+			log.Log("error", err, "provider", name, "msg", "unable to authenticate provider, its offers won't be registered")
+			webhook.Fire(context.Background(), webhook.Event{
+				Type:     webhook.AuthFailed,
+				Provider: name,
+				Message:  "unable to authenticate provider with its marketplace, its offers won't be registered",
+				Error:    err.Error(),
+			})
+		} else {
+			p.authenticated = true
+			authenticated++
+		}
+
+		profiles[name] = p
+	}
+
+	if authenticated == 0 {
+		return nil, errors.New("no provider could authenticate with its marketplace")
+	}
+
+	return profiles, nil
+}
+
+// newPipeClient returns a pipe client authenticating with token and the pipe
+// settings of config, options are applied after them
+func newPipeClient(config Config, token secret.String, options ...pipes.Option) (*pipes.Client, error) {
+	return pipes.NewClient(
+		token.Reveal(),
+		append([]pipes.Option{
+			pipes.WithTimeout(config.PipeTimeoutSec * time.Second),
+			pipes.WithRetries(config.PipeRetries, pipes.DefaultRetryWait),
+			pipes.WithProxy(config.PipeProxy),
+			pipes.WithCAFile(config.PipeCAFile),
+		}, options...)...,
+	)
+}
+
+// pipeProfiles returns profiles with only a pipe client, for the commands
+// calling pipes without contacting the marketplace
+func pipeProfiles(config Config, options ...pipes.Option) (map[string]*profile, error) {
+	profiles := map[string]*profile{}
+	for name, pc := range config.Providers {
+		pipeClient, err := newPipeClient(config, pc.PipeAccessToken, options...)
+		if err != nil {
+			return nil, err
+		}
+		profiles[name] = &profile{name: name, pipeClient: pipeClient}
+	}
+	return profiles, nil
+}
+
+// offerProvider returns the profile name an offer belongs to
+func offerProvider(o Offer) string {
+	if o.Provider == "" {
+		return DefaultProvider
+	}
+	return o.Provider
+}
+
+// profileOffers returns the offers whose provider profile exists, offer ids
+// must be unique across every provider
+func profileOffers(offers []Offer, profiles map[string]*profile) ([]Offer, error) {
+	if err := checkOfferIDs(offers); err != nil {
+		return nil, err
+	}
+	valid := make([]Offer, 0, len(offers))
+	for _, o := range offers {
+		if _, ok := profiles[offerProvider(o)]; !ok {
+			log.Log("offering-id", o.ID, "provider", offerProvider(o), "error", "unknown provider, ignoring offer")
+			continue
+		}
+		valid = append(valid, o)
+	}
+	return valid, nil
+}
+
+// checkOfferIDs rejects offers sharing an id, even for different providers:
+// the registry, the state store and the /offering/:id routes are keyed by it,
+// ignoring case like the routes
+func checkOfferIDs(offers []Offer) error {
+	seen := map[string]Offer{}
+	for _, o := range offers {
+		id := strings.ToLower(o.ID)
+		if prev, ok := seen[id]; ok {
+			return fmt.Errorf("duplicate offer id %s, used by providers %s and %s", o.ID, offerProvider(prev), offerProvider(o))
+		}
+		seen[id] = o
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package gw
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProfileOffers(t *testing.T) {
+	profiles := map[string]*profile{
+		DefaultProvider: {name: DefaultProvider},
+		"barcelona":     {name: "barcelona"},
+	}
+
+	testCases := []struct {
+		name   string
+		offers []Offer
+		ids    []string
+		err    string
+	}{
+		{
+			name:   "unique ids",
+			offers: []Offer{{ID: "parking"}, {ID: "weather", Provider: "barcelona"}},
+			ids:    []string{"parking", "weather"},
+		},
+		{
+			name:   "unknown provider is dropped",
+			offers: []Offer{{ID: "parking"}, {ID: "weather", Provider: "madrid"}},
+			ids:    []string{"parking"},
+		},
+		{
+			name:   "same id for different providers",
+			offers: []Offer{{ID: "parking"}, {ID: "parking", Provider: "barcelona"}},
+			err:    "duplicate offer id parking, used by providers default and barcelona",
+		},
+		{
+			name:   "ids differing in case",
+			offers: []Offer{{ID: "parking"}, {ID: "Parking"}},
+			err:    "duplicate offer id Parking",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			offers, err := profileOffers(tc.offers, profiles)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			ids := []string{}
+			for _, o := range offers {
+				ids = append(ids, o.ID)
+			}
+			if strings.Join(ids, ",") != strings.Join(tc.ids, ",") {
+				t.Errorf("expected offers %v, got %v", tc.ids, ids)
+			}
+		})
+	}
+}
@@ -0,0 +1,372 @@
+package gw
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/breaker"
+	"github.com/thingful/big-iot-gateway/pkg/geocoder"
+	"github.com/thingful/big-iot-gateway/pkg/log"
+	"github.com/thingful/big-iot-gateway/pkg/marketplace"
+	"github.com/thingful/big-iot-gateway/pkg/middleware"
+	"github.com/thingful/big-iot-gateway/pkg/trace"
+	"github.com/thingful/big-iot-gateway/pkg/webhook"
+	"github.com/thingful/bigiot"
+)
+
+// reconcile actions, besides create and update
+const (
+	ActionActivate = "activate"
+	ActionDelete   = "delete"
+)
+
+// Operation is a marketplace mutation needed to bring the offerings of a
+// provider in line with the offers
+type Operation struct {
+	Action        string `json:"action"`
+	OfferID       string `json:"offerId"`
+	Provider      string `json:"provider"`
+	MarketplaceID string `json:"marketplaceId"`
+	Reason        string `json:"reason"`
+}
+
+// reconciler compares the offerings registered on the marketplace with the
+// offers and plans, or applies, the mutations needed
+type reconciler struct {
+	config   Config
+	offers   []Offer
+	profiles map[string]*profile
+	clients  map[string]*marketplace.Client
+	reg      *registry
+	host     string
+	geo      geocoder.Geocoder
+
+	// managed tells whether an offer may be created, updated or activated
+	managed func(o Offer) bool
+
+	// prune deletes every orphan, not only the ones recorded in the state,
+	// which may belong to other tools or gateways sharing the provider
+	prune bool
+}
+
+func newReconciler(config Config, offers []Offer, profiles map[string]*profile, reg *registry, host string, geo geocoder.Geocoder, managed func(o Offer) bool, prune bool) *reconciler {
+	return &reconciler{
+		config:   config,
+		offers:   offers,
+		profiles: profiles,
+		clients:  newMarketplaceClients(config),
+		reg:      reg,
+		host:     host,
+		geo:      geo,
+		managed:  managed,
+		prune:    prune,
+	}
+}
+
+// plan lists the operations needed for every authenticated provider. A
+// provider whose offerings can't be listed is skipped, so nothing is ever
+// deleted based on a partial view of its offerings, and the others are still
+// planned.
+func (r *reconciler) plan(ctx context.Context) []Operation {
+	names := []string{}
+	for name := range r.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ops := []Operation{}
+	for _, name := range names {
+		if !r.profiles[name].authenticated {
+			log.LogContext(ctx, "provider", name, "msg", "provider not authenticated, skipping reconciliation")
+			continue
+		}
+
+		registered, err := registeredOfferings(ctx, r.clients[name], r.config.Providers[name].ID)
+		if err != nil {
+			log.LogContext(ctx, "error", err, "provider", name, "msg", "unable to list offerings, skipping reconciliation")
+			continue
+		}
+		prefix := r.config.Providers[name].ID + "-"
+
+		desired := map[string]bool{}
+		for _, o := range r.offers {
+			if offerProvider(o) != name {
+				continue
+			}
+			desired[o.ID] = true
+			if !r.managed(o) {
+				continue
+			}
+
+			op := Operation{OfferID: o.ID, Provider: name, MarketplaceID: prefix + o.ID}
+			ro, ok := registered[o.ID]
+			if ok {
+				op.MarketplaceID = ro.ID
+			}
+
+			switch reason := r.changed(o, ro); {
+			case !ok:
+				op.Action, op.Reason = ActionCreate, "not registered on the marketplace"
+			case reason != "":
+				op.Action, op.Reason = ActionUpdate, reason
+			case !ro.Active || ro.ExpirationTime.Before(time.Now()):
+				op.Action, op.Reason = ActionActivate, "inactive on the marketplace"
+			default:
+				continue
+			}
+			ops = append(ops, op)
+		}
+
+		orphans := []Operation{}
+		for id, ro := range registered {
+			if desired[id] {
+				continue
+			}
+			if _, recorded := r.reg.get(id); !recorded && !r.prune {
+				log.Debug(ctx, "offering-id", id, "provider", name, "msg", "orphan not registered by this gateway, left alone without prune")
+				continue
+			}
+			orphans = append(orphans, Operation{
+				Action:        ActionDelete,
+				OfferID:       id,
+				Provider:      name,
+				MarketplaceID: ro.ID,
+				Reason:        "not in the offers",
+			})
+		}
+		sort.Slice(orphans, func(i, j int) bool { return orphans[i].OfferID < orphans[j].OfferID })
+		ops = append(ops, orphans...)
+	}
+
+	return ops
+}
+
+// newMarketplaceClients returns a marketplace client per provider
+func newMarketplaceClients(config Config) map[string]*marketplace.Client {
+	clients := map[string]*marketplace.Client{}
+	for name, pc := range config.Providers {
+		clients[name] = marketplace.NewClient(pc.MarketPlaceURI, pc.ID, pc.Secret.Reveal(), &http.Client{
+			Timeout: bigiot.DefaultTimeout * time.Second,
+			Transport: trace.Transport{
+				Name:    "marketplace",
+				Proxied: middleware.RequestIDTransport{},
+			},
+		})
+	}
+	return clients
+}
+
+// registeredOfferings lists the offerings a provider has on the marketplace,
+// indexed by offer id
+func registeredOfferings(ctx context.Context, client *marketplace.Client, providerID string) (map[string]marketplace.RemoteOffering, error) {
+	remote, err := client.Offerings(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// marketplace ids are the provider id followed by the offer id
+	prefix := providerID + "-"
+	registered := map[string]marketplace.RemoteOffering{}
+	for _, ro := range remote {
+		registered[strings.TrimPrefix(ro.ID, prefix)] = ro
+	}
+	return registered, nil
+}
+
+// changed returns why an offer needs to be registered again, or an empty
+// string if it doesn't
+func (r *reconciler) changed(o Offer, ro marketplace.RemoteOffering) string {
+	if ro.Name != o.Name {
+		return "name changed"
+	}
+
+	last, ok := r.reg.registration(o.ID)
+	if !ok {
+		return ""
+	}
+	if o.ExtentFromData && o.BoundingBox == nil {
+		if b, ok := r.reg.bounds(o.ID); ok {
+			o.BoundingBox = b
+		} else {
+			o.BoundingBox = descriptionBounds(last.Description)
+		}
+	}
+	desc := makeOfferingInput(o, r.host, r.config.OfferingActiveLengthSec, r.geo)
+	if fields := diffDescriptions(last.Description, desc); len(fields) > 0 {
+		return "description changed: " + fields[0].Field
+	}
+	return ""
+}
+
+// apply runs every operation, carrying on when one fails
+func (r *reconciler) apply(ctx context.Context, ops []Operation) error {
+	offers := map[string]Offer{}
+	for _, o := range r.offers {
+		offers[o.ID] = o
+	}
+
+	failed := 0
+	for _, op := range ops {
+		provider := r.profiles[op.Provider].provider
+
+		var err error
+		switch op.Action {
+		case ActionCreate, ActionUpdate:
+			err = registerOffering(ctx, provider, r.reg, offers[op.OfferID], r.host, r.config.OfferingActiveLengthSec, r.geo)
+		case ActionActivate:
+			_, err = provider.ActivateOffering(ctx, &bigiot.ActivateOffering{
+				ID:       op.MarketplaceID,
+				Duration: r.config.OfferingActiveLengthSec * time.Second,
+			})
+		case ActionDelete:
+			err = provider.DeleteOffering(ctx, &bigiot.DeleteOffering{ID: op.MarketplaceID})
+			if err == nil {
+				r.reg.remove(op.OfferID)
+			}
+		}
+		if err == nil {
+			fireOperation(ctx, op)
+		}
+
+		if err != nil {
+			failed++
+			log.LogContext(ctx, "error", err, "action", op.Action, "offering-id", op.OfferID, "provider", op.Provider)
+			continue
+		}
+		log.LogContext(ctx, "action", op.Action, "offering-id", op.OfferID, "provider", op.Provider, "reason", op.Reason, "msg", "reconciled offering")
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d reconcile operations failed", failed, len(ops))
+	}
+	return nil
+}
+
+// reconcileLoop reconciles the marketplace every interval, starting right
+// away to clean up after a crash. Only the leader reconciles.
+func reconcileLoop(r *reconciler, interval time.Duration, leader *elector) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if leader.leading() {
+			ctx := log.WithRequestID(context.Background(), log.NewRequestID())
+			if err := r.apply(ctx, r.plan(ctx)); err != nil {
+				log.LogContext(ctx, "error", err)
+			}
+		}
+
+		<-ticker.C
+	}
+}
+
+// managedOffer returns whether the running gateway may reconcile an offer:
+// it must be registered by the offering checks, its pipe healthy, its schema
+// not drifting and its data fresh, so the loop doesn't undo a deletion or
+// deactivation made on purpose
+func managedOffer(reg *registry, breakers pipeBreakers, drift *driftDetector, fresh *freshness) func(o Offer) bool {
+	return func(o Offer) bool {
+		if _, ok := reg.get(o.ID); !ok {
+			return false
+		}
+		if drift.deactivated(o.ID) || fresh.stale(o.ID) {
+			return false
+		}
+		return breakers[o.PipeURL].State() == breaker.Closed
+	}
+}
+
+// Reconcile compares the offerings registered on the marketplace by every
+// provider with the offers and writes the operations needed to w, as a diff
+// or json. With apply the operations are run as well. Orphans are only
+// deleted when recorded in the state file, or with prune.
+func Reconcile(config Config, offers []Offer, apply, prune bool, w io.Writer, format string) error {
+	if format != "diff" && format != "json" {
+		return fmt.Errorf("unknown reconcile format %s", format)
+	}
+
+	profiles, err := newProfiles(config)
+	if err != nil {
+		return err
+	}
+	offers, err = profileOffers(offers, profiles)
+	if err != nil {
+		return err
+	}
+	addCommonOutputToOfferings(offers)
+
+	offeringEndpoint, err := url.Parse(config.OfferingEndPoint)
+	if err != nil {
+		return err
+	}
+
+	geo, err := newGeocoder(config, nil)
+	if err != nil {
+		return err
+	}
+
+	// the state file may belong to a running gateway, it's only read
+	reg, err := readRegistry(config)
+	if err != nil {
+		return err
+	}
+
+	r := newReconciler(config, offers, profiles, reg, offeringEndpoint.String(), geo, func(Offer) bool { return true }, prune)
+
+	ctx := log.WithRequestID(context.Background(), log.NewRequestID())
+	ops := r.plan(ctx)
+
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(ops); err != nil {
+			return err
+		}
+	} else {
+		counts := map[string]int{}
+		for _, op := range ops {
+			counts[op.Action]++
+			fmt.Fprintf(w, "%s %-8s %s (provider %s): %s\n", actionSymbols[op.Action], op.Action, op.MarketplaceID, op.Provider, op.Reason)
+		}
+		fmt.Fprintf(w, "\nReconcile: %d to create, %d to update, %d to activate, %d to delete.\n",
+			counts[ActionCreate], counts[ActionUpdate], counts[ActionActivate], counts[ActionDelete])
+	}
+
+	if !apply || len(ops) == 0 {
+		return nil
+	}
+	return r.apply(ctx, ops)
+}
+
+var actionSymbols = map[string]string{
+	ActionCreate:   "+",
+	ActionUpdate:   "~",
+	ActionActivate: ">",
+	ActionDelete:   "-",
+}
+
+// fireOperation sends a webhook event for the operations changing whether an
+// offering is advertised, registrations send their own
+func fireOperation(ctx context.Context, op Operation) {
+	e := webhook.Event{
+		OfferingID: op.OfferID,
+		Provider:   op.Provider,
+		Message:    "reconciled offering, " + op.Reason,
+	}
+	switch op.Action {
+	case ActionActivate:
+		e.Type = webhook.OfferingActivated
+	case ActionDelete:
+		e.Type = webhook.OfferingDeleted
+	default:
+		return
+	}
+	webhook.Fire(ctx, e)
+}
@@ -0,0 +1,103 @@
+package gw
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/marketplace"
+	"github.com/thingful/big-iot-gateway/pkg/secret"
+	"github.com/thingful/big-iot-gateway/pkg/store"
+	"github.com/thingful/bigiot"
+)
+
+func TestReconcilePlan(t *testing.T) {
+	providerSecret := base64.StdEncoding.EncodeToString([]byte("supersecretkey-0123456789abcdef!"))
+
+	emulator := marketplace.NewEmulator()
+	srv := httptest.NewServer(emulator)
+	defer srv.Close()
+
+	// a marketplace that can't list offerings
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/accessToken" {
+			w.Write([]byte("token"))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	provider, err := bigiot.NewProvider("Org-A", providerSecret, bigiot.WithMarketplace(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, localID := range []string{"kept", "recorded", "foreign"} {
+		_, err := provider.RegisterOffering(context.Background(), &bigiot.OfferingDescription{
+			LocalID:    localID,
+			Name:       localID,
+			Activation: &bigiot.Activation{Status: true, Duration: time.Hour},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := NewConfig()
+	config.Providers = map[string]ProviderConfig{
+		DefaultProvider: {ID: "Org-A", Secret: secret.String(providerSecret), MarketPlaceURI: srv.URL},
+		"broken":        {ID: "Org-B", Secret: secret.String(providerSecret), MarketPlaceURI: broken.URL},
+	}
+	profiles := map[string]*profile{
+		DefaultProvider: {name: DefaultProvider, authenticated: true},
+		"broken":        {name: "broken", authenticated: true},
+	}
+	offers := []Offer{
+		{ID: "kept", Name: "kept"},
+		{ID: "new", Name: "new"},
+		{ID: "elsewhere", Name: "elsewhere", Provider: "broken"},
+	}
+
+	testCases := []struct {
+		name     string
+		prune    bool
+		expected []string
+	}{
+		{
+			name:     "recorded orphans only",
+			expected: []string{"create Org-A-new", "delete Org-A-recorded"},
+		},
+		{
+			name:     "prune",
+			prune:    true,
+			expected: []string{"create Org-A-new", "delete Org-A-foreign", "delete Org-A-recorded"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			st, _ := store.Open("")
+			reg := newRegistry(st)
+			reg.set(Offer{ID: "recorded"}, "Org-A-recorded", &bigiot.OfferingDescription{})
+
+			r := newReconciler(config, offers, profiles, reg, "http://localhost", nil, func(Offer) bool { return true }, tc.prune)
+
+			got := []string{}
+			for _, op := range r.plan(context.Background()) {
+				got = append(got, op.Action+" "+op.MarketplaceID)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
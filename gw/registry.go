@@ -0,0 +1,264 @@
+package gw
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/geocoder"
+	"github.com/thingful/big-iot-gateway/pkg/log"
+	"github.com/thingful/big-iot-gateway/pkg/store"
+	"github.com/thingful/bigiot"
+)
+
+// registration is what the gateway last registered on the marketplace for
+// an offer
+type registration struct {
+	MarketplaceID string                      `json:"marketplaceId"`
+	Provider      string                      `json:"provider"`
+	Description   *bigiot.OfferingDescription `json:"description"`
+	RegisteredAt  time.Time                   `json:"registeredAt"`
+	ActiveUntil   time.Time                   `json:"activeUntil"`
+	Deactivated   bool                        `json:"deactivated,omitempty"`
+}
+
+// checkResult is the outcome of the last offering check of an offer
+type checkResult struct {
+	Checked time.Time `json:"checked"`
+	Records int       `json:"records"`
+	Result  string    `json:"result"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// registry buckets in the state store
+const (
+	registrationsBucket = "registrations"
+	extentsBucket       = "extents"
+	checksBucket        = "checks"
+)
+
+// registry keeps the marketplace ids of the offerings registered by the
+// gateway, the extents derived from their data and the result of their last
+// check, indexed by offer ID. Everything is kept in the state store, which
+// plan and reconcile read to compare against.
+type registry struct {
+	st *store.Store
+
+	mu            sync.RWMutex
+	registrations map[string]registration
+	extents       map[string]*geocoder.Bounds
+	checks        map[string]checkResult
+}
+
+func newRegistry(st *store.Store) *registry {
+	return &registry{
+		st:            st,
+		registrations: map[string]registration{},
+		extents:       map[string]*geocoder.Bounds{},
+		checks:        map[string]checkResult{},
+	}
+}
+
+// set stores the marketplace id of an offer and the description registered
+func (r *registry) set(o Offer, id string, desc *bigiot.OfferingDescription) {
+	// the activation changes on every registration, only its expiry is kept
+	d := *desc
+	d.Activation = nil
+
+	reg := registration{
+		MarketplaceID: id,
+		Provider:      offerProvider(o),
+		Description:   &d,
+		RegisteredAt:  time.Now().UTC(),
+	}
+	if desc.Activation != nil {
+		reg.ActiveUntil = desc.Activation.ExpirationTime.UTC()
+	}
+
+	r.mu.Lock()
+	r.registrations[o.ID] = reg
+	r.persist(registrationsBucket, o.ID, reg)
+	r.mu.Unlock()
+}
+
+// get returns the marketplace id of an offer
+func (r *registry) get(offerID string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	reg, ok := r.registrations[offerID]
+	return reg.MarketplaceID, ok
+}
+
+// remove forgets an offer
+func (r *registry) remove(offerID string) {
+	r.mu.Lock()
+	delete(r.registrations, offerID)
+	r.persist(registrationsBucket, offerID, nil)
+	r.mu.Unlock()
+}
+
+// markInactive records that a registered offer was deactivated, until it's
+// registered again
+func (r *registry) markInactive(offerID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg, ok := r.registrations[offerID]
+	if !ok {
+		return
+	}
+	reg.Deactivated = true
+	reg.ActiveUntil = time.Now().UTC()
+	r.registrations[offerID] = reg
+	r.persist(registrationsBucket, offerID, reg)
+}
+
+// inactive tells whether a registered offer is deactivated
+func (r *registry) inactive(offerID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.registrations[offerID].Deactivated
+}
+
+// registration returns what was last registered for an offer
+func (r *registry) registration(offerID string) (registration, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	reg, ok := r.registrations[offerID]
+	return reg, ok
+}
+
+// setBounds stores the extent derived from an offer's data
+func (r *registry) setBounds(offerID string, b *geocoder.Bounds) {
+	r.mu.Lock()
+	r.extents[offerID] = b
+	r.persist(extentsBucket, offerID, b)
+	r.mu.Unlock()
+}
+
+// bounds returns the extent derived from an offer's data
+func (r *registry) bounds(offerID string) (*geocoder.Bounds, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	b, ok := r.extents[offerID]
+	return b, ok
+}
+
+// setCheck stores the result of an offering check, it's written to disk with
+// the next sync of the state store
+func (r *registry) setCheck(offerID string, c checkResult) {
+	c.Checked = time.Now().UTC()
+	r.mu.Lock()
+	r.checks[offerID] = c
+	if err := r.st.Stage(checksBucket, offerID, c); err != nil {
+		log.Log("error", err, "offering-id", offerID, "msg", "unable to keep check result")
+	}
+	r.mu.Unlock()
+}
+
+// check returns the result of the last check of an offer
+func (r *registry) check(offerID string) (checkResult, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.checks[offerID]
+	return c, ok
+}
+
+// restore reads what a previous run left in the state store
+func (r *registry) restore() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, id := range r.st.Keys(registrationsBucket) {
+		reg := registration{}
+		if _, err := r.st.Get(registrationsBucket, id, &reg); err != nil {
+			return err
+		}
+		r.registrations[id] = reg
+	}
+	for _, id := range r.st.Keys(extentsBucket) {
+		b := &geocoder.Bounds{}
+		if _, err := r.st.Get(extentsBucket, id, b); err != nil {
+			return err
+		}
+		r.extents[id] = b
+	}
+	for _, id := range r.st.Keys(checksBucket) {
+		c := checkResult{}
+		if _, err := r.st.Get(checksBucket, id, &c); err != nil {
+			return err
+		}
+		r.checks[id] = c
+	}
+	return nil
+}
+
+// offerIDs returns the offers with a registration
+func (r *registry) offerIDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make([]string, 0, len(r.registrations))
+	for id := range r.registrations {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// persist writes v to the state store, deleting the key when v is nil. It
+// must be called with the lock held.
+func (r *registry) persist(bucket, offerID string, v interface{}) {
+	var err error
+	if v == nil {
+		err = r.st.Delete(bucket, offerID)
+	} else {
+		err = r.st.Put(bucket, offerID, v)
+	}
+	if err != nil {
+		log.Log("error", err, "offering-id", offerID, "msg", "unable to save gateway state")
+	}
+}
+
+// importRegistrations copies the registrations kept in file by earlier
+// versions into the state store, unless it already has registrations
+func importRegistrations(file string, st *store.Store) (int, error) {
+	if file == "" || len(st.Keys(registrationsBucket)) > 0 {
+		return 0, nil
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	registrations := map[string]registration{}
+	if err := json.Unmarshal(b, &registrations); err != nil {
+		return 0, err
+	}
+	for id, reg := range registrations {
+		if err := st.Put(registrationsBucket, id, reg); err != nil {
+			return 0, err
+		}
+	}
+	return len(registrations), nil
+}
+
+// readRegistry reads the registry kept in the state file of a gateway that
+// may be running, with the registrations of RegisteredFile when it has none
+func readRegistry(config Config) (*registry, error) {
+	st, err := store.Read(config.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := importRegistrations(config.RegisteredFile, st); err != nil {
+		return nil, err
+	}
+
+	reg := newRegistry(st)
+	return reg, reg.restore()
+}
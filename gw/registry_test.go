@@ -0,0 +1,89 @@
+package gw
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thingful/big-iot-gateway/pkg/store"
+)
+
+func TestImportRegistrations(t *testing.T) {
+	legacy := `{"t1":{"marketplaceId":"Org-Prov-t1","provider":"default"},"t2":{"marketplaceId":"Org-Prov-t2","provider":"default"}}`
+
+	testCases := []struct {
+		name     string
+		file     string
+		existing []string
+		imported int
+		ids      []string
+	}{
+		{
+			name:     "into an empty state",
+			file:     legacy,
+			imported: 2,
+			ids:      []string{"t1", "t2"},
+		},
+		{
+			name:     "state with registrations is kept",
+			file:     legacy,
+			existing: []string{"t3"},
+			ids:      []string{"t3"},
+		},
+		{
+			name: "missing file",
+			ids:  []string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "registry")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			file := filepath.Join(dir, "registered.json")
+			if tc.file != "" {
+				ioutil.WriteFile(file, []byte(tc.file), 0644)
+			}
+			config := Config{StateFile: filepath.Join(dir, "state.json"), RegisteredFile: file}
+
+			st, err := store.Open(config.StateFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range tc.existing {
+				st.Put(registrationsBucket, id, registration{MarketplaceID: "Org-Prov-" + id})
+			}
+
+			imported, err := importRegistrations(file, st)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if imported != tc.imported {
+				t.Errorf("expected %d imported, got %d", tc.imported, imported)
+			}
+
+			// plan and reconcile read what the gateway keeps
+			reg, err := readRegistry(Config{StateFile: config.StateFile})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := reg.offerIDs()
+			if len(ids) != len(tc.ids) {
+				t.Fatalf("expected %v, got %v", tc.ids, ids)
+			}
+			for i, id := range ids {
+				if id != tc.ids[i] {
+					t.Errorf("expected %v, got %v", tc.ids, ids)
+				}
+				if mpID, _ := reg.get(id); mpID != "Org-Prov-"+id {
+					t.Errorf("expected marketplace id Org-Prov-%s, got %s", id, mpID)
+				}
+			}
+		})
+	}
+}
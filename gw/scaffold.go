@@ -0,0 +1,362 @@
+package gw
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ScaffoldOptions describes the offer to scaffold, everything but PipeURL is
+// optional
+type ScaffoldOptions struct {
+	PipeURL  string
+	ID       string
+	Name     string
+	City     string
+	Provider string
+	RootPath string // detected from the response when empty
+	Limit    int    // records requested from the pipe
+}
+
+// Field is what was inferred about a field of the sampled records, Seen
+// counts the records where it isn't null. Nested fields have a dotted Term and
+// can't be used as PipeTerm.
+type Field struct {
+	Term    string   `json:"term"`
+	Type    string   `json:"type"`
+	Seen    int      `json:"seen"`
+	Min     *float64 `json:"min,omitempty"`
+	Max     *float64 `json:"max,omitempty"`
+	Example string   `json:"example,omitempty"`
+	Nested  bool     `json:"nested,omitempty"`
+	Common  bool     `json:"common,omitempty"`
+	Output  *Output  `json:"output,omitempty"`
+	Matched bool     `json:"matched,omitempty"`
+}
+
+// Scaffold is an offer built from a sample of its pipe and the fields found
+type Scaffold struct {
+	Offer   Offer
+	Records int
+	Fields  []Field
+}
+
+// ScaffoldOffer samples a pipe and builds an offer for it. Outputs are
+// suggested from the vocabulary for the top level fields of the records,
+// leaving out the ones every offer already has.
+func ScaffoldOffer(config Config, opts ScaffoldOptions) (*Scaffold, error) {
+	provider := opts.Provider
+	if provider == "" {
+		provider = DefaultProvider
+	}
+	pc, ok := config.Providers[provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %s", provider)
+	}
+
+	client, err := newPipeClient(config, pc.PipeAccessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(opts.PipeURL)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Limit > 0 {
+		q := u.Query()
+		q.Set("limit", fmt.Sprint(opts.Limit))
+		u.RawQuery = q.Encode()
+	}
+
+	body, err := client.Get(context.Background(), u.String(), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	rootPath := opts.RootPath
+	if rootPath == "" {
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return nil, err
+		}
+		if rootPath, ok = findRecords(doc, ""); !ok {
+			return nil, fmt.Errorf("no array of records found in the response of %s", opts.PipeURL)
+		}
+	}
+	records, err := pipeRecords(body, rootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := inferFields(records)
+
+	common := map[string]bool{}
+	for _, o := range commonOutputs {
+		common[strings.Split(o.PipeTerm, ".")[0]] = true
+	}
+
+	id := opts.ID
+	if id == "" {
+		id = strings.ToLower(normalizeID(path.Base(u.Path)))
+	}
+	name := opts.Name
+	if name == "" {
+		name = id
+	}
+
+	o := Offer{
+		ID:       id,
+		Name:     name,
+		City:     opts.City,
+		PipeURL:  opts.PipeURL,
+		RootPath: rootPath,
+		Outputs:  []Output{},
+	}
+	if provider != DefaultProvider {
+		o.Provider = provider
+	}
+
+	categories := map[string]int{}
+	for i, f := range fields {
+		root := strings.Split(f.Term, ".")[0]
+		if common[root] {
+			fields[i].Common = true
+			continue
+		}
+		if f.Nested || f.Type == "object" || f.Type == "array" || f.Type == "null" {
+			continue
+		}
+
+		out := Output{
+			BigiotName: camelCase(f.Term),
+			BigiotRDF:  "proposed:" + camelCase(f.Term),
+			PipeTerm:   f.Term,
+		}
+		if t, ok := suggestTerm(f.Term); ok {
+			out.BigiotName, out.BigiotRDF = t.name, t.rdf
+			fields[i].Matched = true
+			if t.category != "" {
+				categories[t.category]++
+			}
+		}
+		fields[i].Output = &out
+		o.Outputs = append(o.Outputs, out)
+	}
+
+	// the category most outputs belong to
+	best := 0
+	for c, n := range categories {
+		if n > best || (n == best && c < o.Category) {
+			o.Category, best = c, n
+		}
+	}
+
+	return &Scaffold{Offer: o, Records: len(records), Fields: fields}, nil
+}
+
+// findRecords returns the dot separated path of the first array of objects
+// in doc, looking at the keys of an object in order
+func findRecords(doc interface{}, prefix string) (string, bool) {
+	switch v := doc.(type) {
+	case []interface{}:
+		for _, m := range v {
+			if _, ok := m.(map[string]interface{}); ok {
+				return prefix, true
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := k
+			if prefix != "" {
+				p = prefix + "." + k
+			}
+			if found, ok := findRecords(v[k], p); ok {
+				return found, true
+			}
+		}
+	}
+	return "", false
+}
+
+// inferFields walks every object record, nested objects included, and
+// returns the fields sorted by term
+func inferFields(records []interface{}) []Field {
+	fields := map[string]*Field{}
+	for _, r := range records {
+		if obj, ok := r.(map[string]interface{}); ok {
+			observeObject(fields, obj, "")
+		}
+	}
+
+	out := make([]Field, 0, len(fields))
+	for _, f := range fields {
+		out = append(out, *f)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Term < out[j].Term })
+	return out
+}
+
+func observeObject(fields map[string]*Field, obj map[string]interface{}, prefix string) {
+	for k, v := range obj {
+		t := k
+		if prefix != "" {
+			t = prefix + "." + k
+		}
+
+		f, ok := fields[t]
+		if !ok {
+			f = &Field{Term: t, Nested: prefix != ""}
+			fields[t] = f
+		}
+		if v != nil {
+			f.Seen++
+		}
+		f.Type = mergeType(f.Type, valueType(v))
+
+		switch val := v.(type) {
+		case map[string]interface{}:
+			observeObject(fields, val, t)
+		case float64:
+			if f.Min == nil || val < *f.Min {
+				min := val
+				f.Min = &min
+			}
+			if f.Max == nil || val > *f.Max {
+				max := val
+				f.Max = &max
+			}
+		case string, bool:
+			if f.Example == "" {
+				f.Example = fmt.Sprint(val)
+			}
+		}
+	}
+}
+
+// valueType returns the json type of a value, telling integers and
+// timestamps apart
+func valueType(v interface{}) string {
+	switch val := v.(type) {
+	case float64:
+		if val == math.Trunc(val) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		if _, err := time.Parse(time.RFC3339, val); err == nil {
+			return "datetime"
+		}
+		return "string"
+	case bool:
+		return "boolean"
+	default:
+		return jsonType(v)
+	}
+}
+
+// mergeType combines the type seen so far with a new one, null doesn't
+// change a type and integers widen to numbers
+func mergeType(seen, t string) string {
+	switch {
+	case seen == "" || seen == "null":
+		return t
+	case t == "null" || t == seen:
+		return seen
+	case (seen == "integer" && t == "number") || (seen == "number" && t == "integer"):
+		return "number"
+	case (seen == "datetime" && t == "string") || (seen == "string" && t == "datetime"):
+		return "string"
+	default:
+		return "mixed"
+	}
+}
+
+// normalizeID turns s into an offer id, i.e. letters, digits and underscores
+func normalizeID(s string) string {
+	id := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, s)
+	id = strings.Trim(id, "_")
+	if id == "" {
+		return "new_offer"
+	}
+	return id
+}
+
+// scaffoldEntry is an offer as written in the offers file, the fields to
+// fill in are always present
+type scaffoldEntry struct {
+	ID          string           `json:"ID" yaml:"ID"`
+	Name        string           `json:"Name" yaml:"Name"`
+	Provider    string           `json:"Provider,omitempty" yaml:"Provider,omitempty"`
+	City        string           `json:"City" yaml:"City"`
+	PipeURL     string           `json:"PipeURL" yaml:"PipeURL"`
+	RootPath    string           `json:"RootPath,omitempty" yaml:"RootPath,omitempty"`
+	Category    string           `json:"Category" yaml:"Category"`
+	Datalicense string           `json:"Datalicense" yaml:"Datalicense"`
+	Price       float64          `json:"Price" yaml:"Price"`
+	Outputs     []scaffoldOutput `json:"Outputs" yaml:"Outputs"`
+}
+
+type scaffoldOutput struct {
+	BigiotName string `json:"BigiotName" yaml:"BigiotName"`
+	BigiotRDF  string `json:"BigiotRDF" yaml:"BigiotRDF"`
+	PipeTerm   string `json:"PipeTerm" yaml:"PipeTerm"`
+}
+
+// WriteScaffold writes the scaffolded offer as an entry of the offers file in
+// json or yaml
+func WriteScaffold(w io.Writer, s *Scaffold, format string) error {
+	entry := scaffoldEntry{
+		ID:          s.Offer.ID,
+		Name:        s.Offer.Name,
+		Provider:    s.Offer.Provider,
+		City:        s.Offer.City,
+		PipeURL:     s.Offer.PipeURL,
+		RootPath:    s.Offer.RootPath,
+		Category:    s.Offer.Category,
+		Datalicense: s.Offer.Datalicense,
+		Price:       s.Offer.Price,
+		Outputs:     []scaffoldOutput{},
+	}
+	for _, o := range s.Offer.Outputs {
+		entry.Outputs = append(entry.Outputs, scaffoldOutput(o))
+	}
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entry)
+
+	case "yaml":
+		// a list item, so it can be pasted under offers
+		b, err := yaml.Marshal([]scaffoldEntry{entry})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+
+	default:
+		return fmt.Errorf("unknown scaffold format %s", format)
+	}
+}
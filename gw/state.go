@@ -0,0 +1,75 @@
+package gw
+
+import (
+	"context"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/log"
+	"github.com/thingful/big-iot-gateway/pkg/store"
+	"github.com/thingful/big-iot-gateway/pkg/webhook"
+	"github.com/thingful/bigiot"
+)
+
+// stateSyncInterval is how often the values staged in the state store, like
+// usage counters and check results, are written to disk
+const stateSyncInterval = 10 * time.Second
+
+// recoverState restores what a previous run left in the state store. A clean
+// shutdown deletes every offering, so registrations found there were left by
+// a crash: the ones of offers that are gone are deleted from the
+// marketplace, the others are kept so the offering checks carry on with them.
+func recoverState(ctx context.Context, offers []Offer, profiles map[string]*profile, reg *registry, drift *driftDetector, fresh *freshness) error {
+	if err := reg.restore(); err != nil {
+		return err
+	}
+
+	desired := map[string]Offer{}
+	for _, o := range offers {
+		desired[o.ID] = o
+		if err := drift.restore(o); err != nil {
+			return err
+		}
+		if err := fresh.restore(o); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range reg.offerIDs() {
+		last, _ := reg.registration(id)
+		if o, ok := desired[id]; ok && offerProvider(o) == last.Provider {
+			log.LogContext(ctx, "offering-id", id, "marketplaceId", last.MarketplaceID, "deactivated", last.Deactivated, "msg", "recovered offering registered by a previous run")
+			continue
+		}
+
+		p, ok := profiles[last.Provider]
+		if !ok || !p.authenticated {
+			log.LogContext(ctx, "offering-id", id, "provider", last.Provider, "msg", "provider unavailable, unable to delete offering left by a previous run")
+			continue
+		}
+		if err := p.provider.DeleteOffering(ctx, &bigiot.DeleteOffering{ID: last.MarketplaceID}); err != nil {
+			log.LogContext(ctx, "error", err, "offering-id", id, "msg", "unable to delete offering left by a previous run")
+			continue
+		}
+		reg.remove(id)
+		log.LogContext(ctx, "offering-id", id, "marketplaceId", last.MarketplaceID, "msg", "deleted offering left by a previous run")
+		webhook.Fire(ctx, webhook.Event{
+			Type:       webhook.OfferingDeleted,
+			OfferingID: id,
+			Provider:   last.Provider,
+			Message:    "offering left by a previous run isn't in the offers anymore, deleted",
+		})
+	}
+	return nil
+}
+
+// syncLoop writes the values staged in the state store every interval
+func syncLoop(st *store.Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := st.Sync(); err != nil {
+			log.Log("error", err, "msg", "unable to save gateway state")
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package gw
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/breaker"
+	"github.com/thingful/big-iot-gateway/pkg/log"
+	"github.com/thingful/big-iot-gateway/pkg/pipes"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// streamBuffer is how many batches a subscriber can fall behind before
+	// it's disconnected
+	streamBuffer = 16
+
+	// streamKeepAlive is how often an idle SSE stream gets a comment, so
+	// proxies don't close it
+	streamKeepAlive = 15 * time.Second
+)
+
+// streamBatch is what stream subscribers receive: every record of the offer
+// when they subscribe, then the records that are new or changed since the
+// previous poll of the pipe
+type streamBatch struct {
+	Seq     uint64            `json:"seq"`
+	Records []json.RawMessage `json:"records"`
+}
+
+// streamHub shares a poller per pipe among the subscribers to the streams of
+// the offers using it, pipes are only polled while someone is subscribed
+type streamHub struct {
+	interval time.Duration
+	clients  map[string]*pipes.Client
+	breakers pipeBreakers
+
+	mu      sync.Mutex
+	closed  bool
+	pollers map[string]*pipePoller
+}
+
+// pipePoller polls a pipe for the offers using it with the same client, the
+// one of their provider unless they have their own credentials
+type pipePoller struct {
+	key     string
+	pipeURL string
+	client  *pipes.Client
+	breaker *breaker.Breaker
+	timeout time.Duration
+	stop    chan struct{}
+
+	// guarded by the hub lock
+	offers map[string]*offerStream
+}
+
+// offerStream is the stream of an offer, seen holds the records of the last
+// poll to tell the ones that changed
+type offerStream struct {
+	offer   Offer
+	seq     uint64
+	seen    map[string]bool
+	current []json.RawMessage
+	subs    map[chan streamBatch]bool
+}
+
+func newStreamHub(interval time.Duration, clients map[string]*pipes.Client, breakers pipeBreakers) *streamHub {
+	return &streamHub{
+		interval: interval,
+		clients:  clients,
+		breakers: breakers,
+		pollers:  map[string]*pipePoller{},
+	}
+}
+
+// subscribe returns a channel receiving the batches of an offer, closed when
+// the subscriber falls too far behind, and the func to unsubscribe
+func (h *streamHub) subscribe(o Offer) (<-chan streamBatch, func()) {
+	ch := make(chan streamBatch, streamBuffer)
+	client := h.clients[o.ID]
+	key := fmt.Sprintf("%p %s", client, o.PipeURL)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	p, ok := h.pollers[key]
+	if !ok {
+		p = &pipePoller{
+			key:     key,
+			pipeURL: o.PipeURL,
+			client:  client,
+			breaker: h.breakers[o.PipeURL],
+			timeout: offerTimeout(o),
+			stop:    make(chan struct{}),
+			offers:  map[string]*offerStream{},
+		}
+		h.pollers[key] = p
+		go h.run(p)
+	}
+
+	s, ok := p.offers[o.ID]
+	if !ok {
+		s = &offerStream{offer: o, subs: map[chan streamBatch]bool{}}
+		p.offers[o.ID] = s
+	}
+	s.subs[ch] = true
+	if s.current != nil {
+		ch <- streamBatch{Seq: s.seq, Records: s.current}
+	}
+
+	return ch, func() { h.unsubscribe(p, s, ch) }
+}
+
+// unsubscribe removes a subscriber, stopping the poller of the pipe when it
+// was the last one
+func (h *streamHub) unsubscribe(p *pipePoller, s *offerStream, ch chan streamBatch) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if s.subs[ch] {
+		delete(s.subs, ch)
+		close(ch)
+	}
+	for _, s := range p.offers {
+		if len(s.subs) > 0 {
+			return
+		}
+	}
+	if h.pollers[p.key] == p {
+		delete(h.pollers, p.key)
+		close(p.stop)
+	}
+}
+
+// close ends every stream and stops the pollers, so the server can shut down
+// without waiting for the subscribers to leave
+func (h *streamHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for key, p := range h.pollers {
+		for _, s := range p.offers {
+			for ch := range s.subs {
+				delete(s.subs, ch)
+				close(ch)
+			}
+		}
+		delete(h.pollers, key)
+		close(p.stop)
+	}
+}
+
+// run polls the pipe every interval, starting right away
+func (h *streamHub) run(p *pipePoller) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		h.poll(p)
+
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// poll calls the pipe once and sends every offer's subscribers its new or
+// changed records
+func (h *streamHub) poll(p *pipePoller) {
+	if _, ok := p.breaker.Allow(); !ok {
+		return
+	}
+
+	ctx := log.WithRequestID(context.Background(), log.NewRequestID())
+	body, err := p.client.Get(ctx, p.pipeURL, p.timeout)
+	record(ctx, p.breaker, err)
+	if err != nil {
+		log.LogContext(ctx, "error", err, "pipe", p.pipeURL, "msg", "unable to poll pipe for streams")
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, s := range p.offers {
+		if len(s.subs) == 0 {
+			continue
+		}
+		changed, err := s.update(body)
+		if err != nil {
+			log.LogContext(ctx, "error", err, "offering-id", s.offer.ID, "msg", "unable to convert pipe records for stream")
+			continue
+		}
+		if len(changed) == 0 {
+			continue
+		}
+
+		s.seq++
+		batch := streamBatch{Seq: s.seq, Records: changed}
+		for ch := range s.subs {
+			select {
+			case ch <- batch:
+			default:
+				log.Warn(ctx, "offering-id", s.offer.ID, "msg", "stream subscriber too slow, disconnecting it")
+				delete(s.subs, ch)
+				close(ch)
+			}
+		}
+	}
+}
+
+// update converts a pipe response for the offer and returns the records that
+// weren't in the previous one
+func (s *offerStream) update(body []byte) ([]json.RawMessage, error) {
+	records, err := ConvertRecords(body, s.offer)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(records))
+	current := make([]json.RawMessage, 0, len(records))
+	changed := []json.RawMessage{}
+	for _, r := range records {
+		// maps are encoded with sorted keys, equal records encode the same
+		b, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		seen[string(b)] = true
+		current = append(current, b)
+		if !s.seen[string(b)] {
+			changed = append(changed, b)
+		}
+	}
+
+	s.seen = seen
+	s.current = current
+	return changed, nil
+}
+
+// serveSSE streams the batches of an offer as server-sent events
+func serveSSE(hub *streamHub, o Offer, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	batches, unsubscribe := hub.subscribe(o)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case batch, ok := <-batches:
+			if !ok {
+				return
+			}
+			b, err := json.Marshal(batch)
+			if err != nil {
+				log.LogContext(r.Context(), "error", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: records\ndata: %s\n\n", batch.Seq, b); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// serveWebSocket streams the batches of an offer as WebSocket text messages,
+// anything the consumer sends is ignored
+func serveWebSocket(hub *streamHub, o Offer, w http.ResponseWriter, r *http.Request) {
+	server := websocket.Server{
+		// consumers are authenticated by token, not by origin
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			batches, unsubscribe := hub.subscribe(o)
+			defer unsubscribe()
+
+			closed := make(chan struct{})
+			go func() {
+				io.Copy(ioutil.Discard, ws)
+				close(closed)
+			}()
+
+			for {
+				select {
+				case batch, ok := <-batches:
+					if !ok {
+						return
+					}
+					if err := websocket.JSON.Send(ws, batch); err != nil {
+						return
+					}
+				case <-closed:
+					return
+				}
+			}
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+// streamURI is the WebSocket endpoint of an offer registered on the
+// marketplace
+func streamURI(host string, o Offer) string {
+	switch {
+	case strings.HasPrefix(host, "https://"):
+		host = "wss://" + strings.TrimPrefix(host, "https://")
+	case strings.HasPrefix(host, "http://"):
+		host = "ws://" + strings.TrimPrefix(host, "http://")
+	}
+	return fmt.Sprintf("%s/offering/%s/ws", host, strings.ToLower(o.ID))
+}
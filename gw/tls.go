@@ -0,0 +1,62 @@
+package gw
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/certs"
+)
+
+// certReloadInterval is how often certificate files are checked for changes
+const certReloadInterval = time.Minute
+
+// newTLSConfig returns the TLS configuration of the gateway, or nil when no
+// certificate is configured and it should serve plain HTTP
+func newTLSConfig(config Config) (*tls.Config, error) {
+	if config.TLSCertFile == "" {
+		return nil, nil
+	}
+
+	reloader, err := certs.NewReloader(config.TLSCertFile, config.TLSKeyFile, certReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	minVersion, err := certs.ParseVersion(config.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     minVersion,
+	}
+
+	if len(config.TLSCiphers) > 0 {
+		tlsConfig.CipherSuites, err = certs.ParseCiphers(config.TLSCiphers)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// newAdminTLSConfig returns the TLS configuration of the admin listener, the
+// gateway's one requiring client certificates signed by TLSClientCAFile when
+// it's set
+func newAdminTLSConfig(tlsConfig *tls.Config, config Config) (*tls.Config, error) {
+	if tlsConfig == nil || config.TLSClientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	clientCAs, err := certs.LoadCAPool(config.TLSClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	adminConfig := tlsConfig.Clone()
+	adminConfig.ClientCAs = clientCAs
+	adminConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return adminConfig, nil
+}
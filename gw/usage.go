@@ -0,0 +1,92 @@
+package gw
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/log"
+	"github.com/thingful/big-iot-gateway/pkg/store"
+)
+
+// usageBucket keeps the usage counters of the offers in the state store
+const usageBucket = "usage"
+
+// offerUsage counts the consumer requests served for an offer since it was
+// first served
+type offerUsage struct {
+	Requests  int64     `json:"requests"`
+	Failures  int64     `json:"failures"`
+	Fallbacks int64     `json:"fallbacks"`
+	Last      time.Time `json:"last"`
+}
+
+// usage keeps the counters of every offer, staged in st on every request and
+// written to disk with the next sync
+type usage struct {
+	st *store.Store
+
+	mu     sync.Mutex
+	offers map[string]*offerUsage
+}
+
+// newUsage returns the counters, carrying on from the ones in st
+func newUsage(st *store.Store) (*usage, error) {
+	u := &usage{st: st, offers: map[string]*offerUsage{}}
+	for _, id := range st.Keys(usageBucket) {
+		c := &offerUsage{}
+		if _, err := st.Get(usageBucket, id, c); err != nil {
+			return nil, err
+		}
+		u.offers[id] = c
+	}
+	return u, nil
+}
+
+// count records a request for an offer answered with status, a fallback
+// response is counted as such and not as a failure
+func (u *usage) count(offerID string, status int, fallback bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	c, ok := u.offers[offerID]
+	if !ok {
+		c = &offerUsage{}
+		u.offers[offerID] = c
+	}
+	c.Requests++
+	switch {
+	case fallback:
+		c.Fallbacks++
+	case status >= 500:
+		c.Failures++
+	}
+	c.Last = time.Now().UTC()
+
+	if err := u.st.Stage(usageBucket, offerID, c); err != nil {
+		log.Log("error", err, "offering-id", offerID, "msg", "unable to keep usage")
+	}
+}
+
+// get returns a copy of the counters of an offer
+func (u *usage) get(offerID string) *offerUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	c, ok := u.offers[offerID]
+	if !ok {
+		return nil
+	}
+	cp := *c
+	return &cp
+}
+
+// statusWriter remembers the status written to a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,86 @@
+package gw
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// term is an entry of the vocabulary scaffold suggests outputs from. Keywords
+// are matched against normalized pipe terms, see normalizeTerm.
+type term struct {
+	name     string
+	rdf      string
+	category string
+	keywords []string
+}
+
+// vocabulary holds the BIG-IoT terms used by the offers so far, terms not in
+// the BIG-IoT schema use the proposed: prefix
+var vocabulary = []term{
+	{"airTemperature", "http://schema.big-iot.org/environment/hasAirTemperature", "urn:big-iot:WeatherIndicatorCategory", []string{"temperature", "airtemperature", "ambienttemperature", "weathertemperature", "temp"}},
+	{"humidity", "http://schema.big-iot.org/environment/hasHumidity", "urn:big-iot:WeatherIndicatorCategory", []string{"humidity", "relativehumidity"}},
+	{"windSpeed", "http://schema.big-iot.org/environment/hasWindSpeed", "urn:big-iot:WeatherIndicatorCategory", []string{"windspeed", "windvelocity"}},
+	{"windDirection", "proposed:windDirection", "urn:big-iot:WeatherIndicatorCategory", []string{"winddirection", "windbearing"}},
+	{"airPressure", "proposed:airPressure", "urn:big-iot:WeatherIndicatorCategory", []string{"pressure", "airpressure", "barometricpressure"}},
+	{"rainfall", "proposed:rainfall", "urn:big-iot:WeatherIndicatorCategory", []string{"rain", "rainfall", "precipitation"}},
+	{"coConcentration", "http://schema.big-iot.org/environment/hasCO_concentration", "urn:big-iot:COCategory", []string{"co", "carbonmonoxide"}},
+	{"no2Concentration", "http://schema.big-iot.org/environment/hasNO2_concentration", "urn:big-iot:NO2Category", []string{"no2", "nitrogendioxide"}},
+	{"pm10Concentration", "proposed:pm10Concentration", "", []string{"pm10"}},
+	{"pm25Concentration", "proposed:pm25Concentration", "", []string{"pm25", "pm2p5"}},
+	{"noiseLevel", "proposed:noiseLevel", "urn:big-iot:NoisePollutionIndicatorCategory", []string{"noise", "noiselevel", "sound", "soundlevel"}},
+	{"totalCapacity", "proposed:totalParkingCapacity", "urn:big-iot:ParkingSiteCategory", []string{"capacity", "totalcapacity", "totalspaces"}},
+	{"numberOfVacantParkingSpaces", "http://schema.big-iot.org/mobility/numberOfVacantParkingSpaces", "urn:big-iot:ParkingSiteCategory", []string{"vacantspaces", "vacantparkingspaces", "freespaces", "availablespaces", "numberofvacantparkingspaces"}},
+	{"averageSpeed", "proposed:averageSpeed", "urn:big-iot:TrafficCategory", []string{"speed", "averagespeed", "speedaverage", "trafficspeed"}},
+	{"trafficFlow", "proposed:trafficFlow", "urn:big-iot:TrafficCategory", []string{"flow", "trafficflow", "vehiclecount", "vehicles"}},
+}
+
+// suggestTerm returns the vocabulary term best matching a pipe term. A
+// keyword equal to the term wins, otherwise the longest keyword it contains,
+// keywords shorter than 3 characters must be equal.
+func suggestTerm(pipeTerm string) (term, bool) {
+	norm := normalizeTerm(pipeTerm)
+
+	var best term
+	bestLen, found := 0, false
+	for _, t := range vocabulary {
+		for _, k := range t.keywords {
+			if k == norm {
+				return t, true
+			}
+			if len(k) >= 3 && len(k) > bestLen && strings.Contains(norm, k) {
+				best, bestLen, found = t, len(k), true
+			}
+		}
+	}
+	return best, found
+}
+
+// normalizeTerm lowercases a term, dropping everything but letters and
+// digits, so wind_speed, WindSpeed and wind-speed are the same
+func normalizeTerm(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return b.String()
+}
+
+// camelCase turns a pipe term into a lower camel case output name
+func camelCase(s string) string {
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, w := range words {
+		// the first letter may take more than a byte, e.g. Ä
+		r, size := utf8.DecodeRuneInString(w)
+		if i == 0 {
+			words[i] = string(unicode.ToLower(r)) + w[size:]
+		} else {
+			words[i] = string(unicode.ToUpper(r)) + w[size:]
+		}
+	}
+	return strings.Join(words, "")
+}
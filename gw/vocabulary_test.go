@@ -0,0 +1,122 @@
+package gw
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSuggestTerm(t *testing.T) {
+	testCases := []struct {
+		pipeTerm string
+		name     string
+		found    bool
+	}{
+		{"WindSpeed", "windSpeed", true},
+		{"wind_speed", "windSpeed", true},
+		{"temp", "airTemperature", true},
+		{"outdoorTemperatureC", "airTemperature", true},
+		{"sound", "noiseLevel", true},
+		{"NoiseLevel", "noiseLevel", true},
+		{"pm2.5", "pm25Concentration", true},
+		{"CO", "coConcentration", true},
+		{"scooter", "", false},
+		{"station", "", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.pipeTerm, func(t *testing.T) {
+			got, found := suggestTerm(tc.pipeTerm)
+			if found != tc.found || got.name != tc.name {
+				t.Errorf("expected %q found %v, got %q found %v", tc.name, tc.found, got.name, found)
+			}
+		})
+	}
+}
+
+func TestVocabularyRDF(t *testing.T) {
+	// terms outside the BIG-IoT schema must be proposed ones
+	for _, term := range vocabulary {
+		if !strings.HasPrefix(term.rdf, "http://schema.big-iot.org/") && !strings.HasPrefix(term.rdf, "proposed:") {
+			t.Errorf("%s: unexpected rdf %s", term.name, term.rdf)
+		}
+		if term.name != camelCase(term.name) {
+			t.Errorf("%s: name isn't lower camel case", term.name)
+		}
+	}
+}
+
+func TestCamelCase(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"wind_speed", "windSpeed"},
+		{"WindSpeed", "windSpeed"},
+		{"total-capacity now", "totalCapacityNow"},
+		{"pm2.5", "pm25"},
+		{"__sound__", "sound"},
+		{"Ärger_über", "ärgerÜber"},
+		{"", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			if got := camelCase(tc.input); got != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestValueType(t *testing.T) {
+	testCases := []struct {
+		name     string
+		value    interface{}
+		expected string
+	}{
+		{"integer", 21.0, "integer"},
+		{"number", 21.5, "number"},
+		{"datetime", "2026-10-19T12:00:00Z", "datetime"},
+		{"string", "high", "string"},
+		{"boolean", true, "boolean"},
+		{"null", nil, "null"},
+		{"object", map[string]interface{}{}, "object"},
+		{"array", []interface{}{}, "array"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := valueType(tc.value); got != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestMergeType(t *testing.T) {
+	testCases := []struct {
+		seen     string
+		t        string
+		expected string
+	}{
+		{"", "integer", "integer"},
+		{"null", "string", "string"},
+		{"string", "null", "string"},
+		{"integer", "integer", "integer"},
+		{"integer", "number", "number"},
+		{"number", "integer", "number"},
+		{"datetime", "string", "string"},
+		{"string", "datetime", "string"},
+		{"integer", "string", "mixed"},
+		{"boolean", "number", "mixed"},
+		{"mixed", "string", "mixed"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.seen+"+"+tc.t, func(t *testing.T) {
+			if got := mergeType(tc.seen, tc.t); got != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
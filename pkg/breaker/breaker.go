@@ -0,0 +1,141 @@
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+// State of a circuit breaker
+type State int
+
+const (
+	// Closed lets every request through
+	Closed State = iota
+	// Open rejects every request until the cooldown has passed
+	Open
+	// HalfOpen lets a single probe request through to decide whether to close
+	// or open again
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// Breaker is a consecutive failures circuit breaker, it's safe for concurrent
+// use
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+	onChange  func(from, to State)
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	probing  bool
+	now      func() time.Time
+}
+
+// New returns a closed Breaker that opens after threshold consecutive failures
+// and waits cooldown before probing again. onChange is called, outside of the
+// breaker lock, on every state transition and can be nil.
+func New(threshold int, cooldown time.Duration, onChange func(from, to State)) *Breaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		onChange:  onChange,
+		now:       time.Now,
+	}
+}
+
+// Allow reports whether a request can go through. When it can't, it returns
+// how long the caller should wait before trying again. Every allowed request
+// must be followed by a call to Success or Failure.
+func (b *Breaker) Allow() (time.Duration, bool) {
+	b.mu.Lock()
+
+	switch b.state {
+	case Open:
+		wait := b.openedAt.Add(b.cooldown).Sub(b.now())
+		if wait > 0 {
+			b.mu.Unlock()
+			return wait, false
+		}
+		b.probing = true
+		b.transition(HalfOpen)
+		return 0, true
+	case HalfOpen:
+		if b.probing {
+			b.mu.Unlock()
+			return b.cooldown, false
+		}
+		b.probing = true
+	}
+
+	b.mu.Unlock()
+	return 0, true
+}
+
+// Success records a successful request
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	b.failures = 0
+	b.probing = false
+	if b.state != Closed {
+		b.transition(Closed)
+		return
+	}
+	b.mu.Unlock()
+}
+
+// Failure records a failed request
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	b.failures++
+	b.probing = false
+	if b.state == HalfOpen || (b.state == Closed && b.failures >= b.threshold) {
+		b.openedAt = b.now()
+		b.transition(Open)
+		return
+	}
+	b.mu.Unlock()
+}
+
+// Abort releases an allowed request without recording any result, i.e. when
+// the caller gave up before the request finished
+func (b *Breaker) Abort() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// State returns the current state of the breaker
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// transition changes state and releases the lock before notifying onChange
+func (b *Breaker) transition(to State) {
+	from := b.state
+	b.state = to
+	b.mu.Unlock()
+
+	if b.onChange != nil && from != to {
+		b.onChange(from, to)
+	}
+}
@@ -0,0 +1,134 @@
+package breaker
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	// steps: allow and deny check Allow, ok, fail and abort report the
+	// result of a request, wait advances the clock by the cooldown
+	testCases := []struct {
+		name        string
+		threshold   int
+		steps       string
+		state       State
+		transitions string
+	}{
+		{
+			name:      "successes keep it closed",
+			threshold: 2,
+			steps:     "allow ok allow ok",
+			state:     Closed,
+		},
+		{
+			name:      "failures below the threshold",
+			threshold: 3,
+			steps:     "allow fail allow fail allow ok allow fail allow fail",
+			state:     Closed,
+		},
+		{
+			name:        "opens after consecutive failures",
+			threshold:   2,
+			steps:       "allow fail allow fail deny",
+			state:       Open,
+			transitions: "closed>open",
+		},
+		{
+			name:        "threshold below one opens on the first failure",
+			threshold:   0,
+			steps:       "allow fail deny",
+			state:       Open,
+			transitions: "closed>open",
+		},
+		{
+			name:        "a single probe after the cooldown",
+			threshold:   1,
+			steps:       "allow fail deny wait allow deny",
+			state:       HalfOpen,
+			transitions: "closed>open open>half-open",
+		},
+		{
+			name:        "a successful probe closes it",
+			threshold:   1,
+			steps:       "allow fail wait allow ok allow ok",
+			state:       Closed,
+			transitions: "closed>open open>half-open half-open>closed",
+		},
+		{
+			name:        "a failed probe opens it again",
+			threshold:   3,
+			steps:       "allow fail allow fail allow fail wait allow fail deny",
+			state:       Open,
+			transitions: "closed>open open>half-open half-open>open",
+		},
+		{
+			name:        "an aborted probe lets another one through",
+			threshold:   1,
+			steps:       "allow fail wait allow abort allow ok",
+			state:       Closed,
+			transitions: "closed>open open>half-open half-open>closed",
+		},
+		{
+			name:        "failures after closing count from zero",
+			threshold:   2,
+			steps:       "allow fail allow fail wait allow ok allow fail allow ok",
+			state:       Closed,
+			transitions: "closed>open open>half-open half-open>closed",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			transitions := []string{}
+			b := New(tc.threshold, time.Minute, func(from, to State) {
+				transitions = append(transitions, fmt.Sprintf("%s>%s", from, to))
+			})
+			now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+			b.now = func() time.Time { return now }
+
+			for i, step := range strings.Fields(tc.steps) {
+				switch step {
+				case "allow", "deny":
+					wait, ok := b.Allow()
+					if ok != (step == "allow") {
+						t.Fatalf("step %d: expected %s, got allowed %v", i, step, ok)
+					}
+					if !ok && wait <= 0 {
+						t.Errorf("step %d: denied without a wait", i)
+					}
+				case "ok":
+					b.Success()
+				case "fail":
+					b.Failure()
+				case "abort":
+					b.Abort()
+				case "wait":
+					now = now.Add(time.Minute)
+				}
+			}
+
+			if b.State() != tc.state {
+				t.Errorf("expected %s, got %s", tc.state, b.State())
+			}
+			if got := strings.Join(transitions, " "); got != tc.transitions {
+				t.Errorf("expected transitions %q, got %q", tc.transitions, got)
+			}
+		})
+	}
+}
+
+func TestBreakerWait(t *testing.T) {
+	b := New(1, time.Minute, nil)
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	b.now = func() time.Time { return now }
+
+	b.Allow()
+	b.Failure()
+	now = now.Add(20 * time.Second)
+	if wait, ok := b.Allow(); ok || wait != 40*time.Second {
+		t.Errorf("expected to wait 40s, got %s allowed %v", wait, ok)
+	}
+}
@@ -0,0 +1,166 @@
+package geocoder
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/log"
+	"github.com/thingful/big-iot-gateway/pkg/store"
+)
+
+// notFoundTTL is how long an address that couldn't be found is remembered,
+// so a transient empty answer doesn't lose its bounds for good
+const notFoundTTL = 24 * time.Hour
+
+// cacheEntry is a cached geocoding result, a nil Bounds records an address
+// that couldn't be found until Expires. Entries without bounds nor expiry,
+// saved by earlier versions, are looked up again.
+type cacheEntry struct {
+	Bounds  *Bounds    `json:"bounds"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// storeBucket keeps the results of a Cache in a state store
+const storeBucket = "geocoder"
+
+// Cache is a Geocoder that remembers the results of another Geocoder. When
+// created with a path, or a state store, the results are kept there, so
+// addresses are geocoded only once across restarts. Transient errors are
+// never cached, and addresses that couldn't be found only for notFoundTTL.
+type Cache struct {
+	path string
+	st   *store.Store
+	next Geocoder
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	now     func() time.Time
+}
+
+// NewCache returns a Cache in front of next, loading any results previously
+// saved to path. An empty path keeps the results in memory only.
+func NewCache(path string, next Geocoder) (*Cache, error) {
+	c := &Cache{
+		path:    path,
+		next:    next,
+		entries: map[string]cacheEntry{},
+		now:     time.Now,
+	}
+
+	if path == "" {
+		return c, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &c.entries); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// NewStoreCache returns a Cache in front of next keeping its results in st
+func NewStoreCache(st *store.Store, next Geocoder) (*Cache, error) {
+	c := &Cache{
+		st:      st,
+		next:    next,
+		entries: map[string]cacheEntry{},
+		now:     time.Now,
+	}
+
+	for _, key := range st.Keys(storeBucket) {
+		e := cacheEntry{}
+		if _, err := st.Get(storeBucket, key, &e); err != nil {
+			return nil, err
+		}
+		c.entries[key] = e
+	}
+
+	return c, nil
+}
+
+// Geocode returns the cached result for address, asking the next Geocoder
+// only on a miss
+func (c *Cache) Geocode(ctx context.Context, address string) (*Bounds, error) {
+	key := strings.ToLower(strings.TrimSpace(address))
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+
+	switch {
+	case ok && e.Bounds != nil:
+		return e.Bounds, nil
+	case ok && e.Expires != nil && c.now().Before(*e.Expires):
+		return nil, ErrNotFound
+	}
+
+	bounds, err := c.next.Geocode(ctx, address)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+
+	e = cacheEntry{Bounds: bounds}
+	if err == ErrNotFound {
+		expires := c.now().Add(notFoundTTL).UTC()
+		e.Expires = &expires
+	}
+
+	c.mu.Lock()
+	c.entries[key] = e
+	saveErr := c.save(key)
+	c.mu.Unlock()
+
+	if saveErr != nil {
+		log.Log("error", saveErr, "msg", "unable to save geocoder cache")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bounds, nil
+}
+
+// save writes the entry of key to the state store, or every entry to a
+// temporary file renamed over the cache file. It must be called with the lock
+// held.
+func (c *Cache) save(key string) error {
+	if c.st != nil {
+		return c.st.Put(storeBucket, key, c.entries[key])
+	}
+	if c.path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), ".geocache")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.path)
+}
@@ -0,0 +1,193 @@
+package geocoder
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/store"
+)
+
+var torino = &Bounds{
+	NorthEast: Point{Lat: 45.1402, Lng: 7.7733},
+	SouthWest: Point{Lat: 45.0067, Lng: 7.5778},
+}
+
+// stubGeocoder answers from results, an address missing from it isn't found,
+// and counts the calls made
+type stubGeocoder struct {
+	results map[string]*Bounds
+	err     error
+	calls   int
+}
+
+func (s *stubGeocoder) Geocode(ctx context.Context, address string) (*Bounds, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	b, ok := s.results[address]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return b, nil
+}
+
+func TestCache(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	// every lookup is made after a while from now, expecting bounds or an error
+	type lookup struct {
+		address string
+		after   time.Duration
+		bounds  *Bounds
+		err     error
+	}
+	testCases := []struct {
+		name    string
+		err     error
+		lookups []lookup
+		calls   int
+	}{
+		{
+			name: "miss then hit",
+			lookups: []lookup{
+				{address: "Torino", bounds: torino},
+				{address: " torino ", bounds: torino},
+				{address: "TORINO", after: 365 * 24 * time.Hour, bounds: torino},
+			},
+			calls: 1,
+		},
+		{
+			name: "not found is remembered until it expires",
+			lookups: []lookup{
+				{address: "Atlantis", err: ErrNotFound},
+				{address: "Atlantis", after: time.Hour, err: ErrNotFound},
+				{address: "Atlantis", after: 25 * time.Hour, err: ErrNotFound},
+			},
+			calls: 2,
+		},
+		{
+			name: "transient errors aren't cached",
+			err:  errors.New("connection refused"),
+			lookups: []lookup{
+				{address: "Torino", err: errors.New("connection refused")},
+				{address: "Torino", err: errors.New("connection refused")},
+			},
+			calls: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			next := &stubGeocoder{results: map[string]*Bounds{"Torino": torino, " torino ": torino, "TORINO": torino}, err: tc.err}
+			c, err := NewCache("", next)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, l := range tc.lookups {
+				c.now = func() time.Time { return now.Add(l.after) }
+				bounds, err := c.Geocode(context.Background(), l.address)
+				if (err == nil) != (l.err == nil) || (err != nil && err.Error() != l.err.Error()) {
+					t.Errorf("lookup %d: expected error %v, got %v", i, l.err, err)
+				}
+				if l.bounds != nil && (bounds == nil || *bounds != *l.bounds) {
+					t.Errorf("lookup %d: expected %+v, got %+v", i, l.bounds, bounds)
+				}
+			}
+			if next.calls != tc.calls {
+				t.Errorf("expected %d calls to the geocoder, got %d", tc.calls, next.calls)
+			}
+		})
+	}
+}
+
+func TestCachePersistence(t *testing.T) {
+	testCases := []struct {
+		name string
+		open func(dir string, next Geocoder) (*Cache, error)
+	}{
+		{
+			name: "cache file",
+			open: func(dir string, next Geocoder) (*Cache, error) {
+				return NewCache(filepath.Join(dir, "geocache.json"), next)
+			},
+		},
+		{
+			name: "state store",
+			open: func(dir string, next Geocoder) (*Cache, error) {
+				st, err := store.Open(filepath.Join(dir, "state.json"))
+				if err != nil {
+					return nil, err
+				}
+				return NewStoreCache(st, next)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "geocoder")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			first := &stubGeocoder{results: map[string]*Bounds{"Torino": torino}}
+			c, err := tc.open(dir, first)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Geocode(context.Background(), "Torino")
+			c.Geocode(context.Background(), "Atlantis")
+
+			// after a restart the results come from disk, the address that
+			// wasn't found too until it expires
+			reopened := &stubGeocoder{results: map[string]*Bounds{"Atlantis": torino}}
+			c, err = tc.open(dir, reopened)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bounds, err := c.Geocode(context.Background(), "Torino"); err != nil || *bounds != *torino {
+				t.Errorf("expected cached bounds, got %+v and %v", bounds, err)
+			}
+			if _, err := c.Geocode(context.Background(), "Atlantis"); err != ErrNotFound {
+				t.Errorf("expected cached %v, got %v", ErrNotFound, err)
+			}
+			if reopened.calls != 0 {
+				t.Errorf("expected no calls to the geocoder, got %d", reopened.calls)
+			}
+
+			c.now = func() time.Time { return time.Now().Add(notFoundTTL + time.Minute) }
+			if bounds, err := c.Geocode(context.Background(), "Atlantis"); err != nil || *bounds != *torino {
+				t.Errorf("expected the expired address to be geocoded again, got %+v and %v", bounds, err)
+			}
+		})
+	}
+}
+
+func TestCacheLegacyNotFound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geocoder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// earlier versions cached addresses that weren't found for good
+	path := filepath.Join(dir, "geocache.json")
+	ioutil.WriteFile(path, []byte(`{"torino":{"bounds":null}}`), 0644)
+
+	next := &stubGeocoder{results: map[string]*Bounds{"Torino": torino}}
+	c, err := NewCache(path, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bounds, err := c.Geocode(context.Background(), "Torino"); err != nil || *bounds != *torino {
+		t.Errorf("expected the address to be geocoded again, got %+v and %v", bounds, err)
+	}
+}
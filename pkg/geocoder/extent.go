@@ -0,0 +1,38 @@
+package geocoder
+
+import "math"
+
+// BoundsOf returns the smallest Bounds containing every point, or nil if
+// there are no points
+func BoundsOf(points []Point) *Bounds {
+	if len(points) == 0 {
+		return nil
+	}
+
+	b := &Bounds{NorthEast: points[0], SouthWest: points[0]}
+	for _, p := range points[1:] {
+		b.NorthEast.Lat = math.Max(b.NorthEast.Lat, p.Lat)
+		b.NorthEast.Lng = math.Max(b.NorthEast.Lng, p.Lng)
+		b.SouthWest.Lat = math.Min(b.SouthWest.Lat, p.Lat)
+		b.SouthWest.Lng = math.Min(b.SouthWest.Lng, p.Lng)
+	}
+	return b
+}
+
+// Differs reports whether any corner of b is further than tolerance degrees
+// from the same corner of other
+func (b *Bounds) Differs(other *Bounds, tolerance float64) bool {
+	if b == nil || other == nil {
+		return b != other
+	}
+	return math.Abs(b.NorthEast.Lat-other.NorthEast.Lat) > tolerance ||
+		math.Abs(b.NorthEast.Lng-other.NorthEast.Lng) > tolerance ||
+		math.Abs(b.SouthWest.Lat-other.SouthWest.Lat) > tolerance ||
+		math.Abs(b.SouthWest.Lng-other.SouthWest.Lng) > tolerance
+}
+
+// Contains reports whether p is inside b, edges included
+func (b *Bounds) Contains(p Point) bool {
+	return p.Lat >= b.SouthWest.Lat && p.Lat <= b.NorthEast.Lat &&
+		p.Lng >= b.SouthWest.Lng && p.Lng <= b.NorthEast.Lng
+}
@@ -0,0 +1,34 @@
+package geocoder
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotFound is returned when an address can't be geocoded
+var ErrNotFound = errors.New("geocoder: no results found")
+
+// Point is a location in decimal degrees
+type Point struct {
+	Lat float64
+	Lng float64
+}
+
+// Bounds is a rectangle defined by its north east and south west corners
+type Bounds struct {
+	NorthEast Point
+	SouthWest Point
+}
+
+// Geocoder resolves an address, usually a city name, into its bounds
+type Geocoder interface {
+	Geocode(ctx context.Context, address string) (*Bounds, error)
+}
+
+// None is a Geocoder that never finds anything, used when geocoding is disabled
+type None struct{}
+
+// Geocode always returns ErrNotFound
+func (None) Geocode(ctx context.Context, address string) (*Bounds, error) {
+	return nil, ErrNotFound
+}
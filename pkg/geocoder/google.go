@@ -0,0 +1,40 @@
+package geocoder
+
+import (
+	"context"
+
+	"googlemaps.github.io/maps"
+)
+
+// Google geocodes addresses using the Google Maps geocoding API
+type Google struct {
+	client *maps.Client
+}
+
+// NewGoogle returns a Google geocoder authenticated with apiKey
+func NewGoogle(apiKey string) (*Google, error) {
+	client, err := maps.NewClient(maps.WithAPIKey(apiKey))
+	if err != nil {
+		return nil, err
+	}
+	return &Google{client: client}, nil
+}
+
+// Geocode returns the bounds of the first result for address
+func (g *Google) Geocode(ctx context.Context, address string) (*Bounds, error) {
+	results, err := g.client.Geocode(ctx, &maps.GeocodingRequest{
+		Address: address,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, ErrNotFound
+	}
+
+	b := results[0].Geometry.Bounds
+	return &Bounds{
+		NorthEast: Point{Lat: b.NorthEast.Lat, Lng: b.NorthEast.Lng},
+		SouthWest: Point{Lat: b.SouthWest.Lat, Lng: b.SouthWest.Lng},
+	}, nil
+}
@@ -0,0 +1,91 @@
+package geocoder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultNominatimURL is the public OpenStreetMap Nominatim instance
+const DefaultNominatimURL = "https://nominatim.openstreetmap.org"
+
+// Nominatim geocodes addresses using a Nominatim compatible search API
+type Nominatim struct {
+	baseURL    string
+	userAgent  string
+	httpClient *http.Client
+}
+
+// NewNominatim returns a Nominatim geocoder for the instance at baseURL, the
+// public usage policy requires a userAgent identifying the application
+func NewNominatim(baseURL, userAgent string) *Nominatim {
+	if baseURL == "" {
+		baseURL = DefaultNominatimURL
+	}
+	return &Nominatim{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		userAgent:  userAgent,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// nominatimPlace is a search result, the bounding box is given as strings in
+// south, north, west, east order
+type nominatimPlace struct {
+	BoundingBox []string `json:"boundingbox"`
+}
+
+// Geocode returns the bounds of the first result for address
+func (n *Nominatim) Geocode(ctx context.Context, address string) (*Bounds, error) {
+	params := url.Values{
+		"q":      []string{address},
+		"format": []string{"json"},
+		"limit":  []string{"1"},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, n.baseURL+"/search?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if n.userAgent != "" {
+		req.Header.Set("User-Agent", n.userAgent)
+	}
+
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("nominatim: status Code: %d received", resp.StatusCode)
+	}
+
+	places := []nominatimPlace{}
+	if err := json.NewDecoder(resp.Body).Decode(&places); err != nil {
+		return nil, err
+	}
+	if len(places) == 0 || len(places[0].BoundingBox) != 4 {
+		return nil, ErrNotFound
+	}
+
+	var c [4]float64
+	for i, v := range places[0].BoundingBox {
+		c[i], err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("nominatim: invalid bounding box: %s", err.Error())
+		}
+	}
+
+	return &Bounds{
+		NorthEast: Point{Lat: c[1], Lng: c[3]},
+		SouthWest: Point{Lat: c[0], Lng: c[2]},
+	}, nil
+}
@@ -0,0 +1,96 @@
+package geocoder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNominatim(t *testing.T) {
+	testCases := []struct {
+		name     string
+		status   int
+		body     string
+		expected *Bounds
+		err      string
+	}{
+		{
+			name:   "bounding box",
+			status: http.StatusOK,
+			body:   `[{"boundingbox":["45.0067","45.1402","7.5778","7.7733"],"display_name":"Torino"}]`,
+			expected: &Bounds{
+				NorthEast: Point{Lat: 45.1402, Lng: 7.7733},
+				SouthWest: Point{Lat: 45.0067, Lng: 7.5778},
+			},
+		},
+		{
+			name:   "no results",
+			status: http.StatusOK,
+			body:   `[]`,
+			err:    ErrNotFound.Error(),
+		},
+		{
+			name:   "result without a bounding box",
+			status: http.StatusOK,
+			body:   `[{"display_name":"Torino"}]`,
+			err:    ErrNotFound.Error(),
+		},
+		{
+			name:   "invalid bounding box",
+			status: http.StatusOK,
+			body:   `[{"boundingbox":["45.0067","north","7.5778","7.7733"]}]`,
+			err:    "nominatim: invalid bounding box",
+		},
+		{
+			name:   "malformed payload",
+			status: http.StatusOK,
+			body:   `{"error":`,
+			err:    "unexpected EOF",
+		},
+		{
+			name:   "rate limited",
+			status: http.StatusTooManyRequests,
+			body:   `{}`,
+			err:    "nominatim: status Code: 429 received",
+		},
+		{
+			name:   "server error",
+			status: http.StatusInternalServerError,
+			body:   `{}`,
+			err:    "nominatim: status Code: 500 received",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				q := r.URL.Query()
+				if r.URL.Path != "/search" || q.Get("q") != "Torino, Italy" || q.Get("format") != "json" || q.Get("limit") != "1" {
+					t.Errorf("unexpected request %s", r.URL)
+				}
+				if r.Header.Get("User-Agent") != "gateway-test" {
+					t.Errorf("expected user agent gateway-test, got %s", r.Header.Get("User-Agent"))
+				}
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+
+			bounds, err := NewNominatim(srv.URL+"/", "gateway-test").Geocode(context.Background(), "Torino, Italy")
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if *bounds != *tc.expected {
+				t.Errorf("expected %+v, got %+v", tc.expected, bounds)
+			}
+		})
+	}
+}
@@ -0,0 +1,358 @@
+// Package history is a time series store of records kept in a directory.
+// Every series has a directory with a file per UTC day, holding a json point
+// per line. Points are only appended, so a crash can at most tear the last
+// line of a file, which is skipped when reading it.
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/geocoder"
+)
+
+const (
+	dayLayout = "2006-01-02"
+	ext       = ".jsonl"
+)
+
+// Point is a record of a series at a time. Sensor and Location are empty
+// when the record doesn't tell them.
+type Point struct {
+	Time     time.Time       `json:"t"`
+	Sensor   string          `json:"s,omitempty"`
+	Location *geocoder.Point `json:"loc,omitempty"`
+	Record   json.RawMessage `json:"r"`
+}
+
+// key identifies a point, a series has a single point per sensor and time.
+// Points without a sensor are told apart by their location, or by their
+// record when they have none.
+func (p Point) key() string {
+	id := p.Sensor
+	switch {
+	case id != "":
+	case p.Location != nil:
+		id = fmt.Sprintf("@%g,%g", p.Location.Lat, p.Location.Lng)
+	default:
+		id = "#" + string(p.Record)
+	}
+	return id + "\x00" + p.Time.UTC().Format(time.RFC3339Nano)
+}
+
+// Query selects the points of a series. Zero values don't filter, a Limit
+// above zero keeps the oldest points.
+type Query struct {
+	From   time.Time
+	To     time.Time
+	Sensor string
+	Bounds *geocoder.Bounds
+	Limit  int
+}
+
+// Store keeps series of points in a directory. It's safe for concurrent use.
+type Store struct {
+	dir string
+
+	mu sync.Mutex
+	// keys of the points in the day files written since open, by series
+	// and day, to drop the points already kept
+	keys map[string]map[string]map[string]bool
+}
+
+// Open returns the store kept in dir, creating it if needed
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, keys: map[string]map[string]map[string]bool{}}, nil
+}
+
+// Append adds points to a series, skipping the ones it already has for the
+// same sensor and time, and returns how many were added. Files are synced
+// before returning.
+func (s *Store) Append(series string, points []Point) (int, error) {
+	days := map[string][]Point{}
+	for _, p := range points {
+		day := p.Time.UTC().Format(dayLayout)
+		days[day] = append(days[day], p)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(s.seriesDir(series), 0755); err != nil {
+		return 0, err
+	}
+
+	added := 0
+	for day, points := range days {
+		keys, err := s.dayKeys(series, day)
+		if err != nil {
+			return added, err
+		}
+
+		buf := &bytes.Buffer{}
+		fresh := []string{}
+		for _, p := range points {
+			k := p.key()
+			if keys[k] {
+				continue
+			}
+			b, err := json.Marshal(p)
+			if err != nil {
+				return added, err
+			}
+			buf.Write(b)
+			buf.WriteByte('\n')
+			// points repeated within the batch are only written once
+			keys[k] = true
+			fresh = append(fresh, k)
+		}
+		if buf.Len() == 0 {
+			continue
+		}
+
+		if err := appendFile(s.dayPath(series, day), buf.Bytes()); err != nil {
+			for _, k := range fresh {
+				delete(keys, k)
+			}
+			return added, err
+		}
+		added += len(fresh)
+	}
+	return added, nil
+}
+
+// Points returns the points of a series selected by q, ordered by time and
+// sensor, and whether Limit left some out. Days are read oldest first and
+// reading stops once Limit is reached.
+func (s *Store) Points(series string, q Query) ([]Point, bool, error) {
+	days, err := s.days(series)
+	if err != nil {
+		return nil, false, err
+	}
+
+	points := []Point{}
+	for i, day := range days {
+		start, _ := time.Parse(dayLayout, day)
+		if !q.To.IsZero() && start.After(q.To) {
+			continue
+		}
+		if !q.From.IsZero() && !start.Add(24*time.Hour).After(q.From) {
+			continue
+		}
+
+		// points are appended as they come, a day isn't in order
+		dayPoints := []Point{}
+		err := s.scan(s.dayPath(series, day), func(p Point) bool {
+			if q.match(p) {
+				dayPoints = append(dayPoints, p)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		sort.Slice(dayPoints, func(i, j int) bool {
+			if !dayPoints[i].Time.Equal(dayPoints[j].Time) {
+				return dayPoints[i].Time.Before(dayPoints[j].Time)
+			}
+			return dayPoints[i].Sensor < dayPoints[j].Sensor
+		})
+		points = append(points, dayPoints...)
+
+		if q.Limit > 0 && len(points) > q.Limit {
+			return points[:q.Limit], true, nil
+		}
+		if q.Limit > 0 && len(points) == q.Limit {
+			more, err := s.matchAny(series, days[i+1:], q)
+			return points, more, err
+		}
+	}
+	return points, false, nil
+}
+
+// Prune removes the days of a series that ended before the given time and
+// returns how many were removed
+func (s *Store) Prune(series string, before time.Time) (int, error) {
+	days, err := s.days(series)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for _, day := range days {
+		start, _ := time.Parse(dayLayout, day)
+		if start.Add(24 * time.Hour).After(before) {
+			continue
+		}
+		if err := os.Remove(s.dayPath(series, day)); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		delete(s.keys[series], day)
+		removed++
+	}
+	return removed, nil
+}
+
+// matchAny tells whether any of the given days of a series has a point
+// selected by q
+func (s *Store) matchAny(series string, days []string, q Query) (bool, error) {
+	found := false
+	for _, day := range days {
+		start, _ := time.Parse(dayLayout, day)
+		if !q.To.IsZero() && start.After(q.To) {
+			break
+		}
+		err := s.scan(s.dayPath(series, day), func(p Point) bool {
+			found = q.match(p)
+			return !found
+		})
+		if err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+func (q Query) match(p Point) bool {
+	if !q.From.IsZero() && p.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && p.Time.After(q.To) {
+		return false
+	}
+	if q.Sensor != "" && p.Sensor != q.Sensor {
+		return false
+	}
+	if q.Bounds != nil && (p.Location == nil || !q.Bounds.Contains(*p.Location)) {
+		return false
+	}
+	return true
+}
+
+// dayKeys returns the keys of the points kept for a day, reading them from
+// its file the first time. It must be called with the lock held.
+func (s *Store) dayKeys(series, day string) (map[string]bool, error) {
+	if s.keys[series] == nil {
+		s.keys[series] = map[string]map[string]bool{}
+	}
+	if keys, ok := s.keys[series][day]; ok {
+		return keys, nil
+	}
+
+	keys := map[string]bool{}
+	err := s.scan(s.dayPath(series, day), func(p Point) bool {
+		keys[p.key()] = true
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.keys[series][day] = keys
+	return keys, nil
+}
+
+// days returns the days a series has points for, oldest first
+func (s *Store) days(series string) ([]string, error) {
+	files, err := ioutil.ReadDir(s.seriesDir(series))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	days := []string{}
+	for _, f := range files {
+		day := strings.TrimSuffix(f.Name(), ext)
+		if f.IsDir() || day == f.Name() {
+			continue
+		}
+		if _, err := time.Parse(dayLayout, day); err != nil {
+			continue
+		}
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// scan calls fn with every point of a day file until it returns false,
+// skipping lines that can't be read like the one torn by a crash
+func (s *Store) scan(path string, fn func(p Point) bool) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 64*1024)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			p := Point{}
+			if json.Unmarshal(line, &p) == nil && !fn(p) {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Store) seriesDir(series string) string {
+	return filepath.Join(s.dir, url.PathEscape(series))
+}
+
+func (s *Store) dayPath(series, day string) string {
+	return filepath.Join(s.seriesDir(series), day+ext)
+}
+
+// appendFile appends b to a file and syncs it. A line torn by a crash is
+// ended first, so it doesn't swallow the first point appended.
+func appendFile(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			b = append([]byte{'\n'}, b...)
+		}
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
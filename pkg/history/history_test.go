@@ -0,0 +1,291 @@
+package history
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/geocoder"
+)
+
+func tempStore(t *testing.T) (*Store, string) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st, dir
+}
+
+func point(t string, sensor string, lat, lng float64) Point {
+	at, _ := time.Parse(time.RFC3339, t)
+	p := Point{Time: at, Sensor: sensor, Record: json.RawMessage(`{"sensor":"` + sensor + `"}`)}
+	if lat != 0 || lng != 0 {
+		p.Location = &geocoder.Point{Lat: lat, Lng: lng}
+	}
+	return p
+}
+
+func TestAppendDedup(t *testing.T) {
+	testCases := []struct {
+		name    string
+		batches [][]Point
+		added   []int
+		reopen  bool
+	}{
+		{
+			name: "same sensor and time is kept once",
+			batches: [][]Point{
+				{point("2026-10-01T10:00:00Z", "a", 0, 0), point("2026-10-01T10:00:00Z", "b", 0, 0)},
+				{point("2026-10-01T10:00:00Z", "a", 0, 0), point("2026-10-01T10:05:00Z", "a", 0, 0)},
+			},
+			added: []int{2, 1},
+		},
+		{
+			name: "repeated within a batch",
+			batches: [][]Point{
+				{point("2026-10-01T10:00:00Z", "a", 0, 0), point("2026-10-01T10:00:00Z", "a", 0, 0)},
+			},
+			added: []int{1},
+		},
+		{
+			name: "points without sensor told apart by location",
+			batches: [][]Point{
+				{point("2026-10-01T10:00:00Z", "", 41.39, 2.17), point("2026-10-01T10:00:00Z", "", 51.5, -0.1)},
+				{point("2026-10-01T10:00:00Z", "", 41.39, 2.17)},
+			},
+			added: []int{2, 0},
+		},
+		{
+			name: "survives a restart",
+			batches: [][]Point{
+				{point("2026-10-01T10:00:00Z", "a", 0, 0), point("2026-10-02T10:00:00Z", "a", 0, 0)},
+				{point("2026-10-01T10:00:00Z", "a", 0, 0), point("2026-10-02T10:00:00Z", "a", 0, 0), point("2026-10-02T11:00:00Z", "a", 0, 0)},
+			},
+			added:  []int{2, 1},
+			reopen: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			st, dir := tempStore(t)
+			defer os.RemoveAll(dir)
+
+			for i, batch := range tc.batches {
+				if tc.reopen && i > 0 {
+					var err error
+					if st, err = Open(dir); err != nil {
+						t.Fatal(err)
+					}
+				}
+				added, err := st.Append("series", batch)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if added != tc.added[i] {
+					t.Errorf("batch %d: expected %d added, got %d", i, tc.added[i], added)
+				}
+			}
+		})
+	}
+}
+
+func TestTornLine(t *testing.T) {
+	st, dir := tempStore(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := st.Append("series", []Point{point("2026-10-01T10:00:00Z", "a", 0, 0)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash tears the last line appended
+	path := filepath.Join(dir, "series", "2026-10-01.jsonl")
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"t":"2026-10-01T11:00:00Z","s":"b","r":{"sen`)
+	f.Close()
+
+	st, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Append("series", []Point{point("2026-10-01T12:00:00Z", "c", 0, 0)}); err != nil {
+		t.Fatal(err)
+	}
+
+	points, _, err := st.Points("series", Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sensors := ""
+	for _, p := range points {
+		sensors += p.Sensor
+	}
+	if sensors != "ac" {
+		t.Errorf("expected the points of a and c, got %q", sensors)
+	}
+}
+
+func TestPoints(t *testing.T) {
+	st, dir := tempStore(t)
+	defer os.RemoveAll(dir)
+
+	// appended out of order, and a day later than the others in between
+	_, err := st.Append("series", []Point{
+		point("2026-10-01T12:00:00Z", "b", 41.39, 2.17),
+		point("2026-10-01T10:00:00Z", "a", 51.5, -0.1),
+		point("2026-10-03T10:00:00Z", "a", 51.5, -0.1),
+		point("2026-10-02T10:00:00Z", "b", 41.39, 2.17),
+		point("2026-10-01T10:00:00Z", "b", 41.39, 2.17),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := func(v string) time.Time {
+		t, _ := time.Parse(time.RFC3339, v)
+		return t
+	}
+
+	testCases := []struct {
+		name      string
+		query     Query
+		expected  []string
+		truncated bool
+	}{
+		{
+			name:     "everything in order",
+			query:    Query{},
+			expected: []string{"2026-10-01T10:00:00Z a", "2026-10-01T10:00:00Z b", "2026-10-01T12:00:00Z b", "2026-10-02T10:00:00Z b", "2026-10-03T10:00:00Z a"},
+		},
+		{
+			name:     "time range",
+			query:    Query{From: at("2026-10-01T11:00:00Z"), To: at("2026-10-02T10:00:00Z")},
+			expected: []string{"2026-10-01T12:00:00Z b", "2026-10-02T10:00:00Z b"},
+		},
+		{
+			name:     "sensor",
+			query:    Query{Sensor: "a"},
+			expected: []string{"2026-10-01T10:00:00Z a", "2026-10-03T10:00:00Z a"},
+		},
+		{
+			name: "bounds",
+			query: Query{Bounds: &geocoder.Bounds{
+				SouthWest: geocoder.Point{Lat: 41, Lng: 2},
+				NorthEast: geocoder.Point{Lat: 42, Lng: 3},
+			}},
+			expected: []string{"2026-10-01T10:00:00Z b", "2026-10-01T12:00:00Z b", "2026-10-02T10:00:00Z b"},
+		},
+		{
+			name:      "limit within a day",
+			query:     Query{Limit: 2},
+			expected:  []string{"2026-10-01T10:00:00Z a", "2026-10-01T10:00:00Z b"},
+			truncated: true,
+		},
+		{
+			name:      "limit at the end of a day with more days",
+			query:     Query{Limit: 3},
+			expected:  []string{"2026-10-01T10:00:00Z a", "2026-10-01T10:00:00Z b", "2026-10-01T12:00:00Z b"},
+			truncated: true,
+		},
+		{
+			name:     "limit at the end of a day without more matches",
+			query:    Query{Limit: 2, Sensor: "a", To: at("2026-10-02T23:00:00Z")},
+			expected: []string{"2026-10-01T10:00:00Z a"},
+		},
+		{
+			name:     "limit reached exactly by the last point",
+			query:    Query{Limit: 5},
+			expected: []string{"2026-10-01T10:00:00Z a", "2026-10-01T10:00:00Z b", "2026-10-01T12:00:00Z b", "2026-10-02T10:00:00Z b", "2026-10-03T10:00:00Z a"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			points, truncated, err := st.Points("series", tc.query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := []string{}
+			for _, p := range points {
+				got = append(got, p.Time.Format(time.RFC3339)+" "+p.Sensor)
+			}
+			if len(got) != len(tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, got)
+			}
+			for i := range got {
+				if got[i] != tc.expected[i] {
+					t.Errorf("expected %v, got %v", tc.expected, got)
+					break
+				}
+			}
+			if truncated != tc.truncated {
+				t.Errorf("expected truncated %v, got %v", tc.truncated, truncated)
+			}
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	testCases := []struct {
+		name    string
+		before  string
+		removed int
+		left    int
+	}{
+		{"nothing older", "2026-09-30T00:00:00Z", 0, 3},
+		{"day still in range is kept", "2026-10-01T23:00:00Z", 0, 3},
+		{"days that ended", "2026-10-02T00:00:00Z", 1, 2},
+		{"every day", "2026-10-04T00:00:00Z", 3, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			st, dir := tempStore(t)
+			defer os.RemoveAll(dir)
+
+			batch := []Point{
+				point("2026-10-01T10:00:00Z", "a", 0, 0),
+				point("2026-10-02T10:00:00Z", "a", 0, 0),
+				point("2026-10-03T10:00:00Z", "a", 0, 0),
+			}
+			if _, err := st.Append("series", batch); err != nil {
+				t.Fatal(err)
+			}
+
+			before, _ := time.Parse(time.RFC3339, tc.before)
+			removed, err := st.Prune("series", before)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if removed != tc.removed {
+				t.Errorf("expected %d removed, got %d", tc.removed, removed)
+			}
+
+			points, _, _ := st.Points("series", Query{})
+			if len(points) != tc.left {
+				t.Errorf("expected %d points left, got %d", tc.left, len(points))
+			}
+
+			// pruned days accept their points again
+			added, err := st.Append("series", batch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if added != tc.removed {
+				t.Errorf("expected %d added again, got %d", tc.removed, added)
+			}
+		})
+	}
+}
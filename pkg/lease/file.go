@@ -0,0 +1,92 @@
+package lease
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// File is a Lease kept in a directory, every change is made holding an
+// exclusive lock on a file in it. Replicas on one host, or sharing a
+// filesystem with working locks, can use it; their clocks must agree.
+type File struct {
+	dir string
+}
+
+// NewFile returns a Lease kept in dir, creating it if needed
+func NewFile(dir string) (*File, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &File{dir: dir}, nil
+}
+
+// Renew implements Lease
+func (f *File) Renew(ctx context.Context, holder string, ttl time.Duration) (string, error) {
+	var leader string
+	err := f.update(func(s *state) {
+		s.renew(holder, ttl, time.Now())
+		leader = s.Leader
+	})
+	return leader, err
+}
+
+// Leave implements Lease
+func (f *File) Leave(ctx context.Context, holder string) (int, error) {
+	var remaining int
+	err := f.update(func(s *state) {
+		remaining = s.leave(holder, time.Now())
+	})
+	return remaining, err
+}
+
+// update changes the state holding the lock, the state file is replaced by a
+// renamed temporary file so it's never seen half written
+func (f *File) update(fn func(s *state)) error {
+	lock, err := os.OpenFile(filepath.Join(f.dir, "lease.lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	if err := lockFile(lock); err != nil {
+		return err
+	}
+	defer unlockFile(lock)
+
+	path := filepath.Join(f.dir, "lease.json")
+	s := &state{}
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, s); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	fn(s)
+
+	b, err = json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(f.dir, ".lease")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
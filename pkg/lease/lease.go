@@ -0,0 +1,61 @@
+// Package lease elects a leader among the replicas of the gateway, and keeps
+// track of the replicas alive, through a lease kept in a store they share
+package lease
+
+import (
+	"context"
+	"time"
+)
+
+// Lease is the store shared by the replicas. Holders are replica ids, unique
+// among the replicas.
+type Lease interface {
+	// Renew records holder as alive for ttl, and makes it the leader for ttl
+	// when the lease is free, expired or already held by it. It returns the
+	// leader.
+	Renew(ctx context.Context, holder string, ttl time.Duration) (string, error)
+
+	// Leave forgets holder, releasing the lease if it holds it, and returns
+	// how many other replicas are alive
+	Leave(ctx context.Context, holder string) (int, error)
+}
+
+// state is what a lease keeps
+type state struct {
+	Leader   string               `json:"leader"`
+	Expires  time.Time            `json:"expires"`
+	Replicas map[string]time.Time `json:"replicas"`
+}
+
+// renew applies Renew to s at now
+func (s *state) renew(holder string, ttl time.Duration, now time.Time) {
+	s.prune(now)
+	s.Replicas[holder] = now.Add(ttl)
+	if s.Leader == "" || s.Leader == holder || now.After(s.Expires) {
+		s.Leader = holder
+		s.Expires = now.Add(ttl)
+	}
+}
+
+// leave applies Leave to s at now
+func (s *state) leave(holder string, now time.Time) int {
+	delete(s.Replicas, holder)
+	if s.Leader == holder {
+		s.Leader = ""
+		s.Expires = time.Time{}
+	}
+	s.prune(now)
+	return len(s.Replicas)
+}
+
+// prune forgets the replicas that stopped renewing
+func (s *state) prune(now time.Time) {
+	if s.Replicas == nil {
+		s.Replicas = map[string]time.Time{}
+	}
+	for holder, expires := range s.Replicas {
+		if now.After(expires) {
+			delete(s.Replicas, holder)
+		}
+	}
+}
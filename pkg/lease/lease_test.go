@@ -0,0 +1,179 @@
+package lease
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestState(t *testing.T) {
+	ttl := 10 * time.Second
+
+	// steps are renew:<holder>@<secs> or leave:<holder>@<secs>, each checked
+	// against the leader or, for leave, the replicas remaining
+	type step struct {
+		op       string
+		expected string
+	}
+	testCases := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "first replica acquires it",
+			steps: []step{
+				{"renew:a@0", "a"},
+				{"renew:b@1", "a"},
+			},
+		},
+		{
+			name: "leader keeps it while renewing",
+			steps: []step{
+				{"renew:a@0", "a"},
+				{"renew:b@1", "a"},
+				{"renew:a@9", "a"},
+				{"renew:b@11", "a"},
+				{"renew:a@18", "a"},
+			},
+		},
+		{
+			name: "taken over once expired",
+			steps: []step{
+				{"renew:a@0", "a"},
+				{"renew:b@5", "a"},
+				{"renew:b@10", "a"},
+				{"renew:b@11", "b"},
+				{"renew:a@12", "b"},
+			},
+		},
+		{
+			name: "released on leave",
+			steps: []step{
+				{"renew:a@0", "a"},
+				{"renew:b@1", "a"},
+				{"leave:a@2", "1"},
+				{"renew:b@3", "b"},
+			},
+		},
+		{
+			name: "crashed replicas don't count once expired",
+			steps: []step{
+				{"renew:a@0", "a"},
+				{"renew:b@1", "a"},
+				{"leave:a@5", "1"},
+				{"renew:c@20", "c"},
+				{"leave:c@21", "0"},
+			},
+		},
+		{
+			name: "last replica leaving",
+			steps: []step{
+				{"renew:a@0", "a"},
+				{"leave:a@1", "0"},
+			},
+		},
+	}
+
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &state{}
+			for _, st := range tc.steps {
+				var op, holder string
+				var secs int
+				fmt.Sscanf(strings.NewReplacer(":", " ", "@", " ").Replace(st.op), "%s %s %d", &op, &holder, &secs)
+				now := start.Add(time.Duration(secs) * time.Second)
+
+				got := ""
+				switch op {
+				case "renew":
+					s.renew(holder, ttl, now)
+					got = s.Leader
+				case "leave":
+					got = fmt.Sprint(s.leave(holder, now))
+				}
+				if got != st.expected {
+					t.Fatalf("%s: expected %s, got %s", st.op, st.expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	replicas := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+
+	// replicas racing for the lease, each with its own File as if they were
+	// different processes, agree on a single leader
+	leaders := make([]string, len(replicas))
+	wg := sync.WaitGroup{}
+	for i, r := range replicas {
+		wg.Add(1)
+		go func(i int, r string) {
+			defer wg.Done()
+			f, err := NewFile(dir)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for n := 0; n < 5; n++ {
+				if leaders[i], err = f.Renew(ctx, r, time.Minute); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i, r)
+	}
+	wg.Wait()
+
+	f, err := NewFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader, err := f.Renew(ctx, leaders[0], time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, l := range leaders {
+		if l != leader {
+			t.Errorf("replica %s sees leader %s, expected %s", replicas[i], l, leader)
+		}
+	}
+
+	// every replica leaves, the count goes down to zero
+	remaining := len(replicas)
+	for _, r := range replicas {
+		n, err := f.Leave(ctx, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remaining--
+		if n != remaining {
+			t.Errorf("%s left, expected %d remaining, got %d", r, remaining, n)
+		}
+	}
+
+	// the lease is free again
+	if leader, err := f.Renew(ctx, "z", time.Minute); err != nil || leader != "z" {
+		t.Errorf("expected z to lead, got %s %v", leader, err)
+	}
+
+	tmps, _ := ioutil.ReadDir(dir)
+	for _, tmp := range tmps {
+		if strings.HasPrefix(tmp.Name(), ".lease") {
+			t.Errorf("temporary file left behind: %s", tmp.Name())
+		}
+	}
+}
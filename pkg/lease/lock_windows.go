@@ -0,0 +1,18 @@
+//go:build windows
+
+package lease
+
+import (
+	"errors"
+	"os"
+)
+
+var errUnsupported = errors.New("file leases aren't supported on windows")
+
+func lockFile(f *os.File) error {
+	return errUnsupported
+}
+
+func unlockFile(f *os.File) error {
+	return errUnsupported
+}
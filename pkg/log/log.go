@@ -1,31 +1,173 @@
 package log
 
 import (
+	"context"
+	"errors"
+	"io"
 	"log"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	kitlog "github.com/go-kit/kit/log"
 	"github.com/go-stack/stack"
 )
 
-var logger kitlog.Logger
-var df = kitlog.Caller(4)
+// Level of a log line
+type Level int32
+
+const (
+	// DebugLevel is for detailed troubleshooting information
+	DebugLevel Level = iota
+	// InfoLevel is for normal operation, the default threshold
+	InfoLevel
+	// WarnLevel is for unexpected but handled situations
+	WarnLevel
+	// ErrorLevel is for failures
+	ErrorLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// ParseLevel returns the Level called name
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return DebugLevel, nil
+	case "info", "":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	default:
+		return InfoLevel, errors.New("unknown log level " + name)
+	}
+}
+
+var (
+	mu     sync.RWMutex
+	logger kitlog.Logger
+
+	threshold = int32(InfoLevel)
+
+	// every exported function goes through write, so the caller is always at
+	// the same depth
+	df = kitlog.Caller(5)
+)
 
 func init() {
-	logger = kitlog.NewJSONLogger(kitlog.NewSyncWriter(os.Stdout))
-	logger = kitlog.With(logger, "ts", kitlog.DefaultTimestampUTC, "caller", df)
+	logger = newLogger("json", os.Stdout)
+}
+
+func newLogger(format string, w io.Writer) kitlog.Logger {
+	var l kitlog.Logger
+	if format == "logfmt" {
+		l = kitlog.NewLogfmtLogger(kitlog.NewSyncWriter(w))
+	} else {
+		l = kitlog.NewJSONLogger(kitlog.NewSyncWriter(w))
+	}
+	return kitlog.With(l, "ts", kitlog.DefaultTimestampUTC, "caller", df)
+}
+
+// SetFormat switches the output between json, the default, and logfmt
+func SetFormat(format string) error {
+	if format != "json" && format != "logfmt" {
+		return errors.New("unknown log format " + format)
+	}
+	mu.Lock()
+	logger = newLogger(format, os.Stdout)
+	mu.Unlock()
+	return nil
+}
+
+// SetLevel changes the minimum level written, it's safe to call at any time
+func SetLevel(l Level) {
+	atomic.StoreInt32(&threshold, int32(l))
+}
+
+// GetLevel returns the minimum level written
+func GetLevel() Level {
+	return Level(atomic.LoadInt32(&threshold))
 }
 
-// Log wrapper for log
+// Log wrapper for log, lines with an error key are logged at error level and
+// the rest at info level
 func Log(keyvals ...interface{}) {
-	logger.Log(keyvals...)
+	write(context.Background(), levelOf(keyvals), keyvals)
+}
+
+// LogContext logs like Log adding the request id found in ctx
+func LogContext(ctx context.Context, keyvals ...interface{}) {
+	write(ctx, levelOf(keyvals), keyvals)
+}
+
+// Debug logs at debug level
+func Debug(ctx context.Context, keyvals ...interface{}) {
+	write(ctx, DebugLevel, keyvals)
+}
+
+// Info logs at info level
+func Info(ctx context.Context, keyvals ...interface{}) {
+	write(ctx, InfoLevel, keyvals)
+}
+
+// Warn logs at warn level
+func Warn(ctx context.Context, keyvals ...interface{}) {
+	write(ctx, WarnLevel, keyvals)
+}
+
+// Error logs at error level
+func Error(ctx context.Context, keyvals ...interface{}) {
+	write(ctx, ErrorLevel, keyvals)
 }
 
 // Fatal
 func Fatal(v ...interface{}) {
-	log.Fatal(v...)
+	log.Fatal(redactAll(v)...)
 }
 
 func Caller(depth int) func() interface{} {
 	return func() interface{} { return stack.Caller(depth) }
 }
+
+func write(ctx context.Context, level Level, keyvals []interface{}) {
+	if level < GetLevel() {
+		return
+	}
+
+	kv := make([]interface{}, 0, len(keyvals)+4)
+	kv = append(kv, "level", level.String())
+	if id := RequestID(ctx); id != "" {
+		kv = append(kv, "requestId", id)
+	}
+	kv = append(kv, redact(keyvals)...)
+
+	mu.RLock()
+	l := logger
+	mu.RUnlock()
+
+	l.Log(kv...)
+}
+
+// levelOf returns the level of a Log call
+func levelOf(keyvals []interface{}) Level {
+	for i := 0; i < len(keyvals); i += 2 {
+		if keyvals[i] == "error" {
+			return ErrorLevel
+		}
+	}
+	return InfoLevel
+}
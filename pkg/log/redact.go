@@ -0,0 +1,89 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// minSecretLength is the shortest value Redact accepts, shorter values would
+// mangle every log line and can't be much of a secret anyway
+const minSecretLength = 4
+
+// secrets holds values that must never be written to the log
+var secrets struct {
+	sync.RWMutex
+	replacer *strings.Replacer
+	values   []string
+}
+
+// Redact registers secret values, every occurrence of them in a logged string
+// or error is replaced by [REDACTED]
+func Redact(values ...string) {
+	secrets.Lock()
+	defer secrets.Unlock()
+
+	for _, v := range values {
+		if len(v) >= minSecretLength {
+			secrets.values = append(secrets.values, v, "[REDACTED]")
+		}
+	}
+	secrets.replacer = strings.NewReplacer(secrets.values...)
+}
+
+// redact replaces the registered secrets found in the values of keyvals, keys
+// are left as they are
+func redact(keyvals []interface{}) []interface{} {
+	r := currentReplacer()
+	if r == nil {
+		return keyvals
+	}
+
+	out := make([]interface{}, len(keyvals))
+	for i, v := range keyvals {
+		if i%2 == 0 {
+			out[i] = v
+			continue
+		}
+		out[i] = redactValue(r, v)
+	}
+	return out
+}
+
+// redactAll replaces the registered secrets found in every value
+func redactAll(values []interface{}) []interface{} {
+	r := currentReplacer()
+	if r == nil {
+		return values
+	}
+
+	out := make([]interface{}, len(values))
+	for i, v := range values {
+		out[i] = redactValue(r, v)
+	}
+	return out
+}
+
+func currentReplacer() *strings.Replacer {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	return secrets.replacer
+}
+
+// redactValue replaces secrets in string, error and Stringer values,
+// json.Marshaler values are left to marshal themselves
+func redactValue(r *strings.Replacer, v interface{}) interface{} {
+	switch x := v.(type) {
+	case string:
+		return r.Replace(x)
+	case error:
+		return r.Replace(x.Error())
+	case json.Marshaler:
+		return v
+	case fmt.Stringer:
+		return r.Replace(x.String())
+	default:
+		return v
+	}
+}
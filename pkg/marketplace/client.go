@@ -0,0 +1,185 @@
+package marketplace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RemoteOffering is an offering as registered on the marketplace
+type RemoteOffering struct {
+	ID             string
+	Name           string
+	Active         bool
+	ExpirationTime time.Time
+}
+
+// Client queries the marketplace for what the bigiot SDK doesn't cover,
+// i.e. the offerings already registered by a provider
+type Client struct {
+	baseURL    string
+	id         string
+	secret     string
+	httpClient *http.Client
+
+	mu    sync.Mutex
+	token string
+}
+
+// NewClient returns a Client for the provider id, httpClient can be nil
+func NewClient(marketplaceURL, id, secret string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Client{
+		baseURL:    strings.TrimRight(marketplaceURL, "/"),
+		id:         id,
+		secret:     secret,
+		httpClient: httpClient,
+	}
+}
+
+// Offerings returns every offering of the provider, authenticating first if
+// needed
+func (c *Client) Offerings(ctx context.Context) ([]RemoteOffering, error) {
+	query := fmt.Sprintf(`query providerOfferings { provider(id: "%s") { id offerings { id name activation { status expirationTime } } } }`, c.id)
+
+	body, err := c.query(ctx, query)
+	if err == errUnauthorized {
+		// the access token may have expired, try once more with a new one
+		c.mu.Lock()
+		c.token = ""
+		c.mu.Unlock()
+		body, err = c.query(ctx, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp := struct {
+		Data struct {
+			Provider *struct {
+				Offerings []struct {
+					ID         string `json:"id"`
+					Name       string `json:"name"`
+					Activation struct {
+						Status         bool  `json:"status"`
+						ExpirationTime int64 `json:"expirationTime"`
+					} `json:"activation"`
+				} `json:"offerings"`
+			} `json:"provider"`
+		} `json:"data"`
+	}{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Data.Provider == nil {
+		return nil, fmt.Errorf("provider %s not found on the marketplace", c.id)
+	}
+
+	offerings := []RemoteOffering{}
+	for _, o := range resp.Data.Provider.Offerings {
+		offerings = append(offerings, RemoteOffering{
+			ID:             o.ID,
+			Name:           o.Name,
+			Active:         o.Activation.Status,
+			ExpirationTime: time.Unix(0, o.Activation.ExpirationTime*int64(time.Millisecond)).UTC(),
+		})
+	}
+	return offerings, nil
+}
+
+var errUnauthorized = errors.New("marketplace: unauthorized")
+
+func (c *Client) query(ctx context.Context, query string) ([]byte, error) {
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(map[string]string{"query": query})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+"/graphql", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, errUnauthorized
+	}
+
+	errResp := struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}{}
+	if json.Unmarshal(body, &errResp) == nil && len(errResp.Errors) > 0 {
+		return nil, errors.New("marketplace: " + errResp.Errors[0].Message)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("marketplace: status Code: %d received", resp.StatusCode)
+	}
+
+	return body, nil
+}
+
+// accessToken returns the cached access token or gets a new one
+func (c *Client) accessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" {
+		return c.token, nil
+	}
+
+	params := url.Values{
+		"clientId":     []string{c.id},
+		"clientSecret": []string{c.secret},
+	}
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+"/accessToken?"+params.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/plain")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("marketplace authentication: " + strings.TrimSpace(string(body)))
+	}
+
+	c.token = string(body)
+	return c.token, nil
+}
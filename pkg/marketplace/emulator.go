@@ -0,0 +1,417 @@
+package marketplace
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Offering is an offering registered on the Emulator
+type Offering struct {
+	ID             string    `json:"id"`
+	ProviderID     string    `json:"providerId"`
+	LocalID        string    `json:"localId"`
+	Name           string    `json:"name"`
+	Category       string    `json:"category"`
+	Active         bool      `json:"active"`
+	ExpirationTime time.Time `json:"expirationTime"`
+	// Query is the addOffering mutation that last registered the offering
+	Query string `json:"query"`
+}
+
+// Mutation is a GraphQL mutation received by the Emulator
+type Mutation struct {
+	Name       string    `json:"name"`
+	ProviderID string    `json:"providerId"`
+	OfferingID string    `json:"offeringId"`
+	Query      string    `json:"query"`
+	Error      string    `json:"error,omitempty"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+// Emulator is an in memory BIG IoT marketplace implementing the endpoints
+// used by providers: /accessToken, the addOffering, activateOffering and
+// deleteOffering mutations and the provider query listing its offerings.
+// Providers are registered the first time they ask for an access token. It's
+// safe for concurrent use.
+type Emulator struct {
+	mu        sync.Mutex
+	secrets   map[string]string
+	tokens    map[string]string
+	offerings map[string]*Offering
+	mutations []Mutation
+}
+
+// NewEmulator returns an empty Emulator
+func NewEmulator() *Emulator {
+	return &Emulator{
+		secrets:   map[string]string{},
+		tokens:    map[string]string{},
+		offerings: map[string]*Offering{},
+	}
+}
+
+// AddProvider registers a provider, otherwise a provider is registered with
+// the secret it first authenticates with
+func (e *Emulator) AddProvider(id, secret string) {
+	e.mu.Lock()
+	e.secrets[id] = secret
+	e.mu.Unlock()
+}
+
+// Offerings returns the registered offerings sorted by ID
+func (e *Emulator) Offerings() []Offering {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	offerings := make([]Offering, 0, len(e.offerings))
+	for _, o := range e.offerings {
+		offerings = append(offerings, *o)
+	}
+	sort.Slice(offerings, func(i, j int) bool { return offerings[i].ID < offerings[j].ID })
+	return offerings
+}
+
+// Mutations returns the mutations received so far, oldest first
+func (e *Emulator) Mutations() []Mutation {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Mutation{}, e.mutations...)
+}
+
+// Reset forgets every offering and mutation, registered providers are kept
+func (e *Emulator) Reset() {
+	e.mu.Lock()
+	e.offerings = map[string]*Offering{}
+	e.mutations = nil
+	e.mu.Unlock()
+}
+
+// MintToken returns a consumer token for a registered offering, signed with
+// the secret of its provider as the marketplace does
+func (e *Emulator) MintToken(offeringID, subscriberID string, ttl time.Duration) (string, error) {
+	e.mu.Lock()
+	o, ok := e.offerings[offeringID]
+	var secret string
+	if ok {
+		secret = e.secrets[o.ProviderID]
+	}
+	e.mu.Unlock()
+
+	if !ok {
+		return "", fmt.Errorf("unknown offering %s", offeringID)
+	}
+	return Token(secret, offeringID, subscriberID, ttl)
+}
+
+// Token returns a consumer token for an offering signed with a provider
+// secret, which is base64 encoded as issued by the marketplace
+func Token(providerSecret, offeringID, subscriberID string, ttl time.Duration) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(providerSecret)
+	if err != nil {
+		return "", errors.New("provider secret isn't base64 encoded")
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: key}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := struct {
+		jwt.Claims
+		SubscribableID string `json:"subscribableId"`
+		SubscriberID   string `json:"subscriberId"`
+	}{
+		Claims: jwt.Claims{
+			IssuedAt: jwt.NewNumericDate(now),
+			Expiry:   jwt.NewNumericDate(now.Add(ttl)),
+		},
+		SubscribableID: offeringID,
+		SubscriberID:   subscriberID,
+	}
+
+	return jwt.Signed(signer).Claims(claims).CompactSerialize()
+}
+
+// ServeHTTP implements the marketplace endpoints plus a few under /emulator
+// to inspect its state:
+//
+//	GET  /emulator/offerings  registered offerings
+//	GET  /emulator/mutations  mutations received
+//	POST /emulator/token      consumer token, needs offering and optionally
+//	                          subscriber and ttl (i.e. 1h) parameters
+//	POST /emulator/reset      forgets every offering and mutation
+func (e *Emulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/accessToken" && r.Method == http.MethodGet:
+		e.accessToken(w, r)
+	case r.URL.Path == "/graphql" && r.Method == http.MethodPost:
+		e.graphql(w, r)
+	case r.URL.Path == "/emulator/offerings" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, e.Offerings())
+	case r.URL.Path == "/emulator/mutations" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, e.Mutations())
+	case r.URL.Path == "/emulator/token" && r.Method == http.MethodPost:
+		e.token(w, r)
+	case r.URL.Path == "/emulator/reset" && r.Method == http.MethodPost:
+		e.Reset()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (e *Emulator) accessToken(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("clientId")
+	secret := r.URL.Query().Get("clientSecret")
+	if id == "" || secret == "" {
+		http.Error(w, "missing client credentials", http.StatusBadRequest)
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if known, ok := e.secrets[id]; ok && known != secret {
+		http.Error(w, "invalid client credentials", http.StatusUnauthorized)
+		return
+	}
+	e.secrets[id] = secret
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	e.tokens[token] = id
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(token))
+}
+
+func (e *Emulator) token(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	ttl := time.Hour
+	if v := q.Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+
+	token, err := e.MintToken(q.Get("offering"), q.Get("subscriber"), ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(token))
+}
+
+var (
+	mutationRe   = regexp.MustCompile(`^\s*mutation\s+(\w+)`)
+	queryRe      = regexp.MustCompile(`^\s*(?:query\s*\w*\s*)?{\s*provider\s*\(\s*id:\s*"([^"]*)"`)
+	idRe         = regexp.MustCompile(`input:\s*{\s*id:\s*"([^"]*)"`)
+	localIDRe    = regexp.MustCompile(`localId:\s*"([^"]*)"`)
+	nameRe       = regexp.MustCompile(`name:\s*"([^"]*)"`)
+	rdfURIRe     = regexp.MustCompile(`rdfUri:\s*"([^"]*)"`)
+	activationRe = regexp.MustCompile(`activation:\s*{\s*status:\s*(true|false),\s*expirationTime:\s*(\d+)`)
+	expirationRe = regexp.MustCompile(`expirationTime:\s*(\d+)`)
+)
+
+func (e *Emulator) graphql(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	providerID, ok := e.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid access token")
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	q := struct {
+		Query string `json:"query"`
+	}{}
+	if err := json.Unmarshal(body, &q); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if match := queryRe.FindStringSubmatch(q.Query); match != nil {
+		e.query(w, providerID, match[1])
+		return
+	}
+
+	m := Mutation{ProviderID: providerID, Query: q.Query, ReceivedAt: time.Now().UTC()}
+	if match := mutationRe.FindStringSubmatch(q.Query); match != nil {
+		m.Name = match[1]
+	}
+
+	status, result, err := e.mutate(&m)
+	if err != nil {
+		m.Error = err.Error()
+		e.mutations = append(e.mutations, m)
+		writeError(w, status, err.Error())
+		return
+	}
+	e.mutations = append(e.mutations, m)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{m.Name: result},
+	})
+}
+
+// query answers the provider query listing its offerings, the only query
+// supported. It must be called with the lock held.
+func (e *Emulator) query(w http.ResponseWriter, providerID, id string) {
+	if id != providerID {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("provider %s can't query %s", providerID, id))
+		return
+	}
+
+	ids := []string{}
+	for oid, o := range e.offerings {
+		if o.ProviderID == id {
+			ids = append(ids, oid)
+		}
+	}
+	sort.Strings(ids)
+
+	offerings := []map[string]interface{}{}
+	for _, oid := range ids {
+		offerings = append(offerings, offeringResult(e.offerings[oid]))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]interface{}{
+			"provider": map[string]interface{}{
+				"id":        id,
+				"offerings": offerings,
+			},
+		},
+	})
+}
+
+// mutate applies a mutation, it must be called with the lock held
+func (e *Emulator) mutate(m *Mutation) (int, interface{}, error) {
+	id := submatch(idRe, m.Query)
+
+	switch m.Name {
+	case "addOffering":
+		if id != m.ProviderID {
+			return http.StatusForbidden, nil, fmt.Errorf("provider %s can't add offerings for %s", m.ProviderID, id)
+		}
+		localID := submatch(localIDRe, m.Query)
+		if localID == "" {
+			return http.StatusBadRequest, nil, errors.New("missing localId")
+		}
+
+		o := &Offering{
+			ID:         id + "-" + localID,
+			ProviderID: id,
+			LocalID:    localID,
+			Name:       submatch(nameRe, m.Query),
+			Category:   submatch(rdfURIRe, m.Query),
+			Query:      m.Query,
+		}
+		if match := activationRe.FindStringSubmatch(m.Query); match != nil {
+			o.Active = match[1] == "true"
+			o.ExpirationTime = epochMs(match[2])
+		}
+		e.offerings[o.ID] = o
+		m.OfferingID = o.ID
+
+		return http.StatusOK, offeringResult(o), nil
+
+	case "activateOffering":
+		o, err := e.owned(m, id)
+		if err != nil {
+			return http.StatusNotFound, nil, err
+		}
+		o.Active = true
+		o.ExpirationTime = epochMs(submatch(expirationRe, m.Query))
+
+		return http.StatusOK, offeringResult(o), nil
+
+	case "deleteOffering":
+		o, err := e.owned(m, id)
+		if err != nil {
+			return http.StatusNotFound, nil, err
+		}
+		delete(e.offerings, o.ID)
+
+		return http.StatusOK, map[string]interface{}{"id": o.ID}, nil
+
+	default:
+		return http.StatusBadRequest, nil, fmt.Errorf("unsupported operation %q", m.Name)
+	}
+}
+
+// owned returns an offering of the provider sending m
+func (e *Emulator) owned(m *Mutation, id string) (*Offering, error) {
+	m.OfferingID = id
+	o, ok := e.offerings[id]
+	if !ok || o.ProviderID != m.ProviderID {
+		return nil, fmt.Errorf("offering %s not found", id)
+	}
+	return o, nil
+}
+
+func offeringResult(o *Offering) map[string]interface{} {
+	return map[string]interface{}{
+		"id":   o.ID,
+		"name": o.Name,
+		"activation": map[string]interface{}{
+			"status":         o.Active && o.ExpirationTime.After(time.Now()),
+			"expirationTime": o.ExpirationTime.UnixNano() / int64(time.Millisecond),
+		},
+	}
+}
+
+func submatch(re *regexp.Regexp, s string) string {
+	match := re.FindStringSubmatch(s)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+func epochMs(v string) time.Time {
+	ms, _ := strconv.ParseInt(v, 10, 64)
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError answers with a GraphQL error body, as parsed by the bigiot client
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]interface{}{
+		"errors": []map[string]string{{"message": msg}},
+	})
+}
@@ -0,0 +1,254 @@
+package marketplace
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thingful/bigiot"
+)
+
+var (
+	secretA = base64.StdEncoding.EncodeToString([]byte("supersecretkey-0123456789abcdef!"))
+	secretB = base64.StdEncoding.EncodeToString([]byte("othersecretkey-0123456789abcdef!"))
+)
+
+// emulatorEnv is an emulator with two providers authenticated through the
+// bigiot SDK
+type emulatorEnv struct {
+	emulator *Emulator
+	url      string
+	a, b     *bigiot.Provider
+}
+
+func newEmulatorEnv(t *testing.T) (*emulatorEnv, func()) {
+	e := NewEmulator()
+	e.AddProvider("Org-A", secretA)
+	e.AddProvider("Org-B", secretB)
+	srv := httptest.NewServer(e)
+
+	env := &emulatorEnv{emulator: e, url: srv.URL}
+	env.a = newProvider(t, srv.URL, "Org-A", secretA)
+	env.b = newProvider(t, srv.URL, "Org-B", secretB)
+
+	return env, srv.Close
+}
+
+func newProvider(t *testing.T, url, id, secret string) *bigiot.Provider {
+	p, err := bigiot.NewProvider(id, secret, bigiot.WithMarketplace(url))
+	if err != nil {
+		t.Fatalf("unexpected error creating provider %s: %v", id, err)
+	}
+	if err := p.Authenticate(); err != nil {
+		t.Fatalf("unexpected error authenticating %s: %v", id, err)
+	}
+	return p
+}
+
+func register(t *testing.T, p *bigiot.Provider, localID string, activation *bigiot.Activation) *bigiot.Offering {
+	o, err := p.RegisterOffering(context.Background(), &bigiot.OfferingDescription{
+		LocalID:    localID,
+		Name:       "Parking " + localID,
+		Category:   "urn:big-iot:ParkingSpaceCategory",
+		Activation: activation,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error registering %s: %v", localID, err)
+	}
+	return o
+}
+
+func find(e *Emulator, id string) *Offering {
+	for _, o := range e.Offerings() {
+		if o.ID == id {
+			return &o
+		}
+	}
+	return nil
+}
+
+func TestEmulatorWithSDK(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		name string
+		run  func(t *testing.T, env *emulatorEnv)
+	}{
+		{
+			name: "register names the offering after provider and localId",
+			run: func(t *testing.T, env *emulatorEnv) {
+				o := register(t, env.a, "parking", &bigiot.Activation{Status: true, Duration: time.Hour})
+				if o.ID != "Org-A-parking" {
+					t.Errorf("expected id Org-A-parking, got %s", o.ID)
+				}
+				if o.Name != "Parking parking" || !o.Activation.Status {
+					t.Errorf("unexpected offering %+v", o)
+				}
+
+				got := find(env.emulator, "Org-A-parking")
+				if got == nil {
+					t.Fatal("offering not stored")
+				}
+				if got.ProviderID != "Org-A" || got.LocalID != "parking" || got.Category != "urn:big-iot:ParkingSpaceCategory" {
+					t.Errorf("unexpected stored offering %+v", got)
+				}
+				if d := time.Until(got.ExpirationTime); d < 59*time.Minute || d > time.Hour {
+					t.Errorf("expected expiration in about an hour, got %s", d)
+				}
+			},
+		},
+		{
+			name: "register again replaces the offering",
+			run: func(t *testing.T, env *emulatorEnv) {
+				register(t, env.a, "parking", &bigiot.Activation{Status: true, Duration: time.Hour})
+				register(t, env.a, "parking", &bigiot.Activation{Status: false, Duration: time.Hour})
+
+				offerings := env.emulator.Offerings()
+				if len(offerings) != 1 || offerings[0].Active {
+					t.Errorf("expected a single inactive offering, got %+v", offerings)
+				}
+			},
+		},
+		{
+			name: "activate renews an expired offering",
+			run: func(t *testing.T, env *emulatorEnv) {
+				o := register(t, env.a, "parking", &bigiot.Activation{Status: true, ExpirationTime: time.Now().Add(-time.Minute)})
+				if o.Activation.Status {
+					t.Error("expected an expired offering to be reported inactive")
+				}
+
+				o, err := env.a.ActivateOffering(ctx, &bigiot.ActivateOffering{ID: o.ID, Duration: time.Hour})
+				if err != nil {
+					t.Fatalf("unexpected error activating: %v", err)
+				}
+				if !o.Activation.Status {
+					t.Error("expected offering to be active")
+				}
+				if got := find(env.emulator, o.ID); got == nil || !got.ExpirationTime.After(time.Now()) {
+					t.Errorf("expected expiration in the future, got %+v", got)
+				}
+			},
+		},
+		{
+			name: "delete removes the offering",
+			run: func(t *testing.T, env *emulatorEnv) {
+				o := register(t, env.a, "parking", nil)
+
+				if err := env.a.DeleteOffering(ctx, &bigiot.DeleteOffering{ID: o.ID}); err != nil {
+					t.Fatalf("unexpected error deleting: %v", err)
+				}
+				if find(env.emulator, o.ID) != nil {
+					t.Error("expected offering to be deleted")
+				}
+				if err := env.a.DeleteOffering(ctx, &bigiot.DeleteOffering{ID: o.ID}); err == nil {
+					t.Error("expected error deleting a missing offering")
+				}
+			},
+		},
+		{
+			name: "another provider's offering can't be changed",
+			run: func(t *testing.T, env *emulatorEnv) {
+				o := register(t, env.a, "parking", &bigiot.Activation{Status: true, Duration: time.Hour})
+
+				err := env.b.DeleteOffering(ctx, &bigiot.DeleteOffering{ID: o.ID})
+				if err == nil || !strings.Contains(err.Error(), "not found") {
+					t.Errorf("expected not found deleting, got %v", err)
+				}
+				_, err = env.b.ActivateOffering(ctx, &bigiot.ActivateOffering{ID: o.ID, Duration: time.Hour})
+				if err == nil || !strings.Contains(err.Error(), "not found") {
+					t.Errorf("expected not found activating, got %v", err)
+				}
+				if find(env.emulator, o.ID) == nil {
+					t.Error("expected offering to be kept")
+				}
+			},
+		},
+		{
+			name: "minted tokens validate with the provider secret",
+			run: func(t *testing.T, env *emulatorEnv) {
+				o := register(t, env.a, "parking", nil)
+
+				token, err := env.emulator.MintToken(o.ID, "Org-C-Consumer", time.Hour)
+				if err != nil {
+					t.Fatalf("unexpected error minting: %v", err)
+				}
+				offeringID, err := env.a.ValidateToken(token)
+				if err != nil {
+					t.Fatalf("unexpected error validating: %v", err)
+				}
+				if offeringID != o.ID {
+					t.Errorf("expected offering %s, got %s", o.ID, offeringID)
+				}
+				if _, err := env.b.ValidateToken(token); err == nil {
+					t.Error("expected error validating with another provider's secret")
+				}
+			},
+		},
+		{
+			name: "client lists only the provider's offerings",
+			run: func(t *testing.T, env *emulatorEnv) {
+				register(t, env.a, "parking", &bigiot.Activation{Status: true, Duration: time.Hour})
+				register(t, env.a, "weather", &bigiot.Activation{Status: false, Duration: time.Hour})
+				register(t, env.b, "parking", nil)
+
+				offerings, err := NewClient(env.url, "Org-A", secretA, nil).Offerings(ctx)
+				if err != nil {
+					t.Fatalf("unexpected error listing: %v", err)
+				}
+				active := map[string]bool{}
+				for _, o := range offerings {
+					active[o.ID] = o.Active
+				}
+				if len(active) != 2 || !active["Org-A-parking"] || active["Org-A-weather"] {
+					t.Errorf("unexpected offerings %+v", offerings)
+				}
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			env, done := newEmulatorEnv(t)
+			defer done()
+
+			tc.run(t, env)
+		})
+	}
+}
+
+func TestEmulatorAuthentication(t *testing.T) {
+	testCases := []struct {
+		name   string
+		id     string
+		secret string
+		ok     bool
+	}{
+		{"known provider", "Org-A", secretA, true},
+		{"wrong secret", "Org-A", secretB, false},
+		{"unknown provider", "Org-C", secretA, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := NewEmulator()
+			e.AddProvider("Org-A", secretA)
+			srv := httptest.NewServer(e)
+			defer srv.Close()
+
+			p, err := bigiot.NewProvider(tc.id, tc.secret, bigiot.WithMarketplace(srv.URL))
+			if err != nil {
+				t.Fatalf("unexpected error creating provider: %v", err)
+			}
+			err = p.Authenticate()
+			if tc.ok && err != nil {
+				t.Errorf("unexpected error authenticating: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Error("expected error authenticating")
+			}
+		})
+	}
+}
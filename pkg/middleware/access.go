@@ -0,0 +1,193 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/log"
+)
+
+// RequestIDHeader carries the correlation id of a request, it's read from
+// consumers and forwarded to pipes and the marketplace
+const RequestIDHeader = "X-Request-ID"
+
+type contextKey int
+
+const accessKey contextKey = iota
+
+// access collects what inner handlers know about a request so AccessLog can
+// include it
+type access struct {
+	mu         sync.Mutex
+	offering   string
+	subscriber string
+}
+
+// SetOffering records the offering requested, for the access log
+func SetOffering(ctx context.Context, id string) {
+	if a, ok := ctx.Value(accessKey).(*access); ok {
+		a.mu.Lock()
+		a.offering = id
+		a.mu.Unlock()
+	}
+}
+
+// SetSubscriber records the subscriber making the request, for the access log
+func SetSubscriber(ctx context.Context, id string) {
+	if a, ok := ctx.Value(accessKey).(*access); ok {
+		a.mu.Lock()
+		a.subscriber = id
+		a.mu.Unlock()
+	}
+}
+
+// RequestID uses the X-Request-ID sent by the consumer, or generates one, and
+// adds it to the request context and response headers
+func RequestID(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = log.NewRequestID()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(log.WithRequestID(r.Context(), id)))
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// validRequestID only accepts short printable ids, so consumers can't inject
+// anything into our logs or upstream headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// AccessLog writes a log line for every request once it has been served
+func AccessLog(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		a := &access{}
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), accessKey, a)))
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		log.Info(r.Context(),
+			"msg", "access",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"offering", a.offering,
+			"subscriber", a.subscriber,
+			"status", rw.status,
+			"bytes", rw.bytes,
+			"duration", time.Since(start).String(),
+		)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// responseWriter records the status and size of a response
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Flush lets streaming handlers flush through the recorder
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets websocket handlers take over the connection
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer can't be hijacked")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// RequestIDTransport forwards the request id found in the context of outgoing
+// requests
+type RequestIDTransport struct {
+	Proxied http.RoundTripper
+}
+
+// RoundTrip sets the X-Request-ID header and sends the request
+func (t RequestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	proxied := t.Proxied
+	if proxied == nil {
+		proxied = http.DefaultTransport
+	}
+
+	if id := log.RequestID(req.Context()); id != "" {
+		// RoundTrippers must not modify the request they are given
+		r := new(http.Request)
+		*r = *req
+		r.Header = make(http.Header, len(req.Header)+1)
+		for k, v := range req.Header {
+			r.Header[k] = v
+		}
+		r.Header.Set(RequestIDHeader, id)
+		req = r
+	}
+
+	return proxied.RoundTrip(req)
+}
+
+// tokenSubscriber returns the subscriberId claim of an already validated JWT
+func tokenSubscriber(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	claims := struct {
+		SubscriberID string `json:"subscriberId"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	return claims.SubscriberID
+}
@@ -6,69 +6,113 @@ import (
 	"strings"
 
 	"github.com/thingful/big-iot-gateway/pkg/log"
-	"github.com/thingful/bigiot"
+	"github.com/thingful/big-iot-gateway/pkg/trace"
+	gojimiddleware "goji.io/middleware"
 	"goji.io/pat"
 )
 
+// TokenValidator validates a token issued by the marketplace, returning the
+// id of the offering it grants access to. *bigiot.Provider implements it.
+type TokenValidator interface {
+	ValidateToken(token string) (string, error)
+}
+
 // authMiddleware is a middleware instance that exposes functionality to
 // validate incoming requests for the presence of a valid JWT provided by the
 // marketplace.
 type auth struct {
-	provider *bigiot.Provider
+	validator func(offeringID string) (TokenValidator, bool)
 }
 
-// NewAuth initializes our authMiddleware instance,
-// converting the string secret into a base64 byte slice. If this decoding fails
-// it returns an error, else the initialized middleware instance.
-func NewAuth(p *bigiot.Provider) (*auth, error) {
+// NewAuth initializes our authMiddleware instance. validator returns the
+// TokenValidator of the provider owning the requested offering, so tokens are
+// checked against the right provider secret, or false if the offering is
+// unknown.
+func NewAuth(validator func(offeringID string) (TokenValidator, bool)) (*auth, error) {
+	if validator == nil {
+		return nil, errors.New("auth needs a token validator")
+	}
 	return &auth{
-		provider: p,
+		validator: validator,
 	}, nil
 }
 
 func (a *auth) Handler(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
+		// the span only covers validation, it ends before calling next
+		ctx, span := trace.Start(r.Context(), "auth", trace.Internal)
+		defer span.End()
 
-		token, err := getToken(r)
+		offeringID := pat.Param(r, "offeringID")
+		token, err := getToken(r, streaming(r))
 		if err != nil {
+			span.SetError(err)
 			http.Error(w, "Missing Token", http.StatusBadRequest)
-			log.Log("error", "Unable to read token")
+			log.LogContext(ctx, "error", "Unable to read token")
+			return
+		}
+
+		log.Debug(ctx, "offeringID", offeringID)
+		SetOffering(ctx, offeringID)
+
+		validator, ok := a.validator(offeringID)
+		if !ok {
+			http.Error(w, "Not Found", http.StatusNotFound)
 			return
 		}
 
-		id, err := a.provider.ValidateToken(token)
+		id, err := validator.ValidateToken(token)
 		if err != nil {
+			span.SetError(err)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			log.Log("error", "non valid token")
+			log.LogContext(ctx, "error", "non valid token")
 			return
 		}
+		SetSubscriber(ctx, tokenSubscriber(token))
 
 		// we need to convert the full id into how we describe locally which is just the last part
 		idParts := strings.Split(id, "-")
 		if len(idParts) != 3 {
-			log.Log("error", "id does not have enough parts")
+			log.LogContext(ctx, "error", "id does not have enough parts")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
 		}
 
-		offeringID := pat.Param(r, "offeringID")
-		log.Log("debug-offeringID", offeringID)
-
 		if idParts[2] != offeringID {
-			log.Log("tokenID", idParts[2], "requestedID", offeringID, "error", "token id does not match requested")
+			log.LogContext(ctx, "tokenID", idParts[2], "requestedID", offeringID, "error", "token id does not match requested")
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		next.ServeHTTP(w, r.WithContext(ctx))
+		span.End()
+		next.ServeHTTP(w, r)
 	}
 
 	return http.HandlerFunc(fn)
 }
 
-// getToken extracts the token string from the request or returns an error
-func getToken(r *http.Request) (string, error) {
+// streaming tells whether r was routed to the SSE or WebSocket endpoint of
+// an offering, i.e. /:offeringID/stream or /:offeringID/ws
+func streaming(r *http.Request) bool {
+	p, ok := gojimiddleware.Pattern(r.Context()).(*pat.Pattern)
+	if !ok {
+		return false
+	}
+	route := p.String()
+	return strings.HasSuffix(route, "/stream") || strings.HasSuffix(route, "/ws")
+}
+
+// getToken extracts the token string from the request or returns an error.
+// Browsers can't set headers on EventSource and WebSocket requests, so for
+// those, with query, the access_token query param is read when there's no
+// Authorization header. Other consumers must send the header, tokens in urls
+// end up in proxy logs.
+func getToken(r *http.Request, query bool) (string, error) {
 	reqToken := r.Header.Get("Authorization")
 	if reqToken == "" {
+		if token := r.URL.Query().Get("access_token"); query && token != "" {
+			return token, nil
+		}
 		return "", errors.New("no auth token")
 	}
 	splitToken := strings.Split(reqToken, "Bearer")
@@ -81,3 +125,18 @@ func getToken(r *http.Request) (string, error) {
 	}
 	return strings.Replace(reqToken, " ", "", -1), nil
 }
+
+// RequireClientCert only lets through requests made with a client certificate
+// verified by the TLS listener
+func RequireClientCert(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			log.LogContext(r.Context(), "error", "missing client certificate", "path", r.URL.Path)
+			http.Error(w, "Client certificate required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
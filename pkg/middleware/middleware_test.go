@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	goji "goji.io"
+	"goji.io/pat"
+)
+
+// fakeValidator accepts the token "good" for the offering parking
+type fakeValidator struct{}
+
+func (fakeValidator) ValidateToken(token string) (string, error) {
+	if token != "good" {
+		return "", errors.New("invalid token")
+	}
+	return "Org-Provider-parking", nil
+}
+
+func TestAuthToken(t *testing.T) {
+	auth, err := NewAuth(func(offeringID string) (TokenValidator, bool) {
+		return fakeValidator{}, offeringID == "parking"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	offerings := goji.SubMux()
+	offerings.Use(auth.Handler)
+	offerings.HandleFunc(pat.Get("/:offeringID"), ok)
+	offerings.HandleFunc(pat.Get("/:offeringID/stream"), ok)
+	offerings.HandleFunc(pat.Get("/:offeringID/ws"), ok)
+	mux := goji.NewMux()
+	mux.Handle(pat.New("/offering/*"), offerings)
+
+	testCases := []struct {
+		name     string
+		path     string
+		header   string
+		expected int
+	}{
+		{"header", "/offering/parking", "Bearer good", http.StatusOK},
+		{"bad header", "/offering/parking", "Bearer bad", http.StatusUnauthorized},
+		{"no token", "/offering/parking", "", http.StatusBadRequest},
+		{"query param on records", "/offering/parking?access_token=good", "", http.StatusBadRequest},
+		{"query param on stream", "/offering/parking/stream?access_token=good", "", http.StatusOK},
+		{"query param on websocket", "/offering/parking/ws?access_token=good", "", http.StatusOK},
+		{"bad query param on stream", "/offering/parking/stream?access_token=bad", "", http.StatusUnauthorized},
+		{"header on stream", "/offering/parking/stream", "Bearer good", http.StatusOK},
+		{"unknown offering", "/offering/weather", "Bearer good", http.StatusNotFound},
+		{"other offering", "/offering/stream/stream?access_token=good", "", http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+
+			if w.Code != tc.expected {
+				t.Errorf("expected status %d, got %d", tc.expected, w.Code)
+			}
+		})
+	}
+}
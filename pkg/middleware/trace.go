@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/thingful/big-iot-gateway/pkg/log"
+	"github.com/thingful/big-iot-gateway/pkg/trace"
+)
+
+// Trace wraps every request in a server span, continuing the trace of the
+// consumer when it sends a traceparent header
+func Trace(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := trace.Start(trace.Extract(r.Context(), r.Header), "HTTP "+r.Method, trace.Server)
+		defer span.End()
+		span.Set("http.method", r.Method)
+		span.Set("http.target", r.URL.Path)
+		if id := log.RequestID(ctx); id != "" {
+			span.Set("request.id", id)
+		}
+
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r.WithContext(ctx))
+
+		span.Set("http.status_code", rw.status)
+		if rw.status >= 500 {
+			span.SetError(errors.New(http.StatusText(rw.status)))
+		}
+	}
+
+	return http.HandlerFunc(fn)
+}
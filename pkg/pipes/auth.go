@@ -0,0 +1,189 @@
+package pipes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authenticator adds credentials to a pipe request
+type Authenticator interface {
+	Authenticate(ctx context.Context, req *http.Request) error
+}
+
+// invalidator is implemented by authenticators caching credentials that
+// should be dropped when the pipe rejects them
+type invalidator interface {
+	Invalidate()
+}
+
+// ThingfulBearer authenticates with a Thingful access token
+type ThingfulBearer string
+
+// Authenticate sets the Thingful-Authorization header
+func (t ThingfulBearer) Authenticate(ctx context.Context, req *http.Request) error {
+	req.Header.Set("Thingful-Authorization", "Bearer "+string(t))
+	return nil
+}
+
+// Bearer authenticates with a standard bearer token
+type Bearer string
+
+// Authenticate sets the Authorization header
+func (b Bearer) Authenticate(ctx context.Context, req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+string(b))
+	return nil
+}
+
+// Basic authenticates with a username and password
+type Basic struct {
+	Username string
+	Password string
+}
+
+// Authenticate sets basic auth credentials
+func (b Basic) Authenticate(ctx context.Context, req *http.Request) error {
+	req.SetBasicAuth(b.Username, b.Password)
+	return nil
+}
+
+// APIKeyHeader sends an api key in a request header
+type APIKeyHeader struct {
+	Name string
+	Key  string
+}
+
+// Authenticate sets the api key header
+func (a APIKeyHeader) Authenticate(ctx context.Context, req *http.Request) error {
+	req.Header.Set(a.Name, a.Key)
+	return nil
+}
+
+// APIKeyQuery sends an api key as a query parameter
+type APIKeyQuery struct {
+	Name string
+	Key  string
+}
+
+// Authenticate adds the api key to the request url
+func (a APIKeyQuery) Authenticate(ctx context.Context, req *http.Request) error {
+	q := req.URL.Query()
+	q.Set(a.Name, a.Key)
+	req.URL.RawQuery = q.Encode()
+	return nil
+}
+
+// ClientCredentials authenticates with an OAuth2 access token obtained using
+// the client credentials grant. The token is cached until shortly before it
+// expires.
+type ClientCredentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	httpClient *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewClientCredentials returns a ClientCredentials authenticator
+func NewClientCredentials(tokenURL, clientID, clientSecret string, scopes []string) *ClientCredentials {
+	return &ClientCredentials{
+		TokenURL:     tokenURL,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scopes:       scopes,
+		httpClient:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Authenticate sets the Authorization header, fetching a new token first if
+// there isn't a valid one
+func (c *ClientCredentials) Authenticate(ctx context.Context, req *http.Request) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token == "" || time.Now().After(c.expires) {
+		if err := c.refresh(ctx); err != nil {
+			return err
+		}
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	return nil
+}
+
+// Invalidate drops the cached token
+func (c *ClientCredentials) Invalidate() {
+	c.mu.Lock()
+	c.token = ""
+	c.mu.Unlock()
+}
+
+// tokenResponse is the token endpoint response defined by RFC 6749
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// refresh requests a new token, it must be called with the lock held
+func (c *ClientCredentials) refresh(ctx context.Context) error {
+	form := url.Values{"grant_type": []string{"client_credentials"}}
+	if len(c.Scopes) > 0 {
+		form.Set("scope", strings.Join(c.Scopes, " "))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oauth2 token request: status Code: %d received", resp.StatusCode)
+	}
+
+	token := tokenResponse{}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return err
+	}
+	if token.AccessToken == "" {
+		return fmt.Errorf("oauth2 token request: no access token received")
+	}
+
+	c.token = token.AccessToken
+	// refresh a bit earlier than needed so the token doesn't expire in flight
+	expiresIn := time.Duration(token.ExpiresIn) * time.Second
+	if expiresIn <= 0 {
+		expiresIn = time.Hour
+	}
+	if expiresIn > time.Minute {
+		expiresIn -= 30 * time.Second
+	}
+	c.expires = time.Now().Add(expiresIn)
+
+	return nil
+}
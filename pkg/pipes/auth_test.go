@@ -0,0 +1,230 @@
+package pipes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAuthenticators(t *testing.T) {
+	testCases := []struct {
+		name  string
+		auth  Authenticator
+		check func(r *http.Request) bool
+	}{
+		{
+			name:  "thingful",
+			auth:  ThingfulBearer("abc"),
+			check: func(r *http.Request) bool { return r.Header.Get("Thingful-Authorization") == "Bearer abc" },
+		},
+		{
+			name:  "bearer",
+			auth:  Bearer("abc"),
+			check: func(r *http.Request) bool { return r.Header.Get("Authorization") == "Bearer abc" },
+		},
+		{
+			name: "basic",
+			auth: Basic{Username: "user", Password: "pa:ss"},
+			check: func(r *http.Request) bool {
+				u, p, ok := r.BasicAuth()
+				return ok && u == "user" && p == "pa:ss"
+			},
+		},
+		{
+			name:  "api key header",
+			auth:  APIKeyHeader{Name: "X-Api-Key", Key: "abc"},
+			check: func(r *http.Request) bool { return r.Header.Get("X-Api-Key") == "abc" },
+		},
+		{
+			name: "api key query",
+			auth: APIKeyQuery{Name: "key", Key: "a b&c"},
+			check: func(r *http.Request) bool {
+				q := r.URL.Query()
+				return q.Get("key") == "a b&c" && q.Get("limit") == "10"
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !tc.check(r) {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.Write([]byte(`[]`))
+			}))
+			defer srv.Close()
+
+			c, err := NewClient("", WithRetries(0, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.WithAuthenticator(tc.auth).Get(context.Background(), srv.URL+"?limit=10", time.Second); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// tokenServer is an OAuth2 token endpoint handing out tok1, tok2... to the
+// client test-client, with the status code given unless it's 0
+func tokenServer(t *testing.T, status int, expiresIn int) (*httptest.Server, *int32) {
+	var issued int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		id, secret, _ := r.BasicAuth()
+		if r.Method != http.MethodPost || r.PostForm.Get("grant_type") != "client_credentials" || r.PostForm.Get("scope") != "read write" {
+			t.Errorf("unexpected token request %s %v", r.Method, r.PostForm)
+		}
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		if id != "test-client" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		n := atomic.AddInt32(&issued, 1)
+		fmt.Fprintf(w, `{"access_token":"tok%d","token_type":"bearer","expires_in":%d}`, n, expiresIn)
+	}))
+	return srv, &issued
+}
+
+func TestClientCredentials(t *testing.T) {
+	testCases := []struct {
+		name string
+		// status of the token endpoint, 0 to issue tokens
+		tokenStatus int
+		// tokens the pipe refuses
+		refused []string
+		// expire the token after the first request
+		expire   bool
+		requests int
+		issued   int32
+		calls    int32
+		err      string
+	}{
+		{
+			name:     "token is cached",
+			requests: 3,
+			issued:   1,
+			calls:    3,
+		},
+		{
+			name:     "expired token is replaced",
+			expire:   true,
+			requests: 2,
+			issued:   2,
+			calls:    2,
+		},
+		{
+			name:     "refused token is replaced and the request sent again",
+			refused:  []string{"tok1"},
+			requests: 2,
+			issued:   2,
+			calls:    3,
+		},
+		{
+			name:     "request sent again only once",
+			refused:  []string{"tok1", "tok2"},
+			requests: 1,
+			issued:   2,
+			calls:    2,
+			err:      "status Code: 401 received",
+		},
+		{
+			name:        "token endpoint refuses the client",
+			tokenStatus: http.StatusUnauthorized,
+			requests:    1,
+			err:         "pipe authentication: oauth2 token request: status Code: 401 received",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tokens, issued := tokenServer(t, tc.tokenStatus, 3600)
+			defer tokens.Close()
+
+			var calls int32
+			pipe := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+				for _, refused := range tc.refused {
+					if token == refused {
+						w.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+				}
+				w.Write([]byte(`[]`))
+			}))
+			defer pipe.Close()
+
+			auth := NewClientCredentials(tokens.URL, "test-client", "s3cret", []string{"read", "write"})
+			c, err := NewClient("", WithRetries(2, time.Millisecond))
+			if err != nil {
+				t.Fatal(err)
+			}
+			c = c.WithAuthenticator(auth)
+
+			for i := 0; i < tc.requests; i++ {
+				_, err = c.Get(context.Background(), pipe.URL, time.Second)
+				if tc.expire {
+					auth.mu.Lock()
+					auth.expires = time.Now().Add(-time.Second)
+					auth.mu.Unlock()
+				}
+			}
+
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("expected error containing %q, got %v", tc.err, err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if got := atomic.LoadInt32(issued); got != tc.issued {
+				t.Errorf("expected %d tokens issued, got %d", tc.issued, got)
+			}
+			if got := atomic.LoadInt32(&calls); got != tc.calls {
+				t.Errorf("expected %d pipe calls, got %d", tc.calls, got)
+			}
+		})
+	}
+}
+
+func TestClientCredentialsExpiry(t *testing.T) {
+	testCases := []struct {
+		name      string
+		expiresIn int
+		min, max  time.Duration
+	}{
+		{"refreshed early", 3600, 3569 * time.Second, 3570 * time.Second},
+		{"short lived kept as is", 30, 29 * time.Second, 30 * time.Second},
+		{"no expiry defaults to an hour", 0, 3569 * time.Second, 3570 * time.Second},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tokens, _ := tokenServer(t, 0, tc.expiresIn)
+			defer tokens.Close()
+
+			auth := NewClientCredentials(tokens.URL, "test-client", "s3cret", []string{"read", "write"})
+			req, _ := http.NewRequest(http.MethodGet, "http://pipe", nil)
+			if err := auth.Authenticate(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+			if req.Header.Get("Authorization") != "Bearer tok1" {
+				t.Errorf("unexpected authorization %s", req.Header.Get("Authorization"))
+			}
+			if left := time.Until(auth.expires); left < tc.min || left > tc.max {
+				t.Errorf("expected the token to expire in %s to %s, got %s", tc.min, tc.max, left)
+			}
+		})
+	}
+}
@@ -1,21 +1,294 @@
 package pipes
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
 
-	"github.com/go-resty/resty"
+	"github.com/thingful/big-iot-gateway/pkg/log"
+	"github.com/thingful/big-iot-gateway/pkg/trace"
 )
 
-// MakeRequest calls at url using token for Authentication
-func MakeRequest(url string, token string) ([]byte, error) {
-	client := resty.New()
-	client.SetHeader("Thingful-Authorization", "Bearer "+token)
-	resp, err := client.R().Get(url)
-	if err != nil || resp.StatusCode() != 200 {
+const (
+	// DefaultTimeout is applied to every pipe request unless the caller's
+	// context has an earlier deadline
+	DefaultTimeout = 30 * time.Second
+
+	// DefaultRetries is the number of extra attempts made for a failed request
+	DefaultRetries = 2
+
+	// DefaultRetryWait is the base wait between attempts, doubled on every retry
+	DefaultRetryWait = 250 * time.Millisecond
+)
+
+// StatusError is returned when a pipe answers with a non 200 status code
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status Code: %d received", e.Code)
+}
+
+// authError is returned when a request can't be authenticated, e.g. an
+// OAuth2 token endpoint refused the client
+type authError struct {
+	err error
+}
+
+func (e *authError) Error() string {
+	return "pipe authentication: " + e.err.Error()
+}
+
+// Client is a long lived pipe client, it's safe for concurrent use and reuses
+// connections between requests
+type Client struct {
+	auth       Authenticator
+	timeout    time.Duration
+	retries    int
+	retryWait  time.Duration
+	proxyURL   string
+	caFile     string
+	httpClient *http.Client
+}
+
+// Option configures a Client
+type Option func(*Client) error
+
+// WithTimeout sets the default timeout for a request including retries, zero
+// keeps DefaultTimeout
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) error {
+		if timeout > 0 {
+			c.timeout = timeout
+		}
+		return nil
+	}
+}
+
+// WithRetries sets how many times a failed request is retried and the base
+// wait between attempts
+func WithRetries(retries int, wait time.Duration) Option {
+	return func(c *Client) error {
+		if retries < 0 {
+			return errors.New("pipe retries can't be negative")
+		}
+		c.retries = retries
+		c.retryWait = wait
+		return nil
+	}
+}
+
+// WithProxy sends every pipe request through the given proxy url instead of
+// the one set in the environment
+func WithProxy(proxyURL string) Option {
+	return func(c *Client) error {
+		c.proxyURL = proxyURL
+		return nil
+	}
+}
+
+// WithCAFile adds the PEM certificates contained in caFile to the system pool
+// used to verify pipes
+func WithCAFile(caFile string) Option {
+	return func(c *Client) error {
+		c.caFile = caFile
+		return nil
+	}
+}
+
+// NewClient returns a Client that authenticates with a Thingful token
+func NewClient(token string, options ...Option) (*Client, error) {
+	c := &Client{
+		auth:      ThingfulBearer(token),
+		timeout:   DefaultTimeout,
+		retries:   DefaultRetries,
+		retryWait: DefaultRetryWait,
+	}
+
+	for _, opt := range options {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		// gzip is negotiated and decoded transparently by the transport
+		DisableCompression: false,
+	}
+
+	if c.proxyURL != "" {
+		u, err := url.Parse(c.proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pipe proxy: %s", err.Error())
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	if c.caFile != "" {
+		pem, err := ioutil.ReadFile(c.caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + c.caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	// every attempt is traced as its own span
+	c.httpClient = &http.Client{Transport: trace.Transport{Name: "pipe", Proxied: transport}}
+
+	return c, nil
+}
+
+// WithAuthenticator returns a copy of the client that authenticates with auth
+// instead, both clients share their connections
+func (c *Client) WithAuthenticator(auth Authenticator) *Client {
+	cc := *c
+	cc.auth = auth
+	return &cc
+}
+
+// Get calls url and returns the body of the response. The request is bound to
+// ctx, so it's abandoned as soon as ctx is cancelled. A timeout of zero uses
+// the client's default.
+func (c *Client) Get(ctx context.Context, url string, timeout time.Duration) ([]byte, error) {
+	if timeout == 0 {
+		timeout = c.timeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var err error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, err
+			case <-time.After(c.backoff(attempt)):
+			}
+		}
+
+		var body []byte
+		body, err = c.get(ctx, url)
+		if c.reauthenticate(err) {
+			// the cached credentials were refused and dropped, a fresh
+			// token may be accepted
+			body, err = c.get(ctx, url)
+		}
 		if err == nil {
-			err = fmt.Errorf("status Code: %d received", resp.StatusCode())
+			return body, nil
+		}
+		if !retryable(ctx, err) {
+			return nil, err
 		}
+	}
+
+	return nil, err
+}
+
+func (c *Client) get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if id := log.RequestID(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	if err := c.auth.Authenticate(ctx, req); err != nil {
+		return nil, &authError{err: err}
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
 		return nil, err
 	}
-	return resp.Body(), nil
+
+	if resp.StatusCode != http.StatusOK {
+		if inv, ok := c.auth.(invalidator); ok && resp.StatusCode == http.StatusUnauthorized {
+			inv.Invalidate()
+		}
+		return nil, &StatusError{Code: resp.StatusCode}
+	}
+
+	return body, nil
+}
+
+// reauthenticate reports whether a request refused with err is worth
+// sending again right away, i.e. a 401 invalidated cached credentials
+func (c *Client) reauthenticate(err error) bool {
+	serr, ok := err.(*StatusError)
+	if !ok || serr.Code != http.StatusUnauthorized {
+		return false
+	}
+	_, ok = c.auth.(invalidator)
+	return ok
+}
+
+// backoff returns the jittered wait before the given attempt
+func (c *Client) backoff(attempt int) time.Duration {
+	wait := c.retryWait << uint(attempt-1)
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// retryable reports whether a failed GET is worth trying again, we only retry
+// on throttling, server side errors, timeouts and dropped connections.
+// Authentication, TLS and invalid url errors won't go away by retrying.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	switch e := err.(type) {
+	case *StatusError:
+		return e.Code == http.StatusTooManyRequests || e.Code >= 500
+	case *url.Error:
+		// url.Error is a net.Error itself, what matters is the cause
+		return transient(e.Err)
+	default:
+		return transient(err)
+	}
+}
+
+// transient reports whether err is a network error or a connection closed
+// by the pipe, certificate errors aren't net.Errors
+func transient(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
 }
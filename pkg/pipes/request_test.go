@@ -0,0 +1,207 @@
+package pipes
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingAuth counts the attempts made by a client, it fails with err when
+// set
+type countingAuth struct {
+	attempts int32
+	err      error
+}
+
+func (a *countingAuth) Authenticate(ctx context.Context, req *http.Request) error {
+	atomic.AddInt32(&a.attempts, 1)
+	return a.err
+}
+
+// statusServer answers with the given status codes in turn, the last one is
+// repeated
+func statusServer(codes ...int) (*httptest.Server, *int32) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&calls, 1))
+		if n > len(codes) {
+			n = len(codes)
+		}
+		w.WriteHeader(codes[n-1])
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	return srv, &calls
+}
+
+func TestGetRetries(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	tlsSrv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	tlsSrv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+
+	testCases := []struct {
+		name     string
+		codes    []int
+		url      string
+		authErr  error
+		attempts int32
+		err      string
+	}{
+		{
+			name:     "success",
+			codes:    []int{200},
+			attempts: 1,
+		},
+		{
+			name:     "server errors are retried",
+			codes:    []int{500, 503, 200},
+			attempts: 3,
+		},
+		{
+			name:     "throttling is retried",
+			codes:    []int{429, 200},
+			attempts: 2,
+		},
+		{
+			name:     "retries run out",
+			codes:    []int{502},
+			attempts: 3,
+			err:      "status Code: 502 received",
+		},
+		{
+			name:     "client errors aren't retried",
+			codes:    []int{404},
+			attempts: 1,
+			err:      "status Code: 404 received",
+		},
+		{
+			name:     "refused connections are retried",
+			url:      closed.URL,
+			attempts: 3,
+			err:      "connection refused",
+		},
+		{
+			name:     "authentication errors aren't retried",
+			codes:    []int{200},
+			authErr:  errors.New("oauth2 token request: status Code: 401 received"),
+			attempts: 1,
+			err:      "pipe authentication: oauth2 token request",
+		},
+		{
+			name:     "certificate errors aren't retried",
+			url:      tlsSrv.URL,
+			attempts: 1,
+			err:      "certificate",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			url := tc.url
+			if url == "" {
+				srv, _ := statusServer(tc.codes...)
+				defer srv.Close()
+				url = srv.URL
+			}
+
+			c, err := NewClient("token", WithRetries(2, time.Millisecond))
+			if err != nil {
+				t.Fatal(err)
+			}
+			auth := &countingAuth{err: tc.authErr}
+			c = c.WithAuthenticator(auth)
+
+			body, err := c.Get(context.Background(), url, time.Second)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("expected error containing %q, got %v", tc.err, err)
+				}
+			} else if err != nil || string(body) != `{"ok":true}` {
+				t.Errorf("unexpected response %s, %v", body, err)
+			}
+			if got := atomic.LoadInt32(&auth.attempts); got != tc.attempts {
+				t.Errorf("expected %d attempts, got %d", tc.attempts, got)
+			}
+		})
+	}
+}
+
+func TestGetCancellation(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	failing, _ := statusServer(500)
+	defer failing.Close()
+
+	testCases := []struct {
+		name     string
+		url      string
+		timeout  time.Duration
+		cancel   time.Duration
+		attempts int32
+	}{
+		{
+			name:     "cancelled while backing off",
+			url:      failing.URL,
+			timeout:  10 * time.Second,
+			cancel:   50 * time.Millisecond,
+			attempts: 1,
+		},
+		{
+			name:     "cancelled in flight",
+			url:      slow.URL,
+			timeout:  10 * time.Second,
+			cancel:   50 * time.Millisecond,
+			attempts: 1,
+		},
+		{
+			name:     "timeout",
+			url:      slow.URL,
+			timeout:  50 * time.Millisecond,
+			attempts: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// the wait before a retry outlasts the test unless cancelled
+			c, err := NewClient("token", WithRetries(2, 5*time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			auth := &countingAuth{}
+			c = c.WithAuthenticator(auth)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancel > 0 {
+				time.AfterFunc(tc.cancel, cancel)
+			}
+
+			start := time.Now()
+			_, err = c.Get(ctx, tc.url, tc.timeout)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("expected Get to return right away, took %s", elapsed)
+			}
+			if got := atomic.LoadInt32(&auth.attempts); got != tc.attempts {
+				t.Errorf("expected %d attempts, got %d", tc.attempts, got)
+			}
+		})
+	}
+}
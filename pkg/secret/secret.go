@@ -0,0 +1,184 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/thingful/big-iot-gateway/pkg/log"
+)
+
+// Redacted is what a String shows instead of its value
+const Redacted = "[REDACTED]"
+
+const (
+	envPrefix  = "env:"
+	filePrefix = "file:"
+	encPrefix  = "enc:"
+)
+
+// String holds a secret value. It prints, logs and marshals as Redacted, the
+// value is only available through Reveal.
+type String string
+
+func (s String) String() string { return Redacted }
+
+// GoString hides the value from %#v
+func (s String) GoString() string { return Redacted }
+
+// MarshalJSON hides the value from json encoding, including log lines
+func (s String) MarshalJSON() ([]byte, error) { return []byte(`"` + Redacted + `"`), nil }
+
+// Reveal returns the secret value
+func (s String) Reveal() string { return string(s) }
+
+// Resolver turns secret references into their values. A reference can be
+//
+//	env:NAME          the value of the environment variable NAME
+//	file:/some/path   the content of a file, i.e. a docker or k8s secret
+//	enc:BASE64        a value encrypted with Encrypt using the local key
+//
+// anything else is taken literally.
+type Resolver struct {
+	keyFile string
+
+	once sync.Once
+	key  []byte
+	err  error
+}
+
+// NewResolver returns a Resolver that decrypts enc: references with the key
+// stored in keyFile
+func NewResolver(keyFile string) *Resolver {
+	return &Resolver{keyFile: keyFile}
+}
+
+// Resolve returns the value of ref. Every resolved value is also registered
+// with the logger so it's redacted if it ever shows up in a log line.
+func (r *Resolver) Resolve(ref string) (String, error) {
+	var (
+		val string
+		err error
+	)
+
+	switch {
+	case strings.HasPrefix(ref, envPrefix):
+		name := strings.TrimPrefix(ref, envPrefix)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("secret env var %s is not set", name)
+		}
+		val = v
+	case strings.HasPrefix(ref, filePrefix):
+		b, ferr := ioutil.ReadFile(strings.TrimPrefix(ref, filePrefix))
+		if ferr != nil {
+			return "", ferr
+		}
+		val = strings.TrimRight(string(b), "\r\n")
+	case strings.HasPrefix(ref, encPrefix):
+		val, err = r.decrypt(strings.TrimPrefix(ref, encPrefix))
+		if err != nil {
+			return "", err
+		}
+	default:
+		val = ref
+	}
+
+	log.Redact(val)
+	return String(val), nil
+}
+
+func (r *Resolver) decrypt(data string) (string, error) {
+	r.once.Do(func() {
+		if r.keyFile == "" {
+			r.err = errors.New("secret key file is not set, unable to decrypt enc: values")
+			return
+		}
+		r.key, r.err = ReadKey(r.keyFile)
+	})
+	if r.err != nil {
+		return "", r.err
+	}
+	return Decrypt(r.key, data)
+}
+
+// GenerateKey returns a new random key, base64 encoded as expected by ReadKey
+func GenerateKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ReadKey reads a base64 encoded AES-256 key from path
+func ReadKey(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret key: %s", err.Error())
+	}
+	if len(key) != 32 {
+		return nil, errors.New("invalid secret key: must be 32 bytes")
+	}
+	return key, nil
+}
+
+// Encrypt encrypts value with AES-GCM and returns a reference that Resolve
+// decrypts with the same key
+func Encrypt(key []byte, value string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(value), nil)
+	return encPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts the base64 data produced by Encrypt, without its enc:
+// prefix
+func Decrypt(key []byte, data string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted secret: %s", err.Error())
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("invalid encrypted secret: too short")
+	}
+
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("unable to decrypt secret, wrong key?")
+	}
+	return string(plain), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,215 @@
+package secret
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thingful/big-iot-gateway/pkg/log"
+)
+
+// writeKey writes a new key file in dir and returns its path and the key
+func writeKey(t *testing.T, dir, name string) (string, []byte) {
+	t.Helper()
+
+	encoded, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(encoded+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := ReadKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, key
+}
+
+// tamper flips a bit of the ciphertext of an enc: reference
+func tamper(ref string) string {
+	sealed, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(ref, encPrefix))
+	sealed[len(sealed)-1] ^= 1
+	return encPrefix + base64.StdEncoding.EncodeToString(sealed)
+}
+
+func TestResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile, key := writeKey(t, dir, "key")
+	otherKeyFile, _ := writeKey(t, dir, "other")
+
+	secretFile := filepath.Join(dir, "provider")
+	ioutil.WriteFile(secretFile, []byte("from-a-file\n"), 0600)
+
+	os.Setenv("SECRET_TEST_VALUE", "from-the-env")
+	defer os.Unsetenv("SECRET_TEST_VALUE")
+
+	encrypted, err := Encrypt(key, "from-the-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		keyFile  string
+		ref      string
+		expected string
+		err      string
+	}{
+		{name: "literal", ref: "plain-value", expected: "plain-value"},
+		{name: "env", ref: "env:SECRET_TEST_VALUE", expected: "from-the-env"},
+		{name: "missing env", ref: "env:SECRET_TEST_MISSING", err: "secret env var SECRET_TEST_MISSING is not set"},
+		{name: "file", ref: "file:" + secretFile, expected: "from-a-file"},
+		{name: "missing file", ref: "file:" + filepath.Join(dir, "missing"), err: "no such file"},
+		{name: "enc", keyFile: keyFile, ref: encrypted, expected: "from-the-key"},
+		{name: "enc without a key", ref: encrypted, err: "secret key file is not set"},
+		{name: "enc with a wrong key", keyFile: otherKeyFile, ref: encrypted, err: "unable to decrypt secret, wrong key?"},
+		{name: "tampered enc", keyFile: keyFile, ref: tamper(encrypted), err: "unable to decrypt secret, wrong key?"},
+		{name: "enc not base64", keyFile: keyFile, ref: "enc:%%%", err: "invalid encrypted secret"},
+		{name: "enc too short", keyFile: keyFile, ref: "enc:AAAA", err: "invalid encrypted secret: too short"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := NewResolver(tc.keyFile).Resolve(tc.ref)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.Reveal() != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got.Reveal())
+			}
+		})
+	}
+}
+
+func TestReadKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testCases := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"valid", base64.StdEncoding.EncodeToString(make([]byte, 32)) + "\n", ""},
+		{"not base64", "%%%", "invalid secret key"},
+		{"too short", base64.StdEncoding.EncodeToString(make([]byte, 16)), "must be 32 bytes"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, "key")
+			ioutil.WriteFile(path, []byte(tc.content), 0600)
+
+			key, err := ReadKey(path)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil || len(key) != 32 {
+				t.Errorf("expected a 32 bytes key, got %d bytes and %v", len(key), err)
+			}
+		})
+	}
+}
+
+func TestString(t *testing.T) {
+	s := String("resolved-credential")
+
+	testCases := []struct {
+		name string
+		got  string
+	}{
+		{"%s", fmt.Sprintf("%s", s)},
+		{"%v", fmt.Sprintf("%v", s)},
+		{"%#v", fmt.Sprintf("%#v", s)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.got != Redacted {
+				t.Errorf("expected %s, got %s", Redacted, tc.got)
+			}
+		})
+	}
+
+	if b, _ := s.MarshalJSON(); string(b) != `"`+Redacted+`"` {
+		t.Errorf("expected json %q, got %s", Redacted, b)
+	}
+}
+
+func TestResolvedValuesAreRedacted(t *testing.T) {
+	os.Setenv("SECRET_TEST_REDACTED", "env-credential-0123")
+	defer os.Unsetenv("SECRET_TEST_REDACTED")
+
+	testCases := []struct {
+		name   string
+		ref    string
+		logged func(v string) []interface{}
+	}{
+		{
+			name:   "string value",
+			ref:    "env:SECRET_TEST_REDACTED",
+			logged: func(v string) []interface{} { return []interface{}{"msg", "token is " + v} },
+		},
+		{
+			name:   "error value",
+			ref:    "literal-credential-4567",
+			logged: func(v string) []interface{} { return []interface{}{"error", errors.New("auth failed for " + v)} },
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := NewResolver("").Resolve(tc.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := ioutil.TempFile("", "log")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			stdout := os.Stdout
+			os.Stdout = f
+			log.SetFormat("json")
+
+			log.Log(tc.logged(v.Reveal())...)
+
+			os.Stdout = stdout
+			log.SetFormat("json")
+			f.Close()
+			b, _ := ioutil.ReadFile(f.Name())
+
+			if strings.Contains(string(b), v.Reveal()) {
+				t.Errorf("secret found in log line %s", b)
+			}
+			if !strings.Contains(string(b), Redacted) {
+				t.Errorf("expected %s in log line %s", Redacted, b)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+// Package store is an embedded key value store kept in a single file. Values
+// are json documents grouped in buckets. Every write replaces the file with a
+// synced temporary copy, so a crash leaves either the previous or the new
+// state on disk, never a mix of both.
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// version of the file format
+const version = 1
+
+// file is the content of a store file
+type file struct {
+	Version int                                   `json:"version"`
+	Saved   time.Time                             `json:"saved"`
+	Buckets map[string]map[string]json.RawMessage `json:"buckets"`
+}
+
+// Store keeps buckets of values in memory and in a file. A store opened
+// without a path is kept in memory only.
+type Store struct {
+	path string
+
+	mu      sync.RWMutex
+	buckets map[string]map[string]json.RawMessage
+	dirty   bool
+}
+
+// Open reads the store kept in path, creating it on the first write, and
+// removes the temporary files a crash may have left next to it
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:    path,
+		buckets: map[string]map[string]json.RawMessage{},
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	tmps, _ := filepath.Glob(s.tmpPattern() + "*")
+	for _, tmp := range tmps {
+		os.Remove(tmp)
+	}
+
+	return s, s.read(path)
+}
+
+// Read reads the store kept in path without taking it over, so it can be
+// used while a gateway runs with it: temporary files are left alone and the
+// store is kept in memory only
+func Read(path string) (*Store, error) {
+	s := &Store{buckets: map[string]map[string]json.RawMessage{}}
+	if path == "" {
+		return s, nil
+	}
+	return s, s.read(path)
+}
+
+// read loads the buckets of the store file in path, a missing file is an
+// empty store
+func (s *Store) read(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	f := file{}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("state file %s is corrupt: %s", path, err.Error())
+	}
+	if f.Version != version {
+		return fmt.Errorf("state file %s has unknown version %d", path, f.Version)
+	}
+	if f.Buckets != nil {
+		s.buckets = f.Buckets
+	}
+	return nil
+}
+
+// Path returns the file of the store, empty when it's kept in memory
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Get decodes the value of key into v, returning false when there's none
+func (s *Store) Get(bucket, key string, v interface{}) (bool, error) {
+	s.mu.RLock()
+	raw, ok := s.buckets[bucket][key]
+	s.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+// Keys returns the keys of a bucket in order
+func (s *Store) Keys(bucket string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Put stores v as the value of key and writes the store to disk before
+// returning
+func (s *Store) Put(bucket, key string, v interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.set(bucket, key, v); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// Stage stores v as the value of key, it's written to disk by the next Put,
+// Delete or Sync. It suits values that change often and can be lost, like
+// counters.
+func (s *Store) Stage(bucket, key string, v interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.set(bucket, key, v); err != nil {
+		return err
+	}
+	s.dirty = true
+	return nil
+}
+
+// Delete removes key and writes the store to disk
+func (s *Store) Delete(bucket, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buckets[bucket][key]; !ok {
+		return nil
+	}
+	delete(s.buckets[bucket], key)
+	if len(s.buckets[bucket]) == 0 {
+		delete(s.buckets, bucket)
+	}
+	return s.save()
+}
+
+// Sync writes the values staged since the last write
+func (s *Store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	return s.save()
+}
+
+func (s *Store) set(bucket, key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = map[string]json.RawMessage{}
+	}
+	s.buckets[bucket][key] = raw
+	return nil
+}
+
+// save writes every bucket to a synced temporary file and renames it over
+// the store file, syncing the directory so the rename survives a crash. It
+// must be called with the lock held.
+func (s *Store) save() error {
+	if s.path == "" {
+		s.dirty = false
+		return nil
+	}
+
+	b, err := json.Marshal(file{
+		Version: version,
+		Saved:   time.Now().UTC(),
+		Buckets: s.buckets,
+	})
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(s.path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(s.tmpPattern()))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	s.dirty = false
+	return nil
+}
+
+// tmpPattern starts the names of the temporary files of the store, hidden
+// files next to it named after it
+func (s *Store) tmpPattern() string {
+	return filepath.Join(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp")
+}
@@ -0,0 +1,237 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// contents returns the values of a bucket of the store kept in path
+func contents(t *testing.T, path, bucket string) map[string]string {
+	t.Helper()
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("unable to open %s: %v", path, err)
+	}
+	values := map[string]string{}
+	for _, k := range s.Keys(bucket) {
+		var v string
+		if _, err := s.Get(bucket, k, &v); err != nil {
+			t.Fatal(err)
+		}
+		values[k] = v
+	}
+	return values
+}
+
+func TestCrash(t *testing.T) {
+	// every case runs its writes and then reopens the store as a restart
+	// after a crash would, without calling Sync
+	testCases := []struct {
+		name     string
+		write    func(s *Store) error
+		expected map[string]string
+	}{
+		{
+			name: "put is on disk",
+			write: func(s *Store) error {
+				return s.Put("b", "k", "v")
+			},
+			expected: map[string]string{"k": "v"},
+		},
+		{
+			name: "staged values are lost",
+			write: func(s *Store) error {
+				if err := s.Put("b", "k", "v"); err != nil {
+					return err
+				}
+				return s.Stage("b", "k", "staged")
+			},
+			expected: map[string]string{"k": "v"},
+		},
+		{
+			name: "staged values are written by the next put",
+			write: func(s *Store) error {
+				if err := s.Stage("b", "staged", "v"); err != nil {
+					return err
+				}
+				return s.Put("b", "k", "v")
+			},
+			expected: map[string]string{"k": "v", "staged": "v"},
+		},
+		{
+			name: "sync writes staged values",
+			write: func(s *Store) error {
+				if err := s.Stage("b", "k", "v"); err != nil {
+					return err
+				}
+				return s.Sync()
+			},
+			expected: map[string]string{"k": "v"},
+		},
+		{
+			name: "delete is on disk",
+			write: func(s *Store) error {
+				if err := s.Put("b", "k", "v"); err != nil {
+					return err
+				}
+				if err := s.Put("b", "other", "v"); err != nil {
+					return err
+				}
+				return s.Delete("b", "k")
+			},
+			expected: map[string]string{"other": "v"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "state.json")
+
+			s, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tc.write(s); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := contents(t, path, "b"); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	testCases := []struct {
+		name     string
+		content  string
+		tmp      string
+		expected map[string]string
+		fails    bool
+	}{
+		{
+			name:     "missing file is an empty store",
+			expected: map[string]string{},
+		},
+		{
+			name:     "temporary file left by a crash is ignored and removed",
+			content:  `{"version":1,"buckets":{"b":{"k":"old"}}}`,
+			tmp:      `{"version":1,"buckets":{"b":{"k":"ne`,
+			expected: map[string]string{"k": "old"},
+		},
+		{
+			name:    "corrupt file",
+			content: `{"version":1,"buckets":{"b":`,
+			fails:   true,
+		},
+		{
+			name:    "unknown version",
+			content: `{"version":2,"buckets":{}}`,
+			fails:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "state.json")
+			tmp := filepath.Join(dir, ".state.json.tmp123456")
+
+			if tc.content != "" {
+				ioutil.WriteFile(path, []byte(tc.content), 0644)
+			}
+			if tc.tmp != "" {
+				ioutil.WriteFile(tmp, []byte(tc.tmp), 0644)
+			}
+
+			s, err := Open(path)
+			if tc.fails {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+				t.Errorf("expected the temporary file to be removed")
+			}
+
+			got := map[string]string{}
+			for _, k := range s.Keys("b") {
+				var v string
+				s.Get("b", k, &v)
+				got[k] = v
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+
+			// no temporary file is left behind by writes
+			if err := s.Put("b", "k", "new"); err != nil {
+				t.Fatal(err)
+			}
+			tmps, _ := filepath.Glob(filepath.Join(dir, ".state.json.tmp*"))
+			if len(tmps) != 0 {
+				t.Errorf("temporary files left behind: %v", tmps)
+			}
+		})
+	}
+}
+
+func TestRead(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	tmp := filepath.Join(dir, ".state.json.tmp123456")
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("b", "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	// a write of the running gateway in progress
+	ioutil.WriteFile(tmp, []byte(`{"version":1`), 0644)
+
+	r, err := Read(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var v string
+	if ok, _ := r.Get("b", "k", &v); !ok || v != "v" {
+		t.Errorf("expected v, got %q", v)
+	}
+	if _, err := os.Stat(tmp); err != nil {
+		t.Errorf("expected the temporary file to be left alone")
+	}
+
+	if err := r.Put("b", "k", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if r.Path() != "" {
+		t.Errorf("expected a store kept in memory, got path %q", r.Path())
+	}
+	os.Remove(tmp)
+	if got := contents(t, path, "b"); got["k"] != "v" {
+		t.Errorf("expected the file untouched, got %v", got)
+	}
+}
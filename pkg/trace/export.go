@@ -0,0 +1,140 @@
+package trace
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/log"
+)
+
+const (
+	queueSize     = 2048
+	batchSize     = 256
+	flushInterval = 5 * time.Second
+)
+
+// Exporter sends finished spans somewhere
+type Exporter interface {
+	Export(ctx context.Context, spans []SpanData) error
+}
+
+// processor batches finished spans and hands them to an Exporter in the
+// background, dropping spans if the exporter can't keep up
+type processor struct {
+	exporter Exporter
+	spans    chan SpanData
+	flush    chan chan struct{}
+	dropped  uint64
+}
+
+var (
+	mu   sync.RWMutex
+	proc *processor
+)
+
+// SetExporter starts exporting sampled spans to e, a nil e stops sampling new
+// traces. It must be called at most once before Shutdown.
+func SetExporter(e Exporter) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if e == nil {
+		proc = nil
+		return
+	}
+	proc = &processor{
+		exporter: e,
+		spans:    make(chan SpanData, queueSize),
+		flush:    make(chan chan struct{}),
+	}
+	go proc.run()
+}
+
+// Shutdown exports the spans still queued, waiting until ctx is done at most
+func Shutdown(ctx context.Context) error {
+	mu.RLock()
+	p := proc
+	mu.RUnlock()
+	if p == nil {
+		return nil
+	}
+
+	done := make(chan struct{})
+	select {
+	case p.flush <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// enabled reports whether new traces should be sampled
+func enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return proc != nil
+}
+
+func queue(d SpanData) {
+	mu.RLock()
+	p := proc
+	mu.RUnlock()
+	if p == nil {
+		return
+	}
+
+	select {
+	case p.spans <- d:
+	default:
+		atomic.AddUint64(&p.dropped, 1)
+	}
+}
+
+func (p *processor) run() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]SpanData, 0, batchSize)
+	for {
+		select {
+		case d := <-p.spans:
+			batch = append(batch, d)
+			if len(batch) >= batchSize {
+				batch = p.export(batch)
+			}
+		case <-ticker.C:
+			batch = p.export(batch)
+		case done := <-p.flush:
+			for len(p.spans) > 0 {
+				batch = append(batch, <-p.spans)
+			}
+			batch = p.export(batch)
+			close(done)
+		}
+	}
+}
+
+// export sends batch and returns it emptied for reuse
+func (p *processor) export(batch []SpanData) []SpanData {
+	if dropped := atomic.SwapUint64(&p.dropped, 0); dropped > 0 {
+		log.Log("dropped", dropped, "msg", "trace queue full, spans dropped")
+	}
+	if len(batch) == 0 {
+		return batch
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := p.exporter.Export(ctx, batch); err != nil {
+		log.Log("error", err, "spans", len(batch), "msg", "unable to export spans")
+	}
+
+	return batch[:0]
+}
@@ -0,0 +1,413 @@
+package trace
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector is an in-memory OTLP/HTTP collector keeping the requests it gets
+type collector struct {
+	*httptest.Server
+
+	status int
+
+	mu       sync.Mutex
+	paths    []string
+	types    []string
+	payloads []map[string]interface{}
+}
+
+func newCollector(status int) *collector {
+	c := &collector{status: status}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		payload := map[string]interface{}{}
+		json.Unmarshal(body, &payload)
+
+		c.mu.Lock()
+		c.paths = append(c.paths, r.URL.Path)
+		c.types = append(c.types, r.Header.Get("Content-Type"))
+		c.payloads = append(c.payloads, payload)
+		c.mu.Unlock()
+
+		w.WriteHeader(c.status)
+	}))
+	return c
+}
+
+func (c *collector) spans() []map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	spans := []map[string]interface{}{}
+	for _, p := range c.payloads {
+		for _, rs := range p["resourceSpans"].([]interface{}) {
+			for _, ss := range rs.(map[string]interface{})["scopeSpans"].([]interface{}) {
+				for _, s := range ss.(map[string]interface{})["spans"].([]interface{}) {
+					spans = append(spans, s.(map[string]interface{}))
+				}
+			}
+		}
+	}
+	return spans
+}
+
+// checkRequest checks a payload against the JSON encoding of an OTLP
+// ExportTraceServiceRequest: ids are lowercase hex, 64 bit integers are
+// decimal strings, enums are numbers and every AnyValue has a single field
+func checkRequest(t *testing.T, payload map[string]interface{}) {
+	t.Helper()
+
+	resourceSpans, ok := payload["resourceSpans"].([]interface{})
+	if !ok || len(resourceSpans) == 0 {
+		t.Fatalf("resourceSpans missing in %v", payload)
+	}
+	for _, rs := range resourceSpans {
+		rs := rs.(map[string]interface{})
+		resource, ok := rs["resource"].(map[string]interface{})
+		if !ok {
+			t.Fatalf("resource missing in %v", rs)
+		}
+		checkAttributes(t, resource["attributes"])
+
+		scopeSpans, ok := rs["scopeSpans"].([]interface{})
+		if !ok || len(scopeSpans) == 0 {
+			t.Fatalf("scopeSpans missing in %v", rs)
+		}
+		for _, ss := range scopeSpans {
+			ss := ss.(map[string]interface{})
+			scope, ok := ss["scope"].(map[string]interface{})
+			if !ok || scope["name"] == "" {
+				t.Errorf("scope name missing in %v", ss)
+			}
+			for _, s := range ss["spans"].([]interface{}) {
+				checkSpan(t, s.(map[string]interface{}))
+			}
+		}
+	}
+}
+
+func checkSpan(t *testing.T, s map[string]interface{}) {
+	t.Helper()
+
+	checkHex(t, s, "traceId", 16, true)
+	checkHex(t, s, "spanId", 8, true)
+	checkHex(t, s, "parentSpanId", 8, false)
+
+	if name, ok := s["name"].(string); !ok || name == "" {
+		t.Errorf("span name missing in %v", s)
+	}
+	// SpanKind goes from SPAN_KIND_INTERNAL to SPAN_KIND_CONSUMER
+	if kind, ok := s["kind"].(float64); !ok || kind < 1 || kind > 5 {
+		t.Errorf("invalid span kind %v", s["kind"])
+	}
+
+	start := checkUint64(t, s, "startTimeUnixNano")
+	end := checkUint64(t, s, "endTimeUnixNano")
+	if end < start {
+		t.Errorf("span ends at %d before it starts at %d", end, start)
+	}
+
+	checkAttributes(t, s["attributes"])
+
+	status, ok := s["status"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("status missing in %v", s)
+	}
+	// StatusCode goes from STATUS_CODE_UNSET to STATUS_CODE_ERROR
+	if code, ok := status["code"]; ok {
+		if c, ok := code.(float64); !ok || c < 0 || c > 2 {
+			t.Errorf("invalid status code %v", code)
+		}
+	}
+}
+
+func checkHex(t *testing.T, obj map[string]interface{}, key string, size int, required bool) {
+	t.Helper()
+
+	v, ok := obj[key]
+	if !ok {
+		if required {
+			t.Errorf("%s missing in %v", key, obj)
+		}
+		return
+	}
+	s, ok := v.(string)
+	b, err := hex.DecodeString(s)
+	if !ok || err != nil || len(b) != size || hex.EncodeToString(b) != s {
+		t.Errorf("%s %v isn't %d bytes of lowercase hex", key, v, size)
+	}
+}
+
+func checkUint64(t *testing.T, obj map[string]interface{}, key string) uint64 {
+	t.Helper()
+
+	s, ok := obj[key].(string)
+	if !ok {
+		t.Errorf("%s %v isn't a string", key, obj[key])
+		return 0
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		t.Errorf("%s %q isn't a decimal uint64", key, s)
+	}
+	return n
+}
+
+func checkAttributes(t *testing.T, v interface{}) {
+	t.Helper()
+
+	if v == nil {
+		return
+	}
+	attrs, ok := v.([]interface{})
+	if !ok {
+		t.Fatalf("attributes %v aren't a list", v)
+	}
+	for _, a := range attrs {
+		kv := a.(map[string]interface{})
+		if key, ok := kv["key"].(string); !ok || key == "" {
+			t.Errorf("attribute key missing in %v", kv)
+		}
+		value, ok := kv["value"].(map[string]interface{})
+		if !ok || len(value) != 1 {
+			t.Errorf("attribute value %v must have a single field", kv["value"])
+			continue
+		}
+		for field, val := range value {
+			switch field {
+			case "stringValue":
+				_, ok = val.(string)
+			case "boolValue":
+				_, ok = val.(bool)
+			case "doubleValue":
+				_, ok = val.(float64)
+			case "intValue":
+				var s string
+				if s, ok = val.(string); ok {
+					_, err := strconv.ParseInt(s, 10, 64)
+					ok = err == nil
+				}
+			default:
+				ok = false
+			}
+			if !ok {
+				t.Errorf("invalid attribute value %s: %v", field, val)
+			}
+		}
+	}
+}
+
+func TestOTLPExporterPayload(t *testing.T) {
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	traceID := TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}
+
+	testCases := []struct {
+		name   string
+		span   SpanData
+		attrs  map[string]interface{}
+		status float64
+	}{
+		{
+			name: "server root span",
+			span: SpanData{
+				Name:    "GET /offering/:offeringID",
+				Kind:    Server,
+				TraceID: traceID,
+				SpanID:  SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+				Start:   start,
+				End:     start.Add(time.Second),
+				Attributes: []Attribute{
+					{Key: "http.method", Value: "GET"},
+					{Key: "http.status_code", Value: 200},
+				},
+			},
+			attrs:  map[string]interface{}{"http.method": map[string]interface{}{"stringValue": "GET"}, "http.status_code": map[string]interface{}{"intValue": "200"}},
+			status: otlpStatusOK,
+		},
+		{
+			name: "client child span with error",
+			span: SpanData{
+				Name:     "pipe fetch",
+				Kind:     Client,
+				TraceID:  traceID,
+				SpanID:   SpanID{8, 7, 6, 5, 4, 3, 2, 1},
+				ParentID: SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+				Start:    start,
+				End:      start.Add(time.Millisecond),
+				Attributes: []Attribute{
+					{Key: "retry", Value: true},
+					{Key: "bytes", Value: int64(1 << 40)},
+					{Key: "ratio", Value: 0.5},
+					{Key: "url", Value: errors.New("not a string")},
+				},
+				Error: "status Code: 502 received",
+			},
+			attrs: map[string]interface{}{
+				"retry": map[string]interface{}{"boolValue": true},
+				"bytes": map[string]interface{}{"intValue": "1099511627776"},
+				"ratio": map[string]interface{}{"doubleValue": 0.5},
+				"url":   map[string]interface{}{"stringValue": "not a string"},
+			},
+			status: otlpStatusError,
+		},
+		{
+			name: "internal span without attributes",
+			span: SpanData{
+				Name:    "convert",
+				Kind:    Internal,
+				TraceID: traceID,
+				SpanID:  SpanID{9, 9, 9, 9, 9, 9, 9, 9},
+				Start:   start,
+				End:     start,
+			},
+			attrs:  map[string]interface{}{},
+			status: otlpStatusOK,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newCollector(http.StatusOK)
+			defer c.Close()
+
+			e := NewOTLPExporter(c.URL, "big-iot-gateway")
+			if err := e.Export(context.Background(), []SpanData{tc.span}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(c.payloads) != 1 {
+				t.Fatalf("expected 1 request, got %d", len(c.payloads))
+			}
+			if c.paths[0] != "/v1/traces" || c.types[0] != "application/json" {
+				t.Errorf("expected a json post to /v1/traces, got %s %s", c.types[0], c.paths[0])
+			}
+			checkRequest(t, c.payloads[0])
+
+			spans := c.spans()
+			if len(spans) != 1 {
+				t.Fatalf("expected 1 span, got %d", len(spans))
+			}
+			s := spans[0]
+			if s["traceId"] != tc.span.TraceID.String() || s["spanId"] != tc.span.SpanID.String() {
+				t.Errorf("unexpected ids %v %v", s["traceId"], s["spanId"])
+			}
+			if tc.span.ParentID.IsValid() != (s["parentSpanId"] != nil) {
+				t.Errorf("unexpected parent %v", s["parentSpanId"])
+			}
+			if s["kind"] != float64(tc.span.Kind) {
+				t.Errorf("expected kind %d, got %v", tc.span.Kind, s["kind"])
+			}
+			if s["startTimeUnixNano"] != strconv.FormatInt(tc.span.Start.UnixNano(), 10) {
+				t.Errorf("unexpected start %v", s["startTimeUnixNano"])
+			}
+
+			status := s["status"].(map[string]interface{})
+			if status["code"] != tc.status {
+				t.Errorf("expected status %v, got %v", tc.status, status["code"])
+			}
+			if tc.span.Error != "" && status["message"] != tc.span.Error {
+				t.Errorf("expected status message %q, got %v", tc.span.Error, status["message"])
+			}
+
+			attrs := map[string]interface{}{}
+			if list, ok := s["attributes"].([]interface{}); ok {
+				for _, a := range list {
+					kv := a.(map[string]interface{})
+					attrs[kv["key"].(string)] = kv["value"]
+				}
+			}
+			got, _ := json.Marshal(attrs)
+			want, _ := json.Marshal(tc.attrs)
+			if string(got) != string(want) {
+				t.Errorf("expected attributes %s, got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestOTLPExporterURL(t *testing.T) {
+	testCases := []struct {
+		endpoint string
+		url      string
+	}{
+		{"http://localhost:4318", "http://localhost:4318/v1/traces"},
+		{"http://localhost:4318/", "http://localhost:4318/v1/traces"},
+		{"http://collector/v1/traces", "http://collector/v1/traces"},
+	}
+
+	for _, tc := range testCases {
+		if got := NewOTLPExporter(tc.endpoint, "gw").url; got != tc.url {
+			t.Errorf("%s: expected %s, got %s", tc.endpoint, tc.url, got)
+		}
+	}
+}
+
+func TestOTLPExporterStatus(t *testing.T) {
+	testCases := []struct {
+		status int
+		fails  bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusAccepted, false},
+		{http.StatusBadRequest, true},
+		{http.StatusServiceUnavailable, true},
+	}
+
+	for _, tc := range testCases {
+		c := newCollector(tc.status)
+		err := NewOTLPExporter(c.URL, "gw").Export(context.Background(), []SpanData{{Name: "span", Kind: Internal}})
+		c.Close()
+		if (err != nil) != tc.fails {
+			t.Errorf("status %d: unexpected error %v", tc.status, err)
+		}
+	}
+}
+
+func TestExportedTrace(t *testing.T) {
+	c := newCollector(http.StatusOK)
+	defer c.Close()
+
+	SetExporter(NewOTLPExporter(c.URL, "big-iot-gateway"))
+	defer SetExporter(nil)
+
+	ctx, root := Start(context.Background(), "request", Server)
+	root.Set("offering", "parking")
+	_, child := Start(ctx, "pipe", Client)
+	child.SetError(errors.New("timeout"))
+	child.End()
+	root.End()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, p := range c.payloads {
+		checkRequest(t, p)
+	}
+	spans := c.spans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	pipe, request := spans[0], spans[1]
+	if pipe["traceId"] != request["traceId"] {
+		t.Errorf("spans belong to different traces")
+	}
+	if pipe["parentSpanId"] != request["spanId"] {
+		t.Errorf("expected parent %v, got %v", request["spanId"], pipe["parentSpanId"])
+	}
+	if _, ok := request["parentSpanId"]; ok {
+		t.Errorf("root span has a parent %v", request["parentSpanId"])
+	}
+}
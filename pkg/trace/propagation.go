@@ -0,0 +1,83 @@
+package trace
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// TraceParentHeader carries the span context as defined by W3C Trace
+	// Context
+	TraceParentHeader = "traceparent"
+	// TraceStateHeader carries vendor specific trace data, passed on untouched
+	TraceStateHeader = "tracestate"
+)
+
+// Inject sets the traceparent of the span in ctx on h
+func Inject(ctx context.Context, h http.Header) {
+	sc, ok := spanContext(ctx)
+	if !ok {
+		return
+	}
+
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	h.Set(TraceParentHeader, fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags))
+	if sc.TraceState != "" {
+		h.Set(TraceStateHeader, sc.TraceState)
+	}
+}
+
+// Extract returns a context holding the span context received in h, or ctx
+// as is when there isn't a valid traceparent
+func Extract(ctx context.Context, h http.Header) context.Context {
+	sc, ok := parseTraceParent(h.Get(TraceParentHeader))
+	if !ok {
+		return ctx
+	}
+	sc.TraceState = h.Get(TraceStateHeader)
+	return ContextWithRemote(ctx, sc)
+}
+
+// parseTraceParent parses a version-traceid-spanid-flags header
+func parseTraceParent(v string) (SpanContext, bool) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	// version 00 has exactly four fields, later versions may add more
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+
+	if !decodeHex(sc.TraceID[:], parts[1]) || !decodeHex(sc.SpanID[:], parts[2]) {
+		return sc, false
+	}
+	if !sc.TraceID.IsValid() || !sc.SpanID.IsValid() {
+		return sc, false
+	}
+
+	var flags [1]byte
+	if !decodeHex(flags[:], parts[3]) {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+
+	return sc, true
+}
+
+// decodeHex decodes lowercase hex s into dst, which it must fill exactly
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
@@ -0,0 +1,194 @@
+// Package trace is a small tracer covering what the gateway needs, not an
+// OpenTelemetry SDK. It supports:
+//
+//   - spans with attributes and an error status. New traces are sampled
+//     while an exporter is set, continued ones follow the caller's flag
+//   - W3C traceparent and tracestate propagation, baggage is not propagated
+//   - exporting to a writer as JSON lines, or to a collector with OTLP/HTTP
+//     using the JSON encoding of trace requests
+//
+// There are no sampling ratios, span events or links, metrics or logs, and
+// OTLP exports aren't compressed nor retried, a failed batch is logged and
+// dropped. A full SDK can replace it behind the same Start and Span calls.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a whole trace
+type TraceID [16]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// IsValid reports whether t isn't all zeros
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// IsValid reports whether s isn't all zeros
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+// SpanContext is the part of a span propagated to other services
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Sampled    bool
+	TraceState string
+}
+
+// Kind describes the relationship of a span with its parent, using the
+// OpenTelemetry values
+type Kind int
+
+const (
+	// Internal spans are operations within the gateway
+	Internal Kind = 1
+	// Server spans handle a request from a consumer
+	Server Kind = 2
+	// Client spans are requests to a pipe or the marketplace
+	Client Kind = 3
+)
+
+// Span is a timed operation, it's safe for concurrent use
+type Span struct {
+	name   string
+	kind   Kind
+	sc     SpanContext
+	parent SpanID
+	start  time.Time
+
+	mu    sync.Mutex
+	attrs []Attribute
+	err   string
+	ended bool
+}
+
+// Attribute is a key value pair describing a span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+type contextKey int
+
+const spanKey contextKey = iota
+
+// Start creates a span as a child of the span, or remote span context, found
+// in ctx, and returns a context holding the new span. Every span must be
+// ended with End.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	s := &Span{
+		name:  name,
+		kind:  kind,
+		start: time.Now(),
+	}
+
+	if parent, ok := spanContext(ctx); ok {
+		s.sc = parent
+		s.parent = parent.SpanID
+	} else {
+		rand.Read(s.sc.TraceID[:])
+		s.sc.Sampled = enabled()
+	}
+	rand.Read(s.sc.SpanID[:])
+
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+// FromContext returns the span in ctx, if any
+func FromContext(ctx context.Context) (*Span, bool) {
+	s, ok := ctx.Value(spanKey).(*Span)
+	return s, ok
+}
+
+// ContextWithRemote returns a context whose spans are children of a span
+// started by another service
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanKey, &Span{sc: sc, ended: true})
+}
+
+func spanContext(ctx context.Context) (SpanContext, bool) {
+	s, ok := FromContext(ctx)
+	if !ok {
+		return SpanContext{}, false
+	}
+	return s.sc, true
+}
+
+// Context returns the span context to propagate
+func (s *Span) Context() SpanContext {
+	return s.sc
+}
+
+// Set adds an attribute to the span
+func (s *Span) Set(key string, value interface{}) {
+	s.mu.Lock()
+	s.attrs = append(s.attrs, Attribute{Key: key, Value: value})
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed, a nil err is ignored
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export if it's sampled, further
+// calls do nothing
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	data := SpanData{
+		Name:       s.name,
+		Kind:       s.kind,
+		TraceID:    s.sc.TraceID,
+		SpanID:     s.sc.SpanID,
+		ParentID:   s.parent,
+		Start:      s.start,
+		End:        time.Now(),
+		Attributes: append([]Attribute{}, s.attrs...),
+		Error:      s.err,
+	}
+	s.mu.Unlock()
+
+	if s.sc.Sampled {
+		queue(data)
+	}
+}
+
+// SpanData is a finished span as handed to an Exporter
+type SpanData struct {
+	Name       string
+	Kind       Kind
+	TraceID    TraceID
+	SpanID     SpanID
+	ParentID   SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+	Error      string
+}
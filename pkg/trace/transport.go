@@ -0,0 +1,62 @@
+package trace
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Transport wraps every outgoing request in a client span called Name and
+// propagates it with a traceparent header
+type Transport struct {
+	Name    string
+	Proxied http.RoundTripper
+}
+
+// RoundTrip starts the span and sends the request
+func (t Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	proxied := t.Proxied
+	if proxied == nil {
+		proxied = http.DefaultTransport
+	}
+
+	ctx, span := Start(req.Context(), t.Name, Client)
+	defer span.End()
+	span.Set("http.method", req.Method)
+	span.Set("http.url", URL(req))
+
+	// RoundTrippers must not modify the request they are given
+	r := req.WithContext(ctx)
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	Inject(ctx, r.Header)
+
+	resp, err := proxied.RoundTrip(r)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	span.Set("http.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		span.SetError(&statusError{resp.Status})
+	}
+	return resp, nil
+}
+
+// URL returns the url of req without query or credentials, which may hold
+// secrets such as api keys
+func URL(req *http.Request) string {
+	u := *req.URL
+	u.RawQuery = ""
+	u.User = nil
+	return strings.TrimSuffix(u.String(), "?")
+}
+
+type statusError struct {
+	status string
+}
+
+func (e *statusError) Error() string {
+	return e.status
+}
@@ -0,0 +1,305 @@
+// Package webhook notifies external services of the state changes of the
+// gateway, posting events as signed json or as Slack messages
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/log"
+)
+
+// event types
+const (
+	OfferingRegistered         = "offering.registered"
+	OfferingActivated          = "offering.activated"
+	OfferingDeactivated        = "offering.deactivated"
+	OfferingDeleted            = "offering.deleted"
+	OfferingRegistrationFailed = "offering.registration_failed"
+	OfferingDrifting           = "offering.drifting"
+	OfferingDriftResolved      = "offering.drift_resolved"
+	PipeFailed                 = "pipe.failed"
+	PipeRecovered              = "pipe.recovered"
+	AuthFailed                 = "auth.failed"
+)
+
+// target formats
+const (
+	FormatJSON  = "json"
+	FormatSlack = "slack"
+)
+
+const (
+	// DefaultRetries is the number of extra attempts made to deliver an event
+	DefaultRetries = 3
+
+	queueSize = 256
+	timeout   = 10 * time.Second
+)
+
+// retryWait is the wait before the first retry, doubled on every one
+var retryWait = time.Second
+
+// SignatureHeader carries the hex encoded HMAC-SHA256 of the body of json
+// deliveries, prefixed with sha256=
+const SignatureHeader = "X-Gateway-Signature"
+
+// Event is a state change of the gateway
+type Event struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	OfferingID string    `json:"offeringId,omitempty"`
+	Provider   string    `json:"provider,omitempty"`
+	Pipe       string    `json:"pipe,omitempty"`
+	Message    string    `json:"message"`
+	Error      string    `json:"error,omitempty"`
+	RequestID  string    `json:"requestId,omitempty"`
+}
+
+// Target is where events are posted. Secret signs json deliveries, Events
+// filters the types sent, every type when empty.
+type Target struct {
+	URL     string
+	Format  string
+	Secret  string
+	Events  []string
+	Retries int
+}
+
+// sender delivers the events of a target in order, from its own queue so a
+// slow target doesn't hold back the others
+type sender struct {
+	target Target
+	host   string
+	events chan Event
+	client *http.Client
+}
+
+var (
+	mu      sync.RWMutex
+	senders []*sender
+	wg      sync.WaitGroup
+)
+
+// Configure starts delivering events to targets. It must be called at most
+// once before Shutdown.
+func Configure(targets []Target) error {
+	configured := make([]*sender, 0, len(targets))
+	for i, t := range targets {
+		u, err := url.Parse(t.URL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("webhook %d: invalid url", i)
+		}
+		switch t.Format {
+		case "":
+			t.Format = FormatJSON
+		case FormatJSON, FormatSlack:
+		default:
+			return fmt.Errorf("webhook %d: unknown format %s", i, t.Format)
+		}
+		if t.Retries < 0 {
+			return fmt.Errorf("webhook %d: retries can't be negative", i)
+		}
+
+		configured = append(configured, &sender{
+			target: t,
+			host:   u.Host,
+			events: make(chan Event, queueSize),
+			client: &http.Client{Timeout: timeout},
+		})
+	}
+
+	mu.Lock()
+	senders = configured
+	mu.Unlock()
+
+	for _, s := range configured {
+		wg.Add(1)
+		go s.run()
+	}
+	return nil
+}
+
+// Fire queues e for every target subscribed to its type. It never blocks, an
+// event is dropped when a target's queue is full.
+func Fire(ctx context.Context, e Event) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if len(senders) == 0 {
+		return
+	}
+
+	e.ID = newID()
+	e.Time = time.Now().UTC()
+	e.RequestID = log.RequestID(ctx)
+
+	for _, s := range senders {
+		if !s.subscribed(e.Type) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			deadLetter(s, e, errors.New("queue full"))
+		}
+	}
+}
+
+// Shutdown delivers the events still queued, waiting until ctx is done at
+// most. Events fired afterwards are dropped.
+func Shutdown(ctx context.Context) error {
+	mu.Lock()
+	for _, s := range senders {
+		close(s.events)
+	}
+	senders = nil
+	mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *sender) subscribed(eventType string) bool {
+	if len(s.target.Events) == 0 {
+		return true
+	}
+	for _, t := range s.target.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *sender) run() {
+	defer wg.Done()
+	for e := range s.events {
+		s.deliver(e)
+	}
+}
+
+// deliver posts e, retrying with a doubling wait, and dead letters it when
+// every attempt failed
+func (s *sender) deliver(e Event) {
+	body, err := s.payload(e)
+	if err != nil {
+		deadLetter(s, e, err)
+		return
+	}
+
+	wait := retryWait
+	for attempt := 0; attempt <= s.target.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+		if err = s.post(e, body); err == nil {
+			return
+		}
+		log.Debug(eventContext(e), "webhook", s.host, "event", e.Type, "attempt", attempt+1, "error", err)
+	}
+	deadLetter(s, e, err)
+}
+
+func (s *sender) post(e Event, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.target.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.target.Format == FormatJSON {
+		req.Header.Set("X-Gateway-Event", e.Type)
+		req.Header.Set("X-Gateway-Delivery", e.ID)
+		if s.target.Secret != "" {
+			req.Header.Set(SignatureHeader, Sign(s.target.Secret, body))
+		}
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status Code: %d received", resp.StatusCode)
+	}
+	return nil
+}
+
+// payload encodes e for the format of the target
+func (s *sender) payload(e Event) ([]byte, error) {
+	if s.target.Format == FormatSlack {
+		return json.Marshal(map[string]string{"text": slackText(e)})
+	}
+	return json.Marshal(e)
+}
+
+// slackText is the message posted to Slack for e
+func slackText(e Event) string {
+	text := "*" + e.Type + "*"
+	if e.OfferingID != "" {
+		text += " `" + e.OfferingID + "`"
+	}
+	if e.Provider != "" {
+		text += " (provider " + e.Provider + ")"
+	}
+	if e.Pipe != "" {
+		text += " pipe " + e.Pipe
+	}
+	text += ": " + e.Message
+	if e.Error != "" {
+		text += "\n> " + e.Error
+	}
+	return text
+}
+
+// Sign returns the signature of a json delivery, receivers compute it over
+// the raw body with the shared secret and compare it with SignatureHeader
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deadLetter logs an event that couldn't be delivered, so it can still be
+// found and replayed
+func deadLetter(s *sender, e Event, err error) {
+	b, _ := json.Marshal(e)
+	log.Error(eventContext(e), "webhook", s.host, "event", e.Type, "error", err, "payload", string(b), "msg", "webhook delivery failed, dead letter")
+}
+
+// eventContext carries the request id of the event to its log lines
+func eventContext(e Event) context.Context {
+	return log.WithRequestID(context.Background(), e.RequestID)
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
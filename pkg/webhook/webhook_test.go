@@ -0,0 +1,260 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thingful/big-iot-gateway/pkg/log"
+)
+
+// receiver is a local webhook endpoint answering with the given statuses in
+// turn, the last one from then on
+type receiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []delivery
+}
+
+type delivery struct {
+	header http.Header
+	body   []byte
+}
+
+func newReceiver(statuses ...int) *receiver {
+	r := &receiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+
+		r.mu.Lock()
+		status := r.statuses[0]
+		if len(r.statuses) > 1 {
+			r.statuses = r.statuses[1:]
+		}
+		r.requests = append(r.requests, delivery{header: req.Header, body: body})
+		r.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	return r
+}
+
+// captureLog returns a func stopping the capture of the log lines written
+// meanwhile and returning them
+func captureLog(t *testing.T) func() string {
+	t.Helper()
+
+	f, err := ioutil.TempFile("", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = f
+	log.SetFormat("json")
+
+	return func() string {
+		os.Stdout = stdout
+		log.SetFormat("json")
+		f.Close()
+		b, _ := ioutil.ReadFile(f.Name())
+		os.Remove(f.Name())
+		return string(b)
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	retryWait = time.Millisecond
+	defer func() { retryWait = time.Second }()
+
+	event := Event{Type: OfferingDeleted, OfferingID: "parking", Provider: "default", Message: "gone"}
+
+	testCases := []struct {
+		name       string
+		target     Target
+		statuses   []int
+		event      Event
+		attempts   int
+		deadLetter bool
+		check      func(t *testing.T, d delivery)
+	}{
+		{
+			name:     "signed json",
+			target:   Target{Secret: "s3cr3t"},
+			statuses: []int{http.StatusOK},
+			event:    event,
+			attempts: 1,
+			check: func(t *testing.T, d delivery) {
+				mac := hmac.New(sha256.New, []byte("s3cr3t"))
+				mac.Write(d.body)
+				if sig := d.header.Get(SignatureHeader); sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+					t.Errorf("invalid signature %s", sig)
+				}
+				if d.header.Get("X-Gateway-Event") != OfferingDeleted || d.header.Get("X-Gateway-Delivery") == "" {
+					t.Errorf("missing event headers %v", d.header)
+				}
+				e := Event{}
+				if err := json.Unmarshal(d.body, &e); err != nil {
+					t.Fatal(err)
+				}
+				if e.Type != OfferingDeleted || e.OfferingID != "parking" || e.ID != d.header.Get("X-Gateway-Delivery") || e.Time.IsZero() {
+					t.Errorf("unexpected event %+v", e)
+				}
+			},
+		},
+		{
+			name:     "unsigned json",
+			target:   Target{},
+			statuses: []int{http.StatusNoContent},
+			event:    event,
+			attempts: 1,
+			check: func(t *testing.T, d delivery) {
+				if sig := d.header.Get(SignatureHeader); sig != "" {
+					t.Errorf("unexpected signature %s", sig)
+				}
+			},
+		},
+		{
+			name:     "slack",
+			target:   Target{Format: FormatSlack, Secret: "ignored"},
+			statuses: []int{http.StatusOK},
+			event:    Event{Type: PipeFailed, Pipe: "https://pipe", Message: "circuit open", Error: "timeout"},
+			attempts: 1,
+			check: func(t *testing.T, d delivery) {
+				msg := map[string]string{}
+				json.Unmarshal(d.body, &msg)
+				if msg["text"] != "*pipe.failed* pipe https://pipe: circuit open\n> timeout" {
+					t.Errorf("unexpected slack message %q", msg["text"])
+				}
+				if d.header.Get(SignatureHeader) != "" || d.header.Get("X-Gateway-Event") != "" {
+					t.Errorf("unexpected headers %v", d.header)
+				}
+			},
+		},
+		{
+			name:     "filtered out",
+			target:   Target{Events: []string{OfferingRegistered}},
+			statuses: []int{http.StatusOK},
+			event:    event,
+			attempts: 0,
+		},
+		{
+			name:     "subscribed",
+			target:   Target{Events: []string{OfferingRegistered, OfferingDeleted}},
+			statuses: []int{http.StatusOK},
+			event:    event,
+			attempts: 1,
+		},
+		{
+			name:     "retried until delivered",
+			target:   Target{Retries: 3},
+			statuses: []int{http.StatusBadGateway, http.StatusInternalServerError, http.StatusOK},
+			event:    event,
+			attempts: 3,
+		},
+		{
+			name:       "dead letter after every retry",
+			target:     Target{Retries: 2},
+			statuses:   []int{http.StatusInternalServerError},
+			event:      event,
+			attempts:   3,
+			deadLetter: true,
+		},
+		{
+			name:       "dead letter without retries",
+			target:     Target{},
+			statuses:   []int{http.StatusBadRequest},
+			event:      event,
+			attempts:   1,
+			deadLetter: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newReceiver(tc.statuses...)
+			defer r.Close()
+
+			stopCapture := captureLog(t)
+
+			target := tc.target
+			target.URL = r.URL + "/hook"
+			if err := Configure([]Target{target}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			Fire(context.Background(), tc.event)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := Shutdown(ctx); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			logged := stopCapture()
+
+			if len(r.requests) != tc.attempts {
+				t.Fatalf("expected %d attempts, got %d", tc.attempts, len(r.requests))
+			}
+			if deadLetter := strings.Contains(logged, "dead letter"); deadLetter != tc.deadLetter {
+				t.Errorf("expected dead letter %v, got log %s", tc.deadLetter, logged)
+			}
+			if tc.deadLetter && !strings.Contains(logged, `\"offeringId\":\"parking\"`) {
+				t.Errorf("expected the payload in the dead letter, got %s", logged)
+			}
+			if tc.check != nil && len(r.requests) > 0 {
+				tc.check(t, r.requests[len(r.requests)-1])
+			}
+		})
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	testCases := []struct {
+		name   string
+		target Target
+		fails  bool
+	}{
+		{"json by default", Target{URL: "https://hooks.example/gw"}, false},
+		{"slack", Target{URL: "https://hooks.slack.com/services/T0/B0/X", Format: FormatSlack}, false},
+		{"missing host", Target{URL: "/gw"}, true},
+		{"invalid url", Target{URL: "://"}, true},
+		{"unknown format", Target{URL: "https://hooks.example/gw", Format: "xml"}, true},
+		{"negative retries", Target{URL: "https://hooks.example/gw", Retries: -1}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Configure([]Target{tc.target})
+			if (err != nil) != tc.fails {
+				t.Errorf("unexpected error %v", err)
+			}
+			if err == nil {
+				Shutdown(context.Background())
+			}
+		})
+	}
+}
+
+func TestFireWithoutTargets(t *testing.T) {
+	// nothing configured, or already shut down, never blocks
+	done := make(chan struct{})
+	go func() {
+		Fire(context.Background(), Event{Type: AuthFailed})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Fire blocked")
+	}
+}